@@ -0,0 +1,93 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Adaptive Spill Codec -------------------
+
+// With --run-codec auto the codec of every spill is chosen from the cost
+// of the previous ones: the wall time per record of writing a spill with
+// each of none, s2 and zstd, averaged exponentially. On a CPU-starved
+// machine compression dominates that time and none wins; where the disk
+// is the bottleneck, smaller spills are written faster and s2 or zstd
+// win. Each codec is tried once, then the cheapest is used, and every
+// probeEvery-th spill re-measures the codec measured longest ago, so the
+// choice follows changes in load during the run.
+var autoCodec bool
+
+var adaptiveCodecs = []runfile.Codec{runfile.CodecNone, runfile.CodecS2, runfile.CodecZstd}
+
+const (
+	probeEvery = 8
+	costWeight = 0.3 // weight of a new measurement in the average
+)
+
+type codecCost struct {
+	nsPerRecord float64
+	measured    int // spill number of the last measurement, 0 for never
+}
+
+var adaptive struct {
+	sync.Mutex
+	costs  map[runfile.Codec]*codecCost
+	spills int
+}
+
+// chooseCodec returns the codec of the next spill.
+func chooseCodec() runfile.Codec {
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	if adaptive.costs == nil {
+		adaptive.costs = make(map[runfile.Codec]*codecCost)
+		for _, c := range adaptiveCodecs {
+			adaptive.costs[c] = &codecCost{}
+		}
+	}
+	adaptive.spills++
+
+	best, stalest := adaptiveCodecs[0], adaptiveCodecs[0]
+	for _, c := range adaptiveCodecs {
+		cost := adaptive.costs[c]
+		if cost.measured == 0 {
+			return c
+		}
+		if cost.nsPerRecord < adaptive.costs[best].nsPerRecord {
+			best = c
+		}
+		if cost.measured < adaptive.costs[stalest].measured {
+			stalest = c
+		}
+	}
+	if adaptive.spills%probeEvery == 0 {
+		return stalest
+	}
+	return best
+}
+
+// recordSpillCost adds the measured cost of a spill written with codec.
+func recordSpillCost(codec runfile.Codec, records int, elapsed time.Duration) {
+	if records == 0 {
+		return
+	}
+	adaptive.Lock()
+	defer adaptive.Unlock()
+	cost, ok := adaptive.costs[codec]
+	if !ok {
+		return // forced by --max-temp-bytes
+	}
+	ns := float64(elapsed.Nanoseconds()) / float64(records)
+	if cost.measured == 0 {
+		cost.nsPerRecord = ns
+	} else {
+		cost.nsPerRecord += costWeight * (ns - cost.nsPerRecord)
+	}
+	cost.measured = adaptive.spills
+	if stats.spillCodecs == nil {
+		stats.spillCodecs = make(map[string]int)
+	}
+	stats.spillCodecs[codec.String()]++
+}
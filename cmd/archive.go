@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ------------------- Archives -------------------
+
+// isArchive tells tar archives, compressed or not, and zip archives by
+// their name. Their member files are counted one after the other, without
+// unpacking them, filtered by --include and --exclude.
+func isArchive(name string) bool {
+	if dec := decoderByName(name); dec != nil {
+		name = strings.TrimSuffix(name, dec.suffix)
+	}
+	for _, suffix := range []string{".tar", ".tgz", ".zip"} {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func processArchive(archive string) ([]string, error) {
+	if strings.HasSuffix(archive, ".zip") {
+		return processZip(archive)
+	}
+	content, file, err := openContent(archive, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	defer content.Close()
+	start := file.pos
+	defer func() { inputDone += file.pos - start }()
+
+	var tempFiles []string
+	tr := tar.NewReader(content)
+	for !stats.limited {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", inputName(archive), err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !selectedFile(path.Base(hdr.Name)) {
+			continue
+		}
+		runs, err := countMember(inputName(archive)+":"+hdr.Name, tr, func() int64 { return inputDone + file.pos - start })
+		if err != nil {
+			return nil, err
+		}
+		tempFiles = append(tempFiles, runs...)
+	}
+	return tempFiles, nil
+}
+
+// processZip counts the members of a zip archive, which has its directory
+// at the end and so must be a local file.
+func processZip(archive string) ([]string, error) {
+	if archive == stdinPath || isURL(archive) {
+		return nil, fmt.Errorf("%s: zip archives can only be read from local files", inputName(archive))
+	}
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	var done int64
+	defer func() { inputDone += done }()
+
+	var tempFiles []string
+	for _, f := range zr.File {
+		if stats.limited {
+			break
+		}
+		if !f.Mode().IsRegular() || !selectedFile(path.Base(f.Name)) {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%s:%s: %w", archive, f.Name, err)
+		}
+		runs, err := countMember(archive+":"+f.Name, r, func() int64 { return inputDone + done })
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		tempFiles = append(tempFiles, runs...)
+		done += int64(f.CompressedSize64)
+	}
+	return tempFiles, nil
+}
+
+// countMember counts one archive member, decompressing it if needed and
+// applying the per-file options like any other input.
+func countMember(name string, r io.Reader, progress func() int64) ([]string, error) {
+	content, err := decodeStream(r, name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	defer content.Close()
+	if _, err := io.CopyN(io.Discard, content, skipBytes); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("%s: %w", name, err)
+	}
+	return countContent(name, content, progress)
+}
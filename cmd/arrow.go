@@ -0,0 +1,325 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Arrow IPC -------------------
+
+// arrowWriter writes the result as an Arrow IPC stream (the format read by
+// pyarrow.ipc.open_stream and arrow::read_ipc_stream): a schema message,
+// record batches of arrowBatch rows and an end-of-stream marker. The key
+// column is "word" (utf8); the values are "count" (int64, or float64 for
+// float results), or "value1".."valueN" with --value-columns N.
+type arrowWriter struct {
+	w       *bufio.Writer
+	float   bool
+	words   []byte
+	offsets []int32
+	ints    [][]int64
+	floats  [][]float64
+	rows    int
+}
+
+const arrowBatch = 1 << 16
+
+// Flatbuffer constants from the Arrow format's Schema.fbs and Message.fbs.
+const (
+	arrowMetadataV5     = 4
+	arrowHeaderSchema   = 1
+	arrowHeaderBatch    = 3
+	arrowTypeInt        = 2
+	arrowTypeFloat      = 3
+	arrowTypeUtf8       = 5
+	arrowPrecisionFloat = 2 // DOUBLE
+	arrowContinuation   = 0xFFFFFFFF
+)
+
+func newArrowWriter(w io.Writer) (recordWriter, error) {
+	aw := &arrowWriter{
+		w:       bufio.NewWriter(w),
+		float:   resultKind() == runfile.KindFloat,
+		offsets: []int32{0},
+		ints:    make([][]int64, valueColumns),
+		floats:  make([][]float64, valueColumns),
+	}
+	return aw, aw.message(aw.schema(), nil)
+}
+
+func (a *arrowWriter) schema() *fbTable {
+	valueType := &fbTable{}
+	valueType.scalar(0, 4, 64).scalar(1, 1, 1) // Int{bitWidth: 64, is_signed: true}
+	valueTypeID := uint64(arrowTypeInt)
+	if a.float {
+		valueType = (&fbTable{}).scalar(0, 2, arrowPrecisionFloat)
+		valueTypeID = arrowTypeFloat
+	}
+
+	field := func(name string, typeID uint64, typ *fbTable) fbObject {
+		return (&fbTable{}).
+			ref(0, fbString(name)).
+			scalar(1, 1, 0). // nullable: false
+			scalar(2, 1, typeID).
+			ref(3, typ).
+			ref(5, fbTables{})
+	}
+	fields := fbTables{field("word", arrowTypeUtf8, &fbTable{})}
+	for _, name := range valueColumnNames() {
+		fields = append(fields, field(name, valueTypeID, valueType))
+	}
+	schema := (&fbTable{}).scalar(0, 2, 0).ref(1, fields) // little endian
+
+	return (&fbTable{}).
+		scalar(0, 2, arrowMetadataV5).
+		scalar(1, 1, arrowHeaderSchema).
+		ref(2, schema)
+}
+
+func (a *arrowWriter) Write(word string, t tally) error {
+	a.words = append(a.words, word...)
+	if len(a.words) > math.MaxInt32 {
+		return fmt.Errorf("arrow: record batch exceeds 2 GiB of words")
+	}
+	a.offsets = append(a.offsets, int32(len(a.words)))
+	for i := range valueColumns {
+		n, f := t.column(i).final()
+		a.ints[i] = append(a.ints[i], n)
+		a.floats[i] = append(a.floats[i], f)
+	}
+	a.rows++
+	if a.rows >= arrowBatch {
+		return a.flush()
+	}
+	return nil
+}
+
+// flush writes the buffered rows as one record batch.
+func (a *arrowWriter) flush() error {
+	if a.rows == 0 {
+		return nil
+	}
+	var body []byte
+	var buffers []byte
+	addBuffer := func(data []byte) {
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(body)))
+		buffers = binary.LittleEndian.AppendUint64(buffers, uint64(len(data)))
+		body = append(body, data...)
+		body = append(body, make([]byte, pad8(len(body)))...)
+	}
+
+	var offsets []byte
+	for _, o := range a.offsets {
+		offsets = binary.LittleEndian.AppendUint32(offsets, uint32(o))
+	}
+	addBuffer(nil) // validity: all rows are valid
+	addBuffer(offsets)
+	addBuffer(a.words)
+	for i := range valueColumns {
+		values := make([]byte, 0, 8*a.rows)
+		for r := range a.rows {
+			if a.float {
+				values = binary.LittleEndian.AppendUint64(values, math.Float64bits(a.floats[i][r]))
+			} else {
+				values = binary.LittleEndian.AppendUint64(values, uint64(a.ints[i][r]))
+			}
+		}
+		addBuffer(nil)
+		addBuffer(values)
+	}
+
+	var nodes []byte
+	for range 1 + valueColumns {
+		nodes = binary.LittleEndian.AppendUint64(nodes, uint64(a.rows))
+		nodes = binary.LittleEndian.AppendUint64(nodes, 0) // null count
+	}
+	batch := (&fbTable{}).
+		scalar(0, 8, uint64(a.rows)).
+		ref(1, fbStructs{nodes, 1 + valueColumns}).
+		ref(2, fbStructs{buffers, len(buffers) / 16})
+	msg := (&fbTable{}).
+		scalar(0, 2, arrowMetadataV5).
+		scalar(1, 1, arrowHeaderBatch).
+		ref(2, batch).
+		scalar(3, 8, uint64(len(body)))
+
+	a.words = a.words[:0]
+	a.offsets = a.offsets[:1]
+	for i := range valueColumns {
+		a.ints[i] = a.ints[i][:0]
+		a.floats[i] = a.floats[i][:0]
+	}
+	a.rows = 0
+	return a.message(msg, body)
+}
+
+// message writes an encapsulated IPC message: continuation marker,
+// metadata length, the flatbuffer padded to 8 bytes, then the body.
+func (a *arrowWriter) message(header *fbTable, body []byte) error {
+	meta := fbEncode(header)
+	meta = append(meta, make([]byte, pad8(8+len(meta)))...)
+	var prefix [8]byte
+	binary.LittleEndian.PutUint32(prefix[0:], arrowContinuation)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(len(meta)))
+	a.w.Write(prefix[:])
+	a.w.Write(meta)
+	_, err := a.w.Write(body)
+	return err
+}
+
+func (a *arrowWriter) Close() error {
+	if err := a.flush(); err != nil {
+		return err
+	}
+	var eos [8]byte
+	binary.LittleEndian.PutUint32(eos[0:], arrowContinuation)
+	a.w.Write(eos[:])
+	return a.w.Flush()
+}
+
+func pad8(n int) int { return (8 - n%8) % 8 }
+
+// A minimal flatbuffer encoder, enough for Arrow's metadata. It lays the
+// buffer out front to back: every table is preceded by its vtable and
+// followed by the objects it references, so all uoffsets point forward.
+
+type fbObject interface {
+	encode(b *fbBuilder) int // returns the object's position
+}
+
+type fbBuilder struct{ buf []byte }
+
+func (b *fbBuilder) align(n int) {
+	for len(b.buf)%n != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) patch(at, target int) {
+	binary.LittleEndian.PutUint32(b.buf[at:], uint32(target-at))
+}
+
+func fbEncode(root fbObject) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.patch(0, root.encode(b))
+	return b.buf
+}
+
+type fbField struct {
+	id     int
+	size   int // of the inline value: 1, 2, 4 or 8; 4 for references
+	scalar uint64
+	ref    fbObject
+}
+
+type fbTable struct{ fields []fbField }
+
+func (t *fbTable) scalar(id, size int, v uint64) *fbTable {
+	t.fields = append(t.fields, fbField{id: id, size: size, scalar: v})
+	return t
+}
+
+func (t *fbTable) ref(id int, o fbObject) *fbTable {
+	t.fields = append(t.fields, fbField{id: id, size: 4, ref: o})
+	return t
+}
+
+func (t *fbTable) encode(b *fbBuilder) int {
+	// Lay out inline fields largest first after the 4-byte vtable offset,
+	// so each is aligned to its size within the 8-aligned table.
+	fields := slices.Clone(t.fields)
+	slices.SortStableFunc(fields, func(x, y fbField) int { return y.size - x.size })
+	inline := make([]int, len(fields))
+	size := 4
+	for i, f := range fields {
+		size += (f.size - size%f.size) % f.size
+		inline[i] = size
+		size += f.size
+	}
+
+	numIDs := 0
+	for _, f := range fields {
+		numIDs = max(numIDs, f.id+1)
+	}
+	vtable := make([]byte, 4+2*numIDs)
+	binary.LittleEndian.PutUint16(vtable[0:], uint16(len(vtable)))
+	binary.LittleEndian.PutUint16(vtable[2:], uint16(size))
+	for i, f := range fields {
+		binary.LittleEndian.PutUint16(vtable[4+2*f.id:], uint16(inline[i]))
+	}
+	b.align(2)
+	vt := len(b.buf)
+	b.buf = append(b.buf, vtable...)
+
+	b.align(8)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	binary.LittleEndian.PutUint32(b.buf[pos:], uint32(int32(pos-vt)))
+	for i, f := range fields {
+		at := pos + inline[i]
+		switch {
+		case f.ref != nil:
+		case f.size == 1:
+			b.buf[at] = byte(f.scalar)
+		case f.size == 2:
+			binary.LittleEndian.PutUint16(b.buf[at:], uint16(f.scalar))
+		case f.size == 4:
+			binary.LittleEndian.PutUint32(b.buf[at:], uint32(f.scalar))
+		default:
+			binary.LittleEndian.PutUint64(b.buf[at:], f.scalar)
+		}
+	}
+	for i, f := range fields {
+		if f.ref != nil {
+			b.patch(pos+inline[i], f.ref.encode(b))
+		}
+	}
+	return pos
+}
+
+type fbString string
+
+func (s fbString) encode(b *fbBuilder) int {
+	b.align(4)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
+
+// fbTables is a vector of tables.
+type fbTables []fbObject
+
+func (v fbTables) encode(b *fbBuilder) int {
+	b.align(4)
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(len(v)))
+	b.buf = append(b.buf, make([]byte, 4*len(v))...)
+	for i, o := range v {
+		b.patch(pos+4+4*i, o.encode(b))
+	}
+	return pos
+}
+
+// fbStructs is a vector of n 8-aligned structs, already encoded.
+type fbStructs struct {
+	data []byte
+	n    int
+}
+
+func (v fbStructs) encode(b *fbBuilder) int {
+	for len(b.buf)%8 != 4 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := len(b.buf)
+	b.buf = binary.LittleEndian.AppendUint32(b.buf, uint32(v.n))
+	b.buf = append(b.buf, v.data...)
+	return pos
+}
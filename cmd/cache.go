@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ------------------- Result Cache -------------------
+
+var cacheDir string
+
+// uncachedFlags do not influence the result, so they are left out of the
+// cache key.
+var uncachedFlags = map[string]bool{
+	"cache-dir":   true,
+	"incremental": true,
+	"job-id":      true,
+	"json":        true,
+	"notify-url":  true,
+	"status-file": true,
+	"output":      true,
+	"o":           true,
+	"temp-dir":    true,
+	"redis":       true,
+	"redis-key":   true,
+	"redis-top":   true,
+
+	"clickhouse":       true,
+	"clickhouse-table": true,
+}
+
+// fileFlags name a file whose content, not its path, goes into the cache
+// key, so editing the file invalidates cached results.
+var fileFlags = map[string]bool{
+	"stopwords": true,
+	"cjk-dict":  true,
+}
+
+// cacheKey identifies a result by the content of the inputs and by every
+// option that can change it. MAX_WORDS_IN_MEMORY only affects how the work
+// is split, so it is not part of the key.
+func cacheKey(mode string, inputs []string) (string, error) {
+	h := sha256.New()
+	if err := writeConfig(h, mode); err != nil {
+		return "", err
+	}
+	for _, input := range inputs {
+		digest, err := fileDigest(input)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "input %s\n", digest)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeConfig writes the mode and every option that can change a result
+// to h, skipping those named in skip as well as uncachedFlags.
+func writeConfig(h io.Writer, mode string, skip ...string) error {
+	fmt.Fprintf(h, "mode=%s\n", mode)
+	var err error
+	flag.VisitAll(func(f *flag.Flag) {
+		switch {
+		case uncachedFlags[f.Name] || slices.Contains(skip, f.Name):
+		case fileFlags[f.Name] && f.Value.String() != "":
+			digest, digestErr := fileDigest(f.Value.String())
+			if err == nil {
+				err = digestErr
+			}
+			fmt.Fprintf(h, "flag %s@%s\n", f.Name, digest)
+		default:
+			fmt.Fprintf(h, "flag %s=%s\n", f.Name, f.Value)
+		}
+	})
+	return err
+}
+
+func fileDigest(path string) (string, error) {
+	if isURL(path) {
+		return urlDigest(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func cachePath(key string) string {
+	return filepath.Join(cacheDir, key+"."+outputFormat)
+}
+
+// copyFileAtomic copies src to dst through a temporary file in dst's
+// directory, so readers never observe a partially written file.
+func copyFileAtomic(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp, err := os.CreateTemp(filepath.Dir(dst), ".wordcount_copy_*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := io.Copy(tmp, in); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
@@ -0,0 +1,132 @@
+//go:build capi
+
+package main
+
+/*
+#include <stdlib.h>
+*/
+import "C"
+
+import (
+	"container/heap"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"unsafe"
+)
+
+// ------------------- C API -------------------
+
+// Built with
+//
+//	go build -tags capi -buildmode=c-shared -o libwordcount.so ./cmd
+//
+// the engine can be called in-process from C and, through ctypes or cffi,
+// from Python; include/wordcount.h declares the functions. The library
+// counts with the default options only. Calls are serialized, and the
+// error of the last failed call is kept for wordcount_last_error.
+
+var (
+	capiMu    sync.Mutex
+	capiOnce  sync.Once
+	capiError error
+	zeroStats = stats
+)
+
+func capiCall(fn func() error) (err error) {
+	capiMu.Lock()
+	defer capiMu.Unlock()
+	capiOnce.Do(defineFlags)
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+		capiError = err
+	}()
+	return fn()
+}
+
+//export wordcount_count
+func wordcount_count(inputs **C.char, numInputs C.int, maxWords C.int, output *C.char) C.int {
+	paths := make([]string, int(numInputs))
+	for i, p := range unsafe.Slice(inputs, int(numInputs)) {
+		paths[i] = C.GoString(p)
+	}
+	outputFile := C.GoString(output)
+	err := capiCall(func() error {
+		if maxWords <= 0 || len(paths) == 0 {
+			return fmt.Errorf("wordcount_count: needs max_words > 0 and at least one input")
+		}
+		MAX_WORDS_IN_MEMORY = int(maxWords)
+		stats, inputDone = zeroStats, 0
+
+		// A plain workspace: createWorkspace would take over the host
+		// process's SIGINT and SIGTERM.
+		dir, err := os.MkdirTemp(tempDir, workspacePrefix+"*")
+		if err != nil {
+			return err
+		}
+		defer os.RemoveAll(dir)
+		workspace = dir
+		return run(paths, outputFile)
+	})
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+//export wordcount_top_n
+func wordcount_top_n(result *C.char, n C.int) *C.char {
+	path := C.GoString(result)
+	var top string
+	err := capiCall(func() error {
+		best := &scoreHeap{}
+		values := make(map[string]string)
+		err := eachRecord(path, func(word string, t tally) error {
+			_, score := t.column(0).final()
+			switch {
+			case best.Len() < int(n):
+				heap.Push(best, scoredWord{word, score})
+			case n > 0 && score > (*best)[0].score:
+				delete(values, (*best)[0].word)
+				(*best)[0] = scoredWord{word, score}
+				heap.Fix(best, 0)
+			default:
+				return nil
+			}
+			values[word] = t.column(0).columnString()
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		lines := make([]string, best.Len())
+		for i := len(lines) - 1; i >= 0; i-- {
+			w := heap.Pop(best).(scoredWord)
+			lines[i] = w.word + "\t" + values[w.word] + "\n"
+		}
+		top = strings.Join(lines, "")
+		return nil
+	})
+	if err != nil {
+		return nil
+	}
+	return C.CString(top)
+}
+
+//export wordcount_last_error
+func wordcount_last_error() *C.char {
+	capiMu.Lock()
+	defer capiMu.Unlock()
+	if capiError == nil {
+		return nil
+	}
+	return C.CString(capiError.Error())
+}
+
+//export wordcount_free
+func wordcount_free(p *C.char) {
+	C.free(unsafe.Pointer(p))
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Pipeline Check -------------------
+
+// check counts the inputs twice: through the external pipeline with the
+// given max_words_in_memory, and naively, into one unbounded in-memory map
+// sorted at the end. Both use the same tokenization, so any difference is
+// a bug in spilling, merging or ordering. It is meant for small or sampled
+// inputs (--limit-tokens, --limit-bytes) after an upgrade.
+var checkAgainst string
+
+var checkReferences = []string{"naive"}
+
+const maxCheckDiffs = 20 // differences printed
+
+func runCheck(inputs []string) error {
+	pipeline := filepath.Join(workspace, "check-pipeline.run")
+	format := outputFormat
+	outputFormat = spillFormat
+	err := run(inputs, pipeline)
+	outputFormat = format
+	if err != nil {
+		return err
+	}
+	pipelineTokens := stats.tokens
+
+	counts, err := naiveCount(inputs)
+	if err != nil {
+		return err
+	}
+	words := make([]string, 0, len(counts))
+	for w := range counts {
+		words = append(words, w)
+	}
+	slices.SortFunc(words, func(a, b string) int {
+		switch {
+		case keyLess(a, b):
+			return -1
+		case keyLess(b, a):
+			return 1
+		}
+		return 0
+	})
+
+	setPhase("check", int64(len(words)))
+	diffs := 0
+	report := func(format string, args ...any) {
+		if diffs++; diffs <= maxCheckDiffs {
+			fmt.Fprintf(os.Stderr, "check: "+format+"\n", args...)
+		}
+	}
+	i := 0
+	err = eachSpillRecord(pipeline, func(word string, t tally) error {
+		for ; i < len(words) && keyLess(words[i], word); i++ {
+			report("%q: missing from the pipeline result (naive %s)", words[i], tallyString(counts[words[i]]))
+		}
+		if i < len(words) && words[i] == word {
+			if !sameTally(t, counts[word]) {
+				report("%q: pipeline %s, naive %s", word, tallyString(t), tallyString(counts[word]))
+			}
+			i++
+		} else {
+			report("%q: only in the pipeline result (%s)", word, tallyString(t))
+		}
+		updateProgress(int64(i))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for ; i < len(words); i++ {
+		report("%q: missing from the pipeline result (naive %s)", words[i], tallyString(counts[words[i]]))
+	}
+	if pipelineTokens != stats.tokens {
+		report("pipeline read %d tokens, naive %d", pipelineTokens, stats.tokens)
+	}
+
+	if diffs > 0 {
+		return fmt.Errorf("check: the pipeline does not match the naive count (mismatches: %d)", diffs)
+	}
+	fmt.Fprintf(os.Stderr, "check: %d words, %d tokens: the pipeline matches the naive count\n", len(words), stats.tokens)
+	return nil
+}
+
+// naiveCount counts the inputs again with nothing spilled, and collects
+// the single run of every input into one map.
+func naiveCount(inputs []string) (map[string]tally, error) {
+	maxWords := MAX_WORDS_IN_MEMORY
+	MAX_WORDS_IN_MEMORY = math.MaxInt
+	defer func() { MAX_WORDS_IN_MEMORY = maxWords }()
+	stats.tokens, stats.inputBytes, stats.limited, inputDone = 0, 0, false, 0
+	setPhase("input", inputSize(inputs))
+
+	counts := make(map[string]tally)
+	for _, input := range inputs {
+		runs, err := processInputFile(input)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range runs {
+			err := eachSpillRecord(r, func(word string, t tally) error {
+				combineInto(counts, word, t)
+				return nil
+			})
+			removeTemp(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if stats.limited {
+			break
+		}
+	}
+	return counts, nil
+}
+
+func eachSpillRecord(path string, fn func(word string, t tally) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	reader, err := newRecordReader(file, spillFormat, path)
+	if err != nil {
+		return err
+	}
+	for {
+		word, t, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(word, t); err != nil {
+			return err
+		}
+	}
+}
+
+// sameTally compares the final values of two tallies; float values may
+// differ in the last bits, since they were summed in a different order.
+func sameTally(a, b tally) bool {
+	for i := range valueColumns {
+		an, af := a.column(i).final()
+		bn, bf := b.column(i).final()
+		if resultKind() == runfile.KindInt && an != bn {
+			return false
+		}
+		if math.Abs(af-bf) > 1e-9*max(math.Abs(af), math.Abs(bf)) {
+			return false
+		}
+	}
+	return true
+}
+
+func tallyString(t tally) string {
+	values := make([]string, valueColumns)
+	for i := range values {
+		values[i] = t.column(i).columnString()
+	}
+	return strings.Join(values, "\t")
+}
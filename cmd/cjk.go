@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"os"
+	"strings"
+	"unicode"
+)
+
+// ------------------- CJK Segmentation -------------------
+
+// Chinese and Japanese are written without spaces, so a whole sentence is
+// a single whitespace-separated field. With --tokenizer=cjk every run of
+// Han, Hiragana and Katakana in a field is segmented into words: by
+// forward maximum matching against --cjk-dict when one is given, and into
+// overlapping bigrams ("東京都" -> "東京", "京都") where the dictionary has
+// no match. Ideographic punctuation such as "。" and "、" separates words
+// like whitespace; other runs, such as Latin words and digits, are kept as
+// they are.
+var (
+	tokenizerName string
+	cjkDictFile   string
+
+	tokenizer func(dst []string, line string) []string
+
+	cjkDict    map[string]bool
+	cjkDictMax int
+)
+
+// tokenizers are the segmentation backends selectable with --tokenizer.
+var tokenizers = map[string]func(dst []string, line string) []string{
+	"none": nil,
+	"cjk":  segmentCJK,
+}
+
+func isCJK(r rune) bool {
+	// U+30FC, the prolonged sound mark, is common to both kana scripts.
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) || r == 'ー'
+}
+
+// isCJKSeparator reports whether r is whitespace or punctuation of the
+// CJK Symbols and Punctuation or Halfwidth and Fullwidth Forms blocks.
+func isCJKSeparator(r rune) bool {
+	return unicode.IsSpace(r) ||
+		unicode.IsPunct(r) && (r >= '\u3000' && r <= '\u303f' || r >= '\uff00' && r <= '\uffef')
+}
+
+func segmentCJK(dst []string, line string) []string {
+	for _, field := range strings.FieldsFunc(line, isCJKSeparator) {
+		runes := []rune(field)
+		for start := 0; start < len(runes); {
+			end := start + 1
+			for end < len(runes) && isCJK(runes[end]) == isCJK(runes[start]) {
+				end++
+			}
+			if isCJK(runes[start]) {
+				dst = segmentRun(dst, runes[start:end])
+			} else {
+				dst = append(dst, string(runes[start:end]))
+			}
+			start = end
+		}
+	}
+	return dst
+}
+
+// segmentRun appends the words of a run of CJK characters: the longest
+// dictionary word at each position, and the bigrams of the spans between
+// them.
+func segmentRun(dst []string, run []rune) []string {
+	unknown := 0
+	for i := 0; i < len(run); {
+		n := min(cjkDictMax, len(run)-i)
+		for ; n > 0 && !cjkDict[string(run[i:i+n])]; n-- {
+		}
+		if n == 0 {
+			i++
+			continue
+		}
+		dst = bigrams(dst, run[unknown:i])
+		dst = append(dst, string(run[i:i+n]))
+		i += n
+		unknown = i
+	}
+	return bigrams(dst, run[unknown:])
+}
+
+// bigrams appends the overlapping pairs of characters of span, or span
+// itself when it is a single character.
+func bigrams(dst []string, span []rune) []string {
+	if len(span) == 1 {
+		return append(dst, string(span))
+	}
+	for i := 0; i+1 < len(span); i++ {
+		dst = append(dst, string(span[i:i+2]))
+	}
+	return dst
+}
+
+// loadCJKDict reads --cjk-dict, one word per line. Only the first
+// tab-separated field is used, so the output of a previous count works
+// as a dictionary too.
+func loadCJKDict(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cjkDict = make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		word, _, _ := strings.Cut(scanner.Text(), "\t")
+		if word = strings.TrimSpace(word); word != "" {
+			cjkDict[word] = true
+			cjkDictMax = max(cjkDictMax, len([]rune(word)))
+		}
+	}
+	return scanner.Err()
+}
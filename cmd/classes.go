@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// ------------------- Token Classes -------------------
+
+// With --classes every word of the result is tagged with a class during
+// the final merge, and the number of distinct words and tokens of each
+// class is written to <output>.classes.tsv.
+var tokenClasses bool
+
+// Token classes, in the order they are reported.
+const (
+	classAlphabetic = iota
+	classNumeric
+	classMixed
+	classPunctuation
+	classURL
+	classEmoji
+	numClasses
+)
+
+var classNames = [numClasses]string{"alphabetic", "numeric", "mixed", "punctuation", "url", "emoji"}
+
+type classTotals struct {
+	types  [numClasses]int64
+	tokens [numClasses]float64
+}
+
+type classSink struct{ classTotals }
+
+func (c *classSink) Write(word string, t tally) error {
+	_, n := t.column(0).final()
+	class := classify(word)
+	c.types[class]++
+	c.tokens[class] += n
+	return nil
+}
+
+func (c *classSink) Close() error {
+	stats.classes = &c.classTotals
+	return nil
+}
+
+// classify returns the class of a word: a URL (by its scheme or www.
+// prefix), letters with inner apostrophes and hyphens, a number (digits
+// with signs and separators), emoji only, punctuation and symbols only,
+// or mixed.
+func classify(word string) int {
+	lower := strings.ToLower(word)
+	for _, prefix := range []string{"http://", "https://", "ftp://", "www."} {
+		if strings.HasPrefix(lower, prefix) {
+			return classURL
+		}
+	}
+	var letters, digits, emoji, joiners, separators, punct, other int
+	for _, r := range word {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsMark(r):
+			letters++
+		case unicode.IsDigit(r):
+			digits++
+		case isEmoji(r):
+			emoji++
+		case isApostrophe(r) || isHyphen(r):
+			joiners++
+		case r == '.' || r == ',' || r == '+':
+			separators++
+		case unicode.IsPunct(r) || unicode.IsSymbol(r):
+			punct++
+		default:
+			other++
+		}
+	}
+	switch {
+	case other > 0:
+		return classMixed
+	case letters > 0 && digits+emoji+separators+punct == 0:
+		return classAlphabetic
+	case digits > 0 && letters+emoji+punct == 0:
+		return classNumeric
+	case emoji > 0 && letters+digits+joiners+separators+punct == 0:
+		return classEmoji
+	case letters+digits+emoji == 0:
+		return classPunctuation
+	}
+	return classMixed
+}
+
+// isEmoji reports whether r is an emoji (including skin tone modifiers and
+// regional indicators) or the zero-width joiner and variation selector
+// emoji sequences are built with.
+func isEmoji(r rune) bool {
+	return r >= 0x1F000 && r <= 0x1FAFF || r >= 0x2600 && r <= 0x27BF ||
+		r == 0x200D || r == 0xFE0F
+}
+
+// writeClasses writes the class totals of the result in outputFile to
+// outputFile.classes.tsv as class, distinct words and tokens.
+func writeClasses(outputFile string, totals *classTotals) error {
+	file, err := os.Create(outputFile + ".classes.tsv")
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := bufio.NewWriter(file)
+	fmt.Fprintln(w, "class\twords\ttokens")
+	for class, name := range classNames {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", name, totals.types[class], strconv.FormatFloat(totals.tokens[class], 'f', -1, 64))
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return file.Close()
+}
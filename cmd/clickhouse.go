@@ -0,0 +1,383 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// ------------------- ClickHouse Sink -------------------
+
+var (
+	clickhouseURL   string
+	clickhouseTable string
+)
+
+const (
+	clickhouseBatch   = 100000 // rows per data block
+	clickhouseTimeout = 10 * time.Minute
+)
+
+// clickhouseSink inserts the result into a ClickHouse table with columns
+// (word String, count Int64, UInt64 or Float64) over the native TCP
+// protocol: one INSERT whose data blocks are sent as the final merge
+// produces them.
+type clickhouseSink struct {
+	conn      *clickhouseConn
+	countType string // of the count column, as the server announced it
+	words     []byte // the String column: length-prefixed words
+	counts    []byte // the count column: little-endian values
+	rows      int
+}
+
+// clickhouseIdent matches a table name, optionally qualified by its
+// database.
+var clickhouseIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func openClickhouseSink() (*clickhouseSink, error) {
+	if !clickhouseIdent.MatchString(clickhouseTable) {
+		return nil, fmt.Errorf("invalid clickhouse table %q", clickhouseTable)
+	}
+	conn, err := dialClickhouse(clickhouseURL)
+	if err != nil {
+		return nil, err
+	}
+	table := "`" + strings.ReplaceAll(clickhouseTable, ".", "`.`") + "`"
+	columns, err := conn.insert(fmt.Sprintf("INSERT INTO %s (word, count) VALUES", table))
+	if err != nil {
+		conn.close()
+		return nil, err
+	}
+	if len(columns) != 2 || columns[0].typ != "String" {
+		conn.close()
+		return nil, fmt.Errorf("clickhouse: table %s needs columns (word String, count Int64 or Float64)", clickhouseTable)
+	}
+	switch columns[1].typ {
+	case "Int64", "UInt64", "Float64":
+	default:
+		conn.close()
+		return nil, fmt.Errorf("clickhouse: unsupported type %s of %s.count", columns[1].typ, clickhouseTable)
+	}
+	return &clickhouseSink{conn: conn, countType: columns[1].typ}, nil
+}
+
+func (s *clickhouseSink) Write(word string, t tally) error {
+	s.words = binary.AppendUvarint(s.words, uint64(len(word)))
+	s.words = append(s.words, word...)
+	n, f := t.column(0).final()
+	if s.countType == "Float64" {
+		s.counts = binary.LittleEndian.AppendUint64(s.counts, math.Float64bits(f))
+	} else {
+		s.counts = binary.LittleEndian.AppendUint64(s.counts, uint64(n))
+	}
+	s.rows++
+	if s.rows >= clickhouseBatch {
+		return s.flush()
+	}
+	return nil
+}
+
+func (s *clickhouseSink) flush() error {
+	if s.rows == 0 {
+		return nil
+	}
+	err := s.conn.sendBlock(s.rows, []clickhouseColumn{
+		{"word", "String", s.words},
+		{"count", s.countType, s.counts},
+	})
+	s.words, s.counts, s.rows = s.words[:0], s.counts[:0], 0
+	return err
+}
+
+func (s *clickhouseSink) Close() error {
+	defer s.conn.close()
+	if err := s.flush(); err != nil {
+		return err
+	}
+	// An empty block ends the insert; the server answers once it is stored.
+	if err := s.conn.sendBlock(0, nil); err != nil {
+		return err
+	}
+	_, err := s.conn.receive(clickhouseEndOfStream)
+	return err
+}
+
+// Abort drops the connection without ending the insert, so the server
+// cancels it.
+func (s *clickhouseSink) Abort() { s.conn.close() }
+
+// clickhouseConn is a minimal client of the native protocol: enough to
+// run one uncompressed INSERT. It speaks an old protocol revision, which
+// every server still accepts and which keeps the packets simple.
+type clickhouseConn struct {
+	c        net.Conn
+	r        *bufio.Reader
+	w        *bufio.Writer
+	revision uint64 // agreed with the server: the lower of both
+	readErr  error  // the first failed read, see err
+	buf      [binary.MaxVarintLen64]byte
+}
+
+const clickhouseRevision = 54213
+
+// Packet types of the native protocol.
+const (
+	clickhouseClientHello = 0
+	clickhouseClientQuery = 1
+	clickhouseClientData  = 2
+
+	clickhouseServerHello       = 0
+	clickhouseServerData        = 1
+	clickhouseServerException   = 2
+	clickhouseServerProgress    = 3
+	clickhouseEndOfStream       = 5
+	clickhouseServerProfileInfo = 6
+)
+
+type clickhouseColumn struct {
+	name, typ string
+	data      []byte
+}
+
+// dialClickhouse connects to clickhouse://[user[:password]@]host[:port][/db].
+func dialClickhouse(rawURL string) (*clickhouseConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "clickhouse" {
+		return nil, fmt.Errorf("invalid clickhouse URL %q", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "9000")
+	}
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := &clickhouseConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c), revision: clickhouseRevision}
+
+	user := u.User.Username()
+	if user == "" {
+		user = "default"
+	}
+	password, _ := u.User.Password()
+	conn.uvarint(clickhouseClientHello)
+	conn.string("wordcount")
+	conn.uvarint(1) // client version 1.0
+	conn.uvarint(0)
+	conn.uvarint(clickhouseRevision)
+	conn.string(strings.Trim(u.Path, "/"))
+	conn.string(user)
+	conn.string(password)
+	if _, err := conn.receive(clickhouseServerHello); err != nil {
+		conn.close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// insert starts the INSERT query and returns the columns the server
+// expects in the data blocks.
+func (c *clickhouseConn) insert(query string) ([]clickhouseColumn, error) {
+	hostname, _ := os.Hostname()
+	c.uvarint(clickhouseClientQuery)
+	c.string("") // query id: assigned by the server
+	c.c.SetDeadline(time.Now().Add(clickhouseTimeout))
+
+	// Client info.
+	c.w.WriteByte(1) // initial query
+	c.string("")     // initial user
+	c.string("")     // initial query id
+	c.string("0.0.0.0:0")
+	c.w.WriteByte(1) // interface: TCP
+	c.string(os.Getenv("USER"))
+	c.string(hostname)
+	c.string("wordcount")
+	c.uvarint(1)
+	c.uvarint(0)
+	c.uvarint(clickhouseRevision)
+	if c.revision >= 54060 {
+		c.string("") // quota key
+	}
+
+	c.string("") // end of settings
+	c.uvarint(2) // stage: complete
+	c.uvarint(0) // no compression
+	c.string(query)
+	if err := c.sendBlock(0, nil); err != nil { // no external tables
+		return nil, err
+	}
+	return c.receive(clickhouseServerData)
+}
+
+// sendBlock sends a data block of rows rows.
+func (c *clickhouseConn) sendBlock(rows int, columns []clickhouseColumn) error {
+	c.c.SetDeadline(time.Now().Add(clickhouseTimeout))
+	c.uvarint(clickhouseClientData)
+	c.string("") // table name
+	// Block info: not an overflow block, no bucket.
+	c.uvarint(1)
+	c.w.WriteByte(0)
+	c.uvarint(2)
+	binary.Write(c.w, binary.LittleEndian, int32(-1))
+	c.uvarint(0)
+
+	c.uvarint(uint64(len(columns)))
+	c.uvarint(uint64(rows))
+	for _, col := range columns {
+		c.string(col.name)
+		c.string(col.typ)
+		c.w.Write(col.data)
+	}
+	return c.w.Flush()
+}
+
+// receive reads packets up to one of type want: the server hello, the
+// header block of an insert or the end of the query. A data packet yields
+// the columns of its block.
+func (c *clickhouseConn) receive(want uint64) ([]clickhouseColumn, error) {
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	c.c.SetDeadline(time.Now().Add(clickhouseTimeout))
+	for {
+		packet, err := binary.ReadUvarint(c.r)
+		if err != nil {
+			return nil, fmt.Errorf("clickhouse: %w", err)
+		}
+		switch packet {
+		case clickhouseServerException:
+			return nil, c.exception()
+		case clickhouseServerHello:
+			if want != clickhouseServerHello {
+				return nil, errors.New("clickhouse: unexpected hello")
+			}
+			c.readString() // server name
+			c.readUvarint()
+			c.readUvarint()
+			c.revision = min(c.revision, c.readUvarint())
+			if c.revision >= 54058 {
+				c.readString() // time zone
+			}
+			return nil, c.err()
+		case clickhouseServerData:
+			columns, err := c.readBlock()
+			if err != nil || want == clickhouseServerData {
+				return columns, err
+			}
+		case clickhouseServerProgress:
+			c.readUvarint() // rows
+			c.readUvarint() // bytes
+			c.readUvarint() // total rows
+		case clickhouseServerProfileInfo:
+			c.readUvarint() // rows
+			c.readUvarint() // blocks
+			c.readUvarint() // bytes
+			c.readByte()    // applied limit
+			c.readUvarint() // rows before limit
+			c.readByte()    // calculated rows before limit
+		case clickhouseEndOfStream:
+			if want != clickhouseEndOfStream {
+				return nil, errors.New("clickhouse: query ended without a header block")
+			}
+			return nil, nil
+		default:
+			return nil, fmt.Errorf("clickhouse: unexpected packet %d", packet)
+		}
+		if err := c.err(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readBlock reads a data block without rows, such as the header block
+// describing the columns of an insert.
+func (c *clickhouseConn) readBlock() ([]clickhouseColumn, error) {
+	c.readString() // table name
+	for field := c.readUvarint(); field != 0 && c.err() == nil; field = c.readUvarint() {
+		switch field {
+		case 1:
+			c.readByte() // is overflows
+		case 2:
+			io.CopyN(io.Discard, c.r, 4) // bucket number
+		default:
+			return nil, fmt.Errorf("clickhouse: unknown block info field %d", field)
+		}
+	}
+	n := c.readUvarint()
+	if rows := c.readUvarint(); rows != 0 {
+		return nil, fmt.Errorf("clickhouse: unexpected block of %d rows", rows)
+	}
+	var columns []clickhouseColumn
+	for range n {
+		columns = append(columns, clickhouseColumn{name: c.readString(), typ: c.readString()})
+	}
+	return columns, c.err()
+}
+
+func (c *clickhouseConn) exception() error {
+	var code int32
+	binary.Read(c.r, binary.LittleEndian, &code)
+	name := c.readString()
+	msg := c.readString()
+	if err := c.err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("clickhouse: %s (code %d): %s", name, code, msg)
+}
+
+// The write helpers buffer; the read helpers record the first error,
+// returned by err.
+
+func (c *clickhouseConn) uvarint(v uint64) {
+	c.w.Write(c.buf[:binary.PutUvarint(c.buf[:], v)])
+}
+
+func (c *clickhouseConn) string(s string) {
+	c.uvarint(uint64(len(s)))
+	c.w.WriteString(s)
+}
+
+func (c *clickhouseConn) readUvarint() uint64 {
+	v, err := binary.ReadUvarint(c.r)
+	c.fail(err)
+	return v
+}
+
+func (c *clickhouseConn) readByte() byte {
+	b, err := c.r.ReadByte()
+	c.fail(err)
+	return b
+}
+
+func (c *clickhouseConn) readString() string {
+	n := c.readUvarint()
+	if n > 1<<20 {
+		c.fail(fmt.Errorf("string of %d bytes", n))
+	}
+	if c.err() != nil {
+		return ""
+	}
+	b := make([]byte, n)
+	_, err := io.ReadFull(c.r, b)
+	c.fail(err)
+	return string(b)
+}
+
+func (c *clickhouseConn) fail(err error) {
+	if err != nil && c.readErr == nil {
+		c.readErr = fmt.Errorf("clickhouse: %w", err)
+	}
+}
+
+func (c *clickhouseConn) err() error { return c.readErr }
+
+func (c *clickhouseConn) close() { c.c.Close() }
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+)
+
+// ------------------- Prefix Roll-ups -------------------
+
+// collapsePrefixes name families of structured keys (err_db_timeout,
+// err_db_refused, ...) that are rolled up during the final merge: a key
+// with one of the prefixes is cut after collapseDepth more collapseSep
+// separated segments, so with prefix err_ and depth 1 both keys count
+// towards err_db.
+var (
+	collapsePrefixes collapseFlag
+	collapseDepth    int
+	collapseSep      string
+	collapseDetail   bool
+)
+
+// collapseFlag collects --collapse-prefix values.
+type collapseFlag []string
+
+func (c *collapseFlag) String() string { return strings.Join(*c, " ") }
+
+func (c *collapseFlag) Set(prefix string) error {
+	*c = append(*c, prefix)
+	return nil
+}
+
+func (c *collapseFlag) values() []string { return *c }
+
+// collapseRollup marks roll-up rows when --collapse-detail writes them next
+// to the detailed keys they sum up, which may include a key equal to the
+// roll-up itself.
+const collapseRollup = "*"
+
+// collapse returns the roll-up key of key, or false when key has none of
+// the prefixes or fewer than collapseDepth segments after its prefix. The
+// longest matching prefix wins.
+func collapse(key string) (string, bool) {
+	prefix := ""
+	for _, p := range collapsePrefixes {
+		if len(p) > len(prefix) && strings.HasPrefix(key, p) {
+			prefix = p
+		}
+	}
+	if prefix == "" {
+		return "", false
+	}
+
+	end := len(prefix)
+	rest := key[end:]
+	for i := 0; i < collapseDepth; i++ {
+		if rest == "" {
+			return "", false
+		}
+		segment, tail, found := strings.Cut(rest, collapseSep)
+		end += len(segment)
+		if i < collapseDepth-1 && found {
+			end += len(collapseSep)
+		}
+		if !found {
+			rest = ""
+			continue
+		}
+		rest = tail
+	}
+
+	rollup := key[:end]
+	if collapseDetail {
+		rollup += collapseRollup
+	}
+	return rollup, true
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Output Columns -------------------
+
+var (
+	columnsSpec    string
+	outputColumns  []string
+	schemaManifest bool
+
+	// resultTotal is the sum of the first value column over the whole
+	// result, the denominator of the freq column.
+	resultTotal float64
+)
+
+// valueColumnNames returns the names of the value columns: count, or
+// value1..valueN with --value-columns N.
+func valueColumnNames() []string {
+	if valueColumns == 1 {
+		return []string{"count"}
+	}
+	names := make([]string, valueColumns)
+	for i := range names {
+		names[i] = fmt.Sprintf("value%d", i+1)
+	}
+	return names
+}
+
+// parseColumns validates --columns, a comma-separated selection of word,
+// the value columns, freq (the first value column's share of its total) and
+// bytes (the first value column times the word's length in bytes: what the
+// word contributes to the input when it counts occurrences).
+func parseColumns(spec string) ([]string, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	columns := strings.Split(spec, ",")
+	known := append([]string{"word", "freq", "bytes"}, valueColumnNames()...)
+	for _, c := range columns {
+		if !slices.Contains(known, c) {
+			return nil, fmt.Errorf("invalid column %q (want %s)", c, strings.Join(known, ", "))
+		}
+	}
+	for _, c := range []string{"freq", "bytes"} {
+		if slices.Contains(columns, c) && aggOp != aggSum && aggOp != aggCount {
+			return nil, fmt.Errorf("the %s column needs --agg sum or count", c)
+		}
+	}
+	return columns, nil
+}
+
+func columnsNeedTotal() bool {
+	return slices.Contains(outputColumns, "freq")
+}
+
+// selectColumns formats the --columns of one TSV record.
+func selectColumns(word string, t tally) string {
+	return strings.Join(columnFields(word, t), "\t")
+}
+
+// columnFields formats the --columns of one record.
+func columnFields(word string, t tally) []string {
+	fields := make([]string, len(outputColumns))
+	for i, c := range outputColumns {
+		switch c {
+		case "word":
+			fields[i] = word
+		case "freq":
+			_, f := t.column(0).final()
+			fields[i] = strconv.FormatFloat(f/resultTotal, 'g', -1, 64)
+		case "bytes":
+			n, f := t.column(0).final()
+			if resultKind() == runfile.KindFloat {
+				fields[i] = strconv.FormatFloat(f*float64(len(word)), 'g', -1, 64)
+			} else {
+				fields[i] = strconv.FormatInt(n*int64(len(word)), 10)
+			}
+		case "count":
+			fields[i] = t.column(0).columnString()
+		default:
+			n, _ := strconv.Atoi(strings.TrimPrefix(c, "value"))
+			fields[i] = t.column(n - 1).columnString()
+		}
+	}
+	return fields
+}
+
+// sumRun returns the sum of the first value column of a spill run.
+func sumRun(path string) (float64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file, spillFormat, path)
+	if err != nil {
+		return 0, err
+	}
+	var total float64
+	for {
+		_, count, err := reader.Next()
+		if err == io.EOF {
+			return total, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		_, f := count.column(0).final()
+		total += f
+	}
+}
+
+type schemaColumn struct {
+	Name        string `json:"name"`
+	Type        string `json:"type"`
+	Description string `json:"description"`
+}
+
+type schemaDoc struct {
+	Format   string         `json:"format"`
+	Columns  []schemaColumn `json:"columns"`
+	SortedBy string         `json:"sorted_by"`
+	KeySep   string         `json:"key_sep,omitempty"`
+}
+
+// writeSchema describes the columns of the result in outputFile.schema.json,
+// so consumers can check what they parse instead of assuming a layout.
+func writeSchema(outputFile string) error {
+	valueType := "int64"
+	if resultKind() == runfile.KindFloat {
+		valueType = "float64"
+	}
+	describe := map[string]schemaColumn{
+		"word":  {"word", "string", "the key"},
+		"freq":  {"freq", "float64", "share of the total of the first value column"},
+		"bytes": {"bytes", valueType, "first value column times the length of the word in UTF-8 bytes"},
+	}
+	for i, name := range valueColumnNames() {
+		describe[name] = schemaColumn{name, valueType, fmt.Sprintf("value column %d, aggregated with --agg %s", i+1, aggOp)}
+	}
+
+	columns := outputColumns
+	if columns == nil {
+		columns = append([]string{"word"}, valueColumnNames()...)
+	}
+	doc := schemaDoc{Format: outputFormat, SortedBy: "word", KeySep: keySep}
+	if topWords > 0 || sortOrder == "count" {
+		doc.SortedBy = valueColumnNames()[0] + " desc"
+	}
+	for _, c := range columns {
+		doc.Columns = append(doc.Columns, describe[c])
+	}
+
+	data, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(outputFile+".schema.json", append(data, '\n'), 0644)
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreyflyagin/wordcounter/corpus"
+	"github.com/andreyflyagin/wordcounter/result"
+)
+
+// The tests run the test binary itself as wordcount, so every option goes
+// through the same flag parsing, workspace and exit handling as a real run.
+const runAsCLI = "WORDCOUNTER_TEST_RUN_AS_CLI"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runAsCLI) != "" {
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// wordcount runs the command line args in dir, with its workspace there
+// too, fails the test if the run fails and returns what it printed.
+func wordcount(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runAsCLI+"=1", envName("temp-dir")+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("wordcount %s: %v\n%s", strings.Join(args, " "), err, out)
+	}
+	return string(out)
+}
+
+// generate writes a corpus to dir/name and returns its reference counts.
+func generate(t *testing.T, dir, name string, cfg corpus.Config) map[string]int64 {
+	t.Helper()
+	f, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	want, err := corpus.Generate(f, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return want
+}
+
+// verify checks the result at path, converted to TSV by decode unless it
+// is a TSV result or a binary run, against want.
+func verify(t *testing.T, path string, decode func([]byte, io.Writer) error, want map[string]int64) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decode != nil {
+		var tsv bytes.Buffer
+		if err := decode(data, &tsv); err != nil {
+			t.Fatalf("decode %s: %v", path, err)
+		}
+		data = tsv.Bytes()
+	}
+	if err := corpus.Verify(bytes.NewReader(data), want); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MAX_WORDS_IN_MEMORY well below the vocabulary, so every run spills and
+// merges.
+const testMaxWords = "300"
+
+var testCorpus = corpus.Config{Tokens: 20000, Vocabulary: 2000, Skew: 1.2, Seed: 7}
+
+func TestCountFormats(t *testing.T) {
+	tests := []struct {
+		format string
+		decode func([]byte, io.Writer) error
+	}{
+		{"tsv", nil},
+		{"run", nil},
+		{"csv", csvToTSV},
+		{"json", jsonToTSV},
+		{"jsonl", jsonToTSV},
+		{"table", tableToTSV},
+		{"packed", packedToTSV},
+		{"arrow", arrowToTSV},
+		{"msgpack", msgpackToTSV},
+		{"protobuf", protobufToTSV},
+	}
+	dir := t.TempDir()
+	want := generate(t, dir, "input.txt", testCorpus)
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			output := "out." + tt.format
+			wordcount(t, dir, "--format", tt.format, "-o", output, testMaxWords, "input.txt")
+			verify(t, filepath.Join(dir, output), tt.decode, want)
+		})
+	}
+}
+
+func TestCountEncodings(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  corpus.Config
+	}{
+		{"ascii uniform", corpus.Config{Tokens: 5000, Vocabulary: 800, Seed: 1}},
+		{"utf8 skewed", corpus.Config{Tokens: 5000, Vocabulary: 800, Skew: 1.5, Encoding: corpus.UTF8, Seed: 2}},
+		{"long words", corpus.Config{Tokens: 5000, Vocabulary: 800, MinLen: 40, MaxLen: 200, Seed: 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			want := generate(t, dir, "input.txt", tt.cfg)
+			wordcount(t, dir, "-o", "out.tsv", "100", "input.txt")
+			verify(t, filepath.Join(dir, "out.tsv"), nil, want)
+		})
+	}
+}
+
+// TestMergeAndAggregate counts two corpora separately and combines the
+// results, which must equal counting both at once.
+func TestMergeAndAggregate(t *testing.T) {
+	dir := t.TempDir()
+	a := generate(t, dir, "a.txt", corpus.Config{Tokens: 8000, Vocabulary: 1500, Skew: 1.1, Seed: 11})
+	b := generate(t, dir, "b.txt", corpus.Config{Tokens: 8000, Vocabulary: 1500, Skew: 1.3, Seed: 12})
+	want := make(map[string]int64)
+	for _, counts := range []map[string]int64{a, b} {
+		for word, n := range counts {
+			want[word] += n
+		}
+	}
+
+	tests := []struct {
+		name    string
+		combine func(t *testing.T, output string) []string // the command line
+	}{
+		{"count both", func(t *testing.T, output string) []string {
+			return []string{"-o", output, testMaxWords, "a.txt", "b.txt"}
+		}},
+		{"merge binary runs", func(t *testing.T, output string) []string {
+			wordcount(t, dir, "--format", "run", "-o", "a.run", testMaxWords, "a.txt")
+			wordcount(t, dir, "--format", "run", "-o", "b.run", testMaxWords, "b.txt")
+			return []string{"merge", "-o", output, testMaxWords, "a.run", "b.run"}
+		}},
+		{"merge legacy tsv", func(t *testing.T, output string) []string {
+			wordcount(t, dir, "-o", "a.tsv", testMaxWords, "a.txt")
+			wordcount(t, dir, "-o", "b.tsv", testMaxWords, "b.txt")
+			return []string{"merge", "-o", output, testMaxWords, "a.tsv", "b.tsv"}
+		}},
+		{"aggregate run store", func(t *testing.T, output string) []string {
+			wordcount(t, dir, "--run-store", "store", "-o", "a.tsv", testMaxWords, "a.txt")
+			wordcount(t, dir, "--run-store", "store", "-o", "b.tsv", testMaxWords, "b.txt")
+			return []string{"aggregate", "-o", output, testMaxWords, "store"}
+		}},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := fmt.Sprintf("combined%d.tsv", i)
+			wordcount(t, dir, tt.combine(t, output)...)
+			verify(t, filepath.Join(dir, output), nil, want)
+		})
+	}
+}
+
+// TestPackedResult reads a packed result through package result.
+func TestPackedResult(t *testing.T) {
+	dir := t.TempDir()
+	want := generate(t, dir, "input.txt", testCorpus)
+	wordcount(t, dir, "--format", "packed", "-o", "out.packed", testMaxWords, "input.txt")
+
+	r, err := result.OpenResult(filepath.Join(dir, "out.packed"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	if r.Len() != len(want) {
+		t.Fatalf("Len() = %d, want %d", r.Len(), len(want))
+	}
+	for word, n := range want {
+		if e, ok := r.Lookup(word); !ok || e.Count != n {
+			t.Fatalf("Lookup(%q) = %d, %v, want %d", word, e.Count, ok, n)
+		}
+	}
+	if _, ok := r.Lookup("not a corpus word"); ok {
+		t.Fatal("Lookup of a missing word succeeded")
+	}
+	top := r.TopN(10)
+	for i := 1; i < len(top); i++ {
+		if top[i].Count > top[i-1].Count {
+			t.Fatalf("TopN out of order: %v", top)
+		}
+	}
+}
+
+// ------------------- Result Decoders -------------------
+
+// The decoders turn a single-column integer result back into word<TAB>count
+// lines for corpus.Verify.
+
+func csvToTSV(data []byte, w io.Writer) error {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(records) == 0 || strings.Join(records[0], ",") != "word,count" {
+		return errors.New("missing header row")
+	}
+	for _, rec := range records[1:] {
+		fmt.Fprintf(w, "%s\t%s\n", rec[0], rec[1])
+	}
+	return nil
+}
+
+// jsonToTSV reads both the json array and jsonl.
+func jsonToTSV(data []byte, w io.Writer) error {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if bytes.HasPrefix(data, []byte("[")) {
+		if _, err := dec.Token(); err != nil {
+			return err
+		}
+	}
+	for dec.More() {
+		var rec struct {
+			Word  string `json:"word"`
+			Count int64  `json:"count"`
+		}
+		if err := dec.Decode(&rec); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\t%d\n", rec.Word, rec.Count)
+	}
+	return nil
+}
+
+func tableToTSV(data []byte, w io.Writer) error {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		count, word, ok := strings.Cut(strings.TrimLeft(scanner.Text(), " "), "  ")
+		if !ok {
+			return fmt.Errorf("malformed row %q", scanner.Text())
+		}
+		fmt.Fprintf(w, "%s\t%s\n", word, count)
+	}
+	return scanner.Err()
+}
+
+func packedToTSV(data []byte, w io.Writer) error {
+	path := filepath.Join(os.TempDir(), fmt.Sprintf("wordcount_test_%d.packed", os.Getpid()))
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	r, err := result.OpenResult(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	for i := range r.Len() {
+		e := r.Entry(i)
+		fmt.Fprintf(w, "%s\t%d\n", e.Key, e.Count)
+	}
+	return nil
+}
+
+func msgpackToTSV(data []byte, w io.Writer) error {
+	for len(data) > 0 {
+		if data[0] != 0x92 {
+			return fmt.Errorf("want a 2-element array, got 0x%02x", data[0])
+		}
+		data = data[1:]
+		var n int
+		switch b := data[0]; {
+		case b&0xe0 == 0xa0:
+			n, data = int(b&0x1f), data[1:]
+		case b == 0xd9:
+			n, data = int(data[1]), data[2:]
+		case b == 0xda:
+			n, data = int(binary.BigEndian.Uint16(data[1:])), data[3:]
+		default:
+			return fmt.Errorf("unexpected string type 0x%02x", b)
+		}
+		word := string(data[:n])
+		data = data[n:]
+		var count uint64
+		switch b := data[0]; {
+		case b < 0x80:
+			count, data = uint64(b), data[1:]
+		case b == 0xcc:
+			count, data = uint64(data[1]), data[2:]
+		case b == 0xcd:
+			count, data = uint64(binary.BigEndian.Uint16(data[1:])), data[3:]
+		case b == 0xce:
+			count, data = uint64(binary.BigEndian.Uint32(data[1:])), data[5:]
+		default:
+			return fmt.Errorf("unexpected integer type 0x%02x", b)
+		}
+		fmt.Fprintf(w, "%s\t%d\n", word, count)
+	}
+	return nil
+}
+
+func protobufToTSV(data []byte, w io.Writer) error {
+	for len(data) > 0 {
+		size, n := binary.Uvarint(data)
+		msg := data[n : n+int(size)]
+		data = data[n+int(size):]
+
+		var word string
+		var count uint64
+		for len(msg) > 0 {
+			tag := msg[0]
+			length, n := binary.Uvarint(msg[1:])
+			field := msg[1+n : 1+n+int(length)]
+			msg = msg[1+n+int(length):]
+			switch tag {
+			case 1<<3 | 2:
+				word = string(field)
+			case 2<<3 | 2:
+				count, _ = binary.Uvarint(field)
+			default:
+				return fmt.Errorf("unexpected tag 0x%02x", tag)
+			}
+		}
+		fmt.Fprintf(w, "%s\t%d\n", word, count)
+	}
+	return nil
+}
+
+// arrowToTSV reads the messages of an Arrow IPC stream with just enough
+// flatbuffer decoding to find the buffers of each record batch.
+func arrowToTSV(data []byte, w io.Writer) error {
+	u32 := func(b []byte, at int) int { return int(binary.LittleEndian.Uint32(b[at:])) }
+	// field returns the position of field i of the table at pos, or 0.
+	field := func(b []byte, pos, i int) int {
+		vtable := pos - int(int32(binary.LittleEndian.Uint32(b[pos:])))
+		if 4+2*i >= int(binary.LittleEndian.Uint16(b[vtable:])) {
+			return 0
+		}
+		if off := int(binary.LittleEndian.Uint16(b[vtable+4+2*i:])); off != 0 {
+			return pos + off
+		}
+		return 0
+	}
+	ref := func(b []byte, at int) int { return at + u32(b, at) }
+
+	for {
+		if len(data) < 8 || u32(data, 0) != arrowContinuation {
+			return errors.New("missing continuation marker")
+		}
+		size := u32(data, 4)
+		if size == 0 {
+			return nil // end of stream
+		}
+		meta := data[8 : 8+size]
+		data = data[8+size:]
+
+		msg := ref(meta, 0)
+		if meta[field(meta, msg, 1)] != arrowHeaderBatch {
+			continue
+		}
+		bodyLen := int(binary.LittleEndian.Uint64(meta[field(meta, msg, 3):]))
+		body := data[:bodyLen]
+		data = data[bodyLen:]
+
+		batch := ref(meta, field(meta, msg, 2))
+		rows := int(binary.LittleEndian.Uint64(meta[field(meta, batch, 0):]))
+		buffers := ref(meta, field(meta, batch, 2)) + 4
+		buffer := func(i int) []byte {
+			off := int(binary.LittleEndian.Uint64(meta[buffers+16*i:]))
+			n := int(binary.LittleEndian.Uint64(meta[buffers+16*i+8:]))
+			return body[off : off+n]
+		}
+		offsets, words, counts := buffer(1), buffer(2), buffer(4)
+		for r := range rows {
+			word := words[u32(offsets, 4*r):u32(offsets, 4*r+4)]
+			fmt.Fprintf(w, "%s\t%d\n", word, int64(binary.LittleEndian.Uint64(counts[8*r:])))
+		}
+	}
+}
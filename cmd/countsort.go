@@ -0,0 +1,258 @@
+package main
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+)
+
+// ------------------- Count Order -------------------
+
+// Output orderings selectable with --sort.
+var sortOrders = []string{"key", "count"}
+
+// sortOrder is the order of the output. With --sort=count the merged
+// result is sorted again, largest first value first and ties in byte-wise
+// key order, by the same external machinery as the input phase: sorted
+// runs of MAX_WORDS_IN_MEMORY records are spilled and merged in rounds, so
+// the result does not have to fit in memory.
+var sortOrder string
+
+// sortByCount reports whether the result needs the count-sorting pass;
+// --top output is already in count order.
+func sortByCount() bool { return sortOrder == "count" && topWords == 0 }
+
+type countRecord struct {
+	word  string
+	count tally
+	score float64
+}
+
+func newCountRecord(word string, count tally) countRecord {
+	_, score := count.column(0).final()
+	return countRecord{word, count, score}
+}
+
+func countLess(a, b countRecord) bool {
+	if a.score != b.score {
+		return a.score > b.score
+	}
+	return a.word < b.word
+}
+
+// sortRunByCount sorts the spill run at path by count into format and
+// removes it.
+func sortRunByCount(path string) (string, error) {
+	files, err := splitCountRuns(path)
+	removeTemp(path)
+	if err != nil {
+		for _, f := range files {
+			removeTemp(f)
+		}
+		return "", err
+	}
+
+	fanIn := max(MAX_WORDS_IN_MEMORY, 2)
+	for len(files) > fanIn {
+		var nextRoundFiles []string
+		stats.mergeRounds++
+		setPhase("merge", int64((len(files)+fanIn-1)/fanIn))
+		for i := 0; i < len(files); i += fanIn {
+			batch := files[i:min(i+fanIn, len(files))]
+			merged, err := mergeByCount(batch, spillFormat)
+			if err != nil {
+				return "", err
+			}
+			nextRoundFiles = append(nextRoundFiles, merged)
+			updateProgress(int64(len(nextRoundFiles)))
+			for _, f := range batch {
+				removeTemp(f)
+			}
+		}
+		files = nextRoundFiles
+	}
+
+	stats.mergeRounds++
+	setPhase("merge", 1)
+	final, err := mergeByCount(files, outputFormat)
+	if err != nil {
+		return "", err
+	}
+	for _, f := range files {
+		removeTemp(f)
+	}
+	return final, nil
+}
+
+// splitCountRuns cuts the spill run at path into count-sorted spill runs.
+func splitCountRuns(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file, spillFormat, path)
+	if err != nil {
+		return nil, err
+	}
+
+	var records []countRecord
+	var tempFiles []string
+	for {
+		word, count, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return tempFiles, err
+		}
+		records = append(records, newCountRecord(word, count))
+
+		if len(records) >= MAX_WORDS_IN_MEMORY {
+			tmp, err := writeCountRun(records)
+			if err != nil {
+				return tempFiles, err
+			}
+			tempFiles = append(tempFiles, tmp)
+			records = records[:0]
+		}
+	}
+
+	// An empty result still needs one run for the final merge to write
+	// an empty output.
+	if len(records) > 0 || len(tempFiles) == 0 {
+		tmp, err := writeCountRun(records)
+		if err != nil {
+			return tempFiles, err
+		}
+		tempFiles = append(tempFiles, tmp)
+	}
+	return tempFiles, nil
+}
+
+func writeCountRun(records []countRecord) (string, error) {
+	slices.SortFunc(records, func(a, b countRecord) int {
+		if countLess(a, b) {
+			return -1
+		}
+		if countLess(b, a) {
+			return 1
+		}
+		return 0
+	})
+
+	tmpFile, err := os.CreateTemp(workspace, "bycount_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer tmpFile.Close()
+
+	writer, err := newRecordWriter(quotaWriter{tmpFile}, spillFormat)
+	if err != nil {
+		return "", err
+	}
+	for _, r := range records {
+		if err := writer.Write(r.word, r.count); err != nil {
+			return "", err
+		}
+	}
+	return tmpFile.Name(), writer.Close()
+}
+
+// mergeByCount merges count-sorted spill runs into format. Keys are unique
+// across the runs, so unlike mergeBatch nothing is combined.
+func mergeByCount(tempFiles []string, format string) (string, error) {
+	readers := make([]recordReader, len(tempFiles))
+	files := make([]*os.File, len(tempFiles))
+	defer func() {
+		for _, f := range files {
+			if f != nil {
+				f.Close()
+			}
+		}
+	}()
+
+	h := &countEntryHeap{}
+	next := func(i int) error {
+		word, count, err := readers[i].Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", tempFiles[i], err)
+		}
+		heap.Push(h, countEntry{newCountRecord(word, count), i})
+		return nil
+	}
+
+	for i, tempFile := range tempFiles {
+		f, err := os.Open(tempFile)
+		if err != nil {
+			return "", err
+		}
+		files[i] = f
+		if readers[i], err = newRecordReader(f, spillFormat, tempFile); err != nil {
+			return "", fmt.Errorf("%s: %w", tempFile, err)
+		}
+		if err := next(i); err != nil {
+			return "", err
+		}
+	}
+
+	tmpOutFile, err := os.CreateTemp(workspace, "merged_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer tmpOutFile.Close()
+	writer, err := newRecordWriter(quotaWriter{tmpOutFile}, format)
+	if err != nil {
+		return "", err
+	}
+	if format != spillFormat {
+		if writer, err = withSinks(writer); err != nil {
+			return "", err
+		}
+	}
+
+	for records := 1; h.Len() > 0; records++ {
+		entry := heap.Pop(h).(countEntry)
+		if records%(1<<16) == 0 {
+			heartbeat()
+		}
+		if err := writer.Write(entry.word, entry.count); err != nil {
+			abortWriter(writer)
+			return "", err
+		}
+		if err := next(entry.fileIdx); err != nil {
+			abortWriter(writer)
+			return "", err
+		}
+	}
+	return tmpOutFile.Name(), writer.Close()
+}
+
+type countEntry struct {
+	countRecord
+	fileIdx int
+}
+
+type countEntryHeap []countEntry
+
+func (h countEntryHeap) Len() int           { return len(h) }
+func (h countEntryHeap) Less(i, j int) bool { return countLess(h[i].countRecord, h[j].countRecord) }
+func (h countEntryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *countEntryHeap) Push(x interface{}) {
+	*h = append(*h, x.(countEntry))
+}
+
+func (h *countEntryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
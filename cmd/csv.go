@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// ------------------- CSV Input -------------------
+
+// With --csv every input is read as CSV with a header row, and only the
+// text of the columns named by --column is tokenized and counted, joined
+// with a space when there are several. Records are split at newlines
+// outside quotes, so quoted fields may contain separators and line breaks,
+// and each record is parsed with encoding/csv.
+var (
+	csvInput   bool
+	csvColumns string
+
+	csvColumnNames []string
+)
+
+// csvHeader returns the index of every --column in the header record.
+func csvHeader(record string) ([]int, error) {
+	fields, err := parseCSVRecord(record)
+	if err != nil {
+		return nil, fmt.Errorf("header: %v", err)
+	}
+	indices := make([]int, len(csvColumnNames))
+	for i, name := range csvColumnNames {
+		if indices[i] = slices.Index(fields, name); indices[i] < 0 {
+			return nil, fmt.Errorf("no column %q in the header", name)
+		}
+	}
+	return indices, nil
+}
+
+// csvText returns the text of the columns at indices of record.
+func csvText(record string, indices []int) (string, error) {
+	fields, err := parseCSVRecord(record)
+	if err != nil {
+		return "", err
+	}
+	texts := make([]string, len(indices))
+	for i, index := range indices {
+		if index >= len(fields) {
+			return "", fmt.Errorf("no column %q", csvColumnNames[i])
+		}
+		texts[i] = fields[index]
+	}
+	return strings.Join(texts, " "), nil
+}
+
+func parseCSVRecord(record string) ([]string, error) {
+	r := csv.NewReader(strings.NewReader(record))
+	r.FieldsPerRecord = -1
+	fields, err := r.Read()
+	if err != nil {
+		return nil, err
+	}
+	return fields, nil
+}
+
+// splitCSVRecords splits at the newlines outside double quotes.
+func splitCSVRecords(data []byte, atEOF bool) (int, []byte, error) {
+	quoted := false
+	for i, c := range data {
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\n' && !quoted:
+			return i + 1, dropCR(data[:i]), nil
+		}
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), dropCR(data), nil
+	}
+	return 0, nil, nil
+}
+
+func dropCR(data []byte) []byte {
+	if len(data) > 0 && data[len(data)-1] == '\r' {
+		return data[:len(data)-1]
+	}
+	return data
+}
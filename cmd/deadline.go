@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// ------------------- Soft Deadline -------------------
+
+// deadline bounds the input phase of time-boxed runs: once it passes,
+// ingestion stops, the runs spilled so far are merged as usual and the
+// result is marked as partial.
+var (
+	deadline        time.Duration
+	deadlineReached atomic.Bool
+)
+
+func startDeadline() {
+	if deadline > 0 {
+		time.AfterFunc(deadline, func() { deadlineReached.Store(true) })
+	}
+}
+
+// markPartial writes outputFile.partial explaining why the result is
+// incomplete, or removes a marker left next to it by an earlier run. For
+// a result on standard output the explanation goes to standard error.
+func markPartial(outputFile string) error {
+	marker := outputFile + ".partial"
+	if outputFile == stdoutPath {
+		marker = ""
+	}
+	if !stats.deadlineHit {
+		if marker == "" {
+			return nil
+		}
+		if err := os.Remove(marker); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	msg := fmt.Sprintf("partial result: --deadline %s reached after %d tokens; input consumed up to byte %d\n",
+		deadline, stats.tokens, stats.endOffset)
+	if marker == "" {
+		_, err := fmt.Fprint(os.Stderr, msg)
+		return err
+	}
+	return os.WriteFile(marker, []byte(msg), 0644)
+}
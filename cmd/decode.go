@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// ------------------- Compressed Inputs -------------------
+
+// A decoder decompresses one input format, recognized by the suffix of the
+// input's name or by its leading magic bytes.
+type decoder struct {
+	suffix    string
+	magic     []byte
+	newReader func(io.Reader) (io.ReadCloser, error)
+}
+
+var decoders = []decoder{
+	{".gz", []byte{0x1f, 0x8b}, func(r io.Reader) (io.ReadCloser, error) {
+		return gzip.NewReader(r)
+	}},
+	{".bz2", []byte("BZh"), func(r io.Reader) (io.ReadCloser, error) {
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}},
+	{".zst", []byte{0x28, 0xb5, 0x2f, 0xfd}, func(r io.Reader) (io.ReadCloser, error) {
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}},
+	{".xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}, func(r io.Reader) (io.ReadCloser, error) {
+		xr, err := xz.NewReader(r)
+		return io.NopCloser(xr), err
+	}},
+}
+
+// decoderByName returns the decoder of a compressed input, judged by its
+// name before anything of it is read.
+func decoderByName(path string) *decoder {
+	for i, d := range decoders {
+		if strings.HasSuffix(path, d.suffix) {
+			return &decoders[i]
+		}
+	}
+	return nil
+}
+
+func decoderByMagic(br *bufio.Reader) *decoder {
+	for i, d := range decoders {
+		if magic, _ := br.Peek(len(d.magic)); bytes.Equal(magic, d.magic) {
+			return &decoders[i]
+		}
+	}
+	return nil
+}
+
+// openContent opens an input and returns its content positioned at skip,
+// decompressing it when the decoder is known by its name or its magic
+// bytes. Offsets into compressed inputs count decompressed bytes, so
+// skipping means reading up to the offset; only plain inputs seek.
+func openContent(path string, skip int64) (io.ReadCloser, *inputReader, error) {
+	file, err := openInput(path, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	br := bufio.NewReader(file)
+	dec := decoderByName(path)
+	if dec == nil {
+		dec = decoderByMagic(br)
+	}
+	if dec == nil && skip > 0 && path != stdinPath {
+		// Sniffed plain: reopen at the offset instead of reading up to it.
+		file.Close()
+		if file, err = openInput(path, skip); err != nil {
+			return nil, nil, err
+		}
+		return io.NopCloser(bufio.NewReader(file)), file, nil
+	}
+
+	var content io.ReadCloser = io.NopCloser(br)
+	if dec != nil {
+		content, err = dec.newReader(br)
+	}
+	if err == nil && skip > 0 {
+		if _, err = io.CopyN(io.Discard, content, skip); err == io.EOF {
+			err = nil
+		}
+	}
+	if err != nil {
+		file.Close()
+		return nil, nil, err
+	}
+	return content, file, nil
+}
+
+// decodeStream decompresses r if name or its magic bytes tell a known
+// format, and returns it as is otherwise.
+func decodeStream(r io.Reader, name string) (io.ReadCloser, error) {
+	br := bufio.NewReader(r)
+	dec := decoderByName(name)
+	if dec == nil {
+		dec = decoderByMagic(br)
+	}
+	if dec == nil {
+		return io.NopCloser(br), nil
+	}
+	return dec.newReader(br)
+}
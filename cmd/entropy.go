@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+)
+
+// ------------------- Corpus Entropy -------------------
+
+// entropySink measures the unigram distribution of the result as the
+// final merge produces it. With n the total count and S the sum of
+// c·log2(c) over the words, the Shannon entropy is log2(n) − S/n bits per
+// token, so one streaming pass over the counts is enough.
+var corpusEntropy bool
+
+type entropySink struct {
+	tokens  float64
+	types   int64
+	cLogC   float64
+	textLen float64 // bytes of the corpus as one word per line
+}
+
+// corpusStats summarizes the unigram distribution of a result.
+type corpusStats struct {
+	Tokens     float64 `json:"tokens"`
+	Types      int64   `json:"types"`
+	Entropy    float64 `json:"entropy_bits"`
+	MaxEntropy float64 `json:"max_entropy_bits"`
+	Redundancy float64 `json:"redundancy"`
+	// UnigramRatio estimates how well the corpus compresses: the size of
+	// the tokens coded at their entropy against the one-word-per-line text.
+	UnigramRatio float64 `json:"unigram_ratio"`
+}
+
+func (e *entropySink) Write(word string, t tally) error {
+	_, c := t.column(0).final()
+	if c <= 0 {
+		return nil
+	}
+	e.tokens += c
+	e.types++
+	e.cLogC += c * math.Log2(c)
+	e.textLen += c * float64(len(word)+1)
+	return nil
+}
+
+func (e *entropySink) Close() error {
+	if e.types == 0 {
+		return nil
+	}
+	s := &corpusStats{Tokens: e.tokens, Types: e.types}
+	s.Entropy = max(math.Log2(e.tokens)-e.cLogC/e.tokens, 0)
+	s.MaxEntropy = math.Log2(float64(e.types))
+	if s.MaxEntropy > 0 {
+		s.Redundancy = 1 - s.Entropy/s.MaxEntropy
+	}
+	s.UnigramRatio = s.Entropy * e.tokens / 8 / e.textLen
+	stats.corpus = s
+	return nil
+}
+
+func printCorpusStats(w io.Writer, s *corpusStats) {
+	fmt.Fprintf(w, "tokens %g, types %d\n", s.Tokens, s.Types)
+	fmt.Fprintf(w, "entropy %.4f bits/token (max %.4f), redundancy %.4f\n", s.Entropy, s.MaxEntropy, s.Redundancy)
+	fmt.Fprintf(w, "unigram coding ratio %.4f of the one-word-per-line text\n", s.UnigramRatio)
+}
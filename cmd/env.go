@@ -0,0 +1,57 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ------------------- Environment Configuration -------------------
+
+const envPrefix = "WORDCOUNT_"
+
+// Environment variables for the positional arguments, so a run can be
+// configured without any command line at all (e.g. a Kubernetes Job).
+const (
+	envMaxWords = envPrefix + "MAX_WORDS_IN_MEMORY"
+	envInput    = envPrefix + "INPUT"
+)
+
+// envName maps a flag name to its environment variable, e.g.
+// "status-file" to WORDCOUNT_STATUS_FILE.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets every flag that has a matching environment variable.
+// It must run before flag.Parse so command-line flags still take priority.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		v, ok := os.LookupEnv(envName(f.Name))
+		if !ok || err != nil {
+			return
+		}
+		if serr := f.Value.Set(v); serr != nil {
+			err = fmt.Errorf("invalid %s=%q: %v", envName(f.Name), v, serr)
+		}
+	})
+	return err
+}
+
+// positionalArgs returns the command-line arguments left after flag
+// parsing, falling back to the environment when none are given.
+func positionalArgs(fs *flag.FlagSet) []string {
+	if fs.NArg() > 0 {
+		return fs.Args()
+	}
+	var args []string
+	if v, ok := os.LookupEnv(envMaxWords); ok {
+		args = append(args, v)
+		if v, ok := os.LookupEnv(envInput); ok {
+			args = append(args, v)
+		}
+	}
+	return args
+}
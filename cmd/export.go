@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"fmt"
+	"io"
+	"math/bits"
+	"os"
+	"strconv"
+)
+
+// ------------------- Anonymized Export -------------------
+
+var (
+	exportMinCount int64
+	exportMaxRank  int
+	exportBuckets  string
+)
+
+// Count bucketings selectable with --buckets.
+var exportBucketings = []string{"pow2", "none"}
+
+// exportVocabulary writes the words of the count result at path whose count
+// reaches --min-count and whose rank is within --max-rank to w, with counts
+// rounded down to their --buckets bucket, so a vocabulary derived from a
+// private corpus can be shared without exposing rare words or exact counts.
+//
+// Words tied with the word at rank --max-rank are all kept, so the rank cut
+// never depends on the alphabetical order of equally frequent words.
+func exportVocabulary(path string, w io.Writer) error {
+	threshold := exportMinCount
+	if exportMaxRank > 0 {
+		rankCount, err := countAtRank(path, exportMaxRank)
+		if err != nil {
+			return err
+		}
+		threshold = max(threshold, rankCount)
+	}
+
+	out := bufio.NewWriter(w)
+	err := eachRecord(path, func(word string, count tally) error {
+		n := exportCount(count)
+		if n < threshold || n <= 0 {
+			return nil
+		}
+		_, err := fmt.Fprintf(out, "%s\t%s\n", word, localizeNumber(strconv.FormatInt(bucketCount(n), 10)))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// countAtRank returns the count of the rank-th most frequent word, or 0 if
+// there are fewer words. It keeps only rank counts in memory.
+func countAtRank(path string, rank int) (int64, error) {
+	top := &countHeap{}
+	err := eachRecord(path, func(_ string, count tally) error {
+		n := exportCount(count)
+		if top.Len() < rank {
+			heap.Push(top, n)
+		} else if n > (*top)[0] {
+			(*top)[0] = n
+			heap.Fix(top, 0)
+		}
+		return nil
+	})
+	if err != nil || top.Len() < rank {
+		return 0, err
+	}
+	return (*top)[0], nil
+}
+
+func eachRecord(path string, fn func(word string, count tally) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file, "auto", path)
+	if err != nil {
+		return err
+	}
+	for {
+		word, count, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(word, count); err != nil {
+			return err
+		}
+	}
+}
+
+func exportCount(t tally) int64 {
+	if floatCounts {
+		return int64(t.float())
+	}
+	return t.n
+}
+
+// bucketCount rounds a positive count down to its bucket.
+func bucketCount(n int64) int64 {
+	if exportBuckets == "none" {
+		return n
+	}
+	return 1 << (63 - bits.LeadingZeros64(uint64(n)))
+}
+
+// countHeap is a min-heap of counts.
+type countHeap []int64
+
+func (h countHeap) Len() int           { return len(h) }
+func (h countHeap) Less(i, j int) bool { return h[i] < h[j] }
+func (h countHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *countHeap) Push(x any)        { *h = append(*h, x.(int64)) }
+func (h *countHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
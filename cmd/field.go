@@ -0,0 +1,62 @@
+package main
+
+import "strings"
+
+// ------------------- Field Extraction -------------------
+
+// With --field N only the Nth field (1-based) of every line, split at
+// --field-sep, is tokenized and counted, so a column of a CSV or TSV file
+// can be counted without preprocessing it. A field that starts with a
+// double quote is read as in CSV: separators inside the quotes do not
+// split it, and "" stands for one quote. Quoted fields cannot span lines.
+var (
+	fieldIndex int
+	fieldSep   string
+
+	fieldDelim string
+)
+
+// extractField returns the --field field of line, or false if the line
+// has fewer fields.
+func extractField(line string) (string, bool) {
+	for i := 1; ; i++ {
+		var value string
+		var more bool
+		if strings.HasPrefix(line, `"`) {
+			value, line, more = quotedField(line[1:])
+		} else {
+			value, line, more = strings.Cut(line, fieldDelim)
+		}
+		if i == fieldIndex {
+			return value, true
+		}
+		if !more {
+			return "", false
+		}
+	}
+}
+
+// quotedField reads a field after its opening quote. It returns the value,
+// the rest of the line after the separator, and whether there was one.
+// Text between the closing quote and the separator is kept as is, and an
+// unterminated field extends to the end of the line.
+func quotedField(s string) (value, rest string, more bool) {
+	var b strings.Builder
+	for {
+		i := strings.IndexByte(s, '"')
+		if i < 0 {
+			b.WriteString(s)
+			return b.String(), "", false
+		}
+		b.WriteString(s[:i])
+		s = s[i+1:]
+		if strings.HasPrefix(s, `"`) {
+			b.WriteByte('"')
+			s = s[1:]
+			continue
+		}
+		before, rest, more := strings.Cut(s, fieldDelim)
+		b.WriteString(before)
+		return b.String(), rest, more
+	}
+}
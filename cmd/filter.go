@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ------------------- Line Filters -------------------
+
+var (
+	matchPattern   string
+	excludePattern string
+
+	matchRE, excludeRE *regexp.Regexp
+)
+
+// compileLineFilters compiles --match and --exclude-match.
+func compileLineFilters() error {
+	var err error
+	if matchPattern != "" {
+		if matchRE, err = regexp.Compile(matchPattern); err != nil {
+			return fmt.Errorf("invalid match: %v", err)
+		}
+	}
+	if excludePattern != "" {
+		if excludeRE, err = regexp.Compile(excludePattern); err != nil {
+			return fmt.Errorf("invalid exclude-match: %v", err)
+		}
+	}
+	return nil
+}
+
+// lineSelected reports whether an input line passes --match and
+// --exclude-match. Filters apply to the raw line, before it is split into
+// tokens or weights.
+func lineSelected(line string) bool {
+	if matchRE != nil && !matchRE.MatchString(line) {
+		return false
+	}
+	return excludeRE == nil || !excludeRE.MatchString(line)
+}
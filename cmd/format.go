@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/andreyflyagin/wordcounter/result"
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Record Formats -------------------
+
+// recordReader yields the (word, count) records of a sorted run and returns
+// io.EOF after the last one.
+type recordReader interface {
+	Next() (string, tally, error)
+}
+
+// recordWriter receives merged records in sorted order.
+type recordWriter interface {
+	Write(word string, count tally) error
+	Close() error
+}
+
+var recordWriters = map[string]func(io.Writer) (recordWriter, error){
+	"tsv":      newTSVWriter,
+	"csv":      newCSVWriter,
+	"run":      newRunWriter,
+	"packed":   newPackedWriter,
+	"arrow":    newArrowWriter,
+	"msgpack":  newMsgpackWriter,
+	"protobuf": newProtobufWriter,
+	"table":    newTableWriter,
+	"json":     newJSONWriter,
+	"jsonl":    newJSONLWriter,
+}
+
+// spillFormat is the internal format of temporary runs: the binary run
+// format holding partial aggregates rather than final values.
+const spillFormat = "spill"
+
+func newRecordWriter(w io.Writer, format string) (recordWriter, error) {
+	if format == spillFormat {
+		return newSpillWriter(w)
+	}
+	newWriter, ok := recordWriters[format]
+	if !ok {
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+	return newWriter(w)
+}
+
+// newRecordReader reads records in the given format. The "auto" format
+// sniffs the run magic and falls back to legacy TSV, so hand-made count
+// files and runs from older versions can still be merged.
+func newRecordReader(r io.Reader, format, name string) (recordReader, error) {
+	if format == "auto" {
+		br := bufio.NewReader(r)
+		format = "tsv"
+		if magic, _ := br.Peek(len(runfile.Magic)); string(magic) == runfile.Magic {
+			format = "run"
+		}
+		r = br
+	}
+
+	switch format {
+	case "tsv":
+		return &tsvReader{scanner: bufio.NewScanner(r), name: name}, nil
+	case "run", spillFormat:
+		rr, err := runfile.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		if format == spillFormat {
+			return &runReader{r: rr, spill: true}, nil
+		}
+		if rr.Header().Columns != valueColumns {
+			return nil, fmt.Errorf("run has %d value columns, expected %d", rr.Header().Columns, valueColumns)
+		}
+		if rr.Header().Kind == runfile.KindFloat && !floatCounts {
+			return nil, fmt.Errorf("run holds float counts; merge it with --float-counts")
+		}
+		return &runReader{r: rr}, nil
+	}
+	return nil, fmt.Errorf("unknown format %q", format)
+}
+
+type tsvWriter struct {
+	w *bufio.Writer
+}
+
+func newTSVWriter(w io.Writer) (recordWriter, error) {
+	return &tsvWriter{bufio.NewWriter(w)}, nil
+}
+
+func (t *tsvWriter) Write(word string, count tally) error {
+	if outputColumns != nil {
+		_, err := fmt.Fprintln(t.w, selectColumns(word, count))
+		return err
+	}
+	_, err := fmt.Fprintf(t.w, "%s\t%s\n", word, count)
+	return err
+}
+
+func (t *tsvWriter) Close() error { return t.w.Flush() }
+
+// csvWriter writes a header row and one row per record with
+// encoding/csv, which quotes words containing commas, quotes or line
+// breaks.
+type csvWriter struct {
+	w      *csv.Writer
+	header bool
+	fields []string
+}
+
+func newCSVWriter(w io.Writer) (recordWriter, error) {
+	return &csvWriter{w: csv.NewWriter(w)}, nil
+}
+
+func (c *csvWriter) Write(word string, count tally) error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvColumnHeader()); err != nil {
+			return err
+		}
+	}
+	if outputColumns != nil {
+		return c.w.Write(columnFields(word, count))
+	}
+	c.fields = append(c.fields[:0], word)
+	for i := range valueColumns {
+		c.fields = append(c.fields, count.column(i).columnString())
+	}
+	return c.w.Write(c.fields)
+}
+
+// Close writes the header of an empty result too.
+func (c *csvWriter) Close() error {
+	if !c.header {
+		c.header = true
+		if err := c.w.Write(csvColumnHeader()); err != nil {
+			return err
+		}
+	}
+	c.w.Flush()
+	return c.w.Error()
+}
+
+func csvColumnHeader() []string {
+	if outputColumns != nil {
+		return outputColumns
+	}
+	return append([]string{"word"}, valueColumnNames()...)
+}
+
+type tsvReader struct {
+	scanner *bufio.Scanner
+	name    string
+	line    int
+	skipped int
+}
+
+// Next skips malformed lines with a warning, or fails on them with --strict.
+func (t *tsvReader) Next() (string, tally, error) {
+	for t.scanner.Scan() {
+		t.line++
+		word, count, err := parseLine(t.scanner.Text())
+		if err != nil {
+			if err := warn(lineLoc(t.name, t.line), "malformed line: %v", err); err != nil {
+				return "", tally{}, err
+			}
+			t.skipped++
+			continue
+		}
+		if !utf8.ValidString(word) {
+			if err := warn(lineLoc(t.name, t.line), "invalid UTF-8 in %q", word); err != nil {
+				return "", tally{}, err
+			}
+		}
+		return word, count, nil
+	}
+	if err := t.scanner.Err(); err != nil {
+		return "", tally{}, err
+	}
+	return "", tally{}, io.EOF
+}
+
+// parseLine splits a word<TAB>count line, or word<TAB>v1<TAB>...<TAB>vN with
+// --value-columns N. The values follow the last N tabs, so words that
+// themselves contain tabs survive the round trip.
+func parseLine(line string) (string, tally, error) {
+	end := len(line)
+	fields := make([]string, valueColumns)
+	for c := valueColumns - 1; c >= 0; c-- {
+		i := strings.LastIndexByte(line[:end], '\t')
+		if i < 0 {
+			return "", tally{}, fmt.Errorf("want %d tab-separated value(s) after the key in %q", valueColumns, line)
+		}
+		fields[c] = line[i+1 : end]
+		end = i
+	}
+
+	count, err := parseTally(fields[0])
+	if err != nil {
+		return "", tally{}, err
+	}
+	for _, field := range fields[1:] {
+		c, err := parseTally(field)
+		if err != nil {
+			return "", tally{}, err
+		}
+		count.rest = append(count.rest, c)
+	}
+	return line[:end], count, nil
+}
+
+// runWriter writes records in the binary run format. Result runs hold one
+// column per value with the final values; spill runs hold the partial
+// aggregates, which for --agg=mean are the sums followed by the record
+// count.
+type runWriter struct {
+	w      *runfile.Writer
+	spill  bool
+	ints   []int64
+	floats []float64
+}
+
+func newRunWriter(w io.Writer) (recordWriter, error) {
+	return openRunWriter(w, runfile.Header{Codec: runCodec, Kind: resultKind(), Columns: valueColumns}, false)
+}
+
+// resultKind is the value kind of final results: floats for --float-counts
+// and means, integers otherwise and always for record counts.
+func resultKind() runfile.Kind {
+	if aggOp != aggCount && (floatCounts || aggOp == aggMean) {
+		return runfile.KindFloat
+	}
+	return runfile.KindInt
+}
+
+func newSpillWriter(w io.Writer) (recordWriter, error) {
+	header := runfile.Header{Codec: spillCodec(), Kind: runfile.KindInt, Columns: valueColumns}
+	if floatCounts && aggOp != aggCount {
+		header.Kind = runfile.KindFloat
+	}
+	if aggOp == aggMean {
+		header.Columns++
+	}
+	return openRunWriter(w, header, true)
+}
+
+func openRunWriter(w io.Writer, header runfile.Header, spill bool) (recordWriter, error) {
+	rw, err := runfile.NewHeaderWriter(w, header)
+	if err != nil {
+		return nil, err
+	}
+	return &runWriter{
+		w:      rw,
+		spill:  spill,
+		ints:   make([]int64, header.Columns),
+		floats: make([]float64, header.Columns),
+	}, nil
+}
+
+func (r *runWriter) Write(word string, t tally) error {
+	header := r.w.Header()
+	for i := range valueColumns {
+		c := t.column(i)
+		switch {
+		case aggOp == aggCount:
+			r.ints[i] = c.k
+		case !r.spill && aggOp == aggMean:
+			r.floats[i] = c.mean()
+		case header.Kind == runfile.KindFloat:
+			r.floats[i] = c.float()
+		default:
+			r.ints[i] = c.n
+		}
+	}
+	if header.Columns > valueColumns {
+		r.ints[valueColumns] = t.k
+		r.floats[valueColumns] = float64(t.k)
+	}
+
+	if header.Kind == runfile.KindFloat {
+		return r.w.WriteFloats(word, r.floats)
+	}
+	return r.w.WriteInts(word, r.ints)
+}
+
+func (r *runWriter) Close() error { return r.w.Close() }
+
+// packedWriter writes the final result in the memory-mappable, indexed
+// format of package result. It holds a single value column, and its keys
+// must be in byte-wise order.
+type packedWriter struct {
+	w    *result.Writer
+	kind runfile.Kind
+}
+
+func newPackedWriter(w io.Writer) (recordWriter, error) {
+	kind := resultKind()
+	pw, err := result.NewWriter(w, kind, workspace)
+	if err != nil {
+		return nil, err
+	}
+	return &packedWriter{w: pw, kind: kind}, nil
+}
+
+func (p *packedWriter) Write(word string, t tally) error {
+	n, f := t.final()
+	if p.kind == runfile.KindFloat {
+		return p.w.WriteFloat(word, f)
+	}
+	return p.w.Write(word, n)
+}
+
+func (p *packedWriter) Close() error { return p.w.Close() }
+
+// runReader reads records from the binary run format. Spill runs are read
+// back as partial aggregates; any other run is a stream of single records,
+// converted to float counts when --float-counts is set so exact and
+// weighted runs can be merged together.
+type runReader struct {
+	r     *runfile.Reader
+	spill bool
+	ints  []int64
+}
+
+func (r *runReader) Next() (string, tally, error) {
+	var word string
+	var values []float64
+	if r.r.Header().Kind == runfile.KindFloat {
+		w, floats, err := r.r.NextFloats()
+		if err != nil {
+			return "", tally{}, err
+		}
+		word, values = w, floats
+	} else {
+		w, ints, err := r.r.NextInts()
+		if err != nil {
+			return "", tally{}, err
+		}
+		word = w
+		r.ints = r.ints[:0]
+		r.ints = append(r.ints, ints...)
+	}
+
+	k := int64(1)
+	if r.spill && aggOp == aggMean {
+		if values != nil {
+			k = int64(values[valueColumns])
+		} else {
+			k = r.ints[valueColumns]
+		}
+	}
+
+	var t tally
+	for i := range valueColumns {
+		var c tally
+		switch {
+		case values != nil:
+			c = tally{f: values[i], k: k}
+		case r.spill && aggOp == aggCount:
+			c = tally{k: r.ints[i]}
+		case floatCounts:
+			c = tally{f: float64(r.ints[i]), k: k}
+		default:
+			c = tally{n: r.ints[i], k: k}
+		}
+		if i == 0 {
+			t = c
+		} else {
+			t.rest = append(t.rest, c)
+		}
+	}
+	return word, t, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"html"
+	"io"
+)
+
+// ------------------- HTML Stripping -------------------
+
+// With --strip-html every input goes through htmlStripper before it is
+// split into records: tags and comments are removed, the bodies of script
+// and style elements are dropped, and character references such as &amp;
+// or &#233; are decoded. Block-level tags (<p>, <br>, <li>, ...) become
+// line breaks, so paragraphs are lines; inline tags (<b>, <a>, ...) vanish,
+// so "<b>w</b>ord" is "word"; other tags become a space. The filter is a
+// state machine over a buffered reader and holds at most a tag name or a
+// reference in memory, however large the page.
+var stripHTML bool
+
+type htmlStripper struct {
+	r   *bufio.Reader
+	out []byte
+	pos int
+	err error
+}
+
+func newHTMLStripper(r io.Reader) io.Reader {
+	return &htmlStripper{r: bufio.NewReader(r)}
+}
+
+const (
+	maxTagName   = 16
+	maxReference = 32 // longest named reference is 31 bytes
+)
+
+var blockTags = map[string]bool{
+	"address": true, "article": true, "aside": true, "blockquote": true, "br": true,
+	"dd": true, "div": true, "dl": true, "dt": true, "figcaption": true, "footer": true,
+	"h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"header": true, "hr": true, "li": true, "main": true, "nav": true, "ol": true,
+	"p": true, "pre": true, "section": true, "table": true, "title": true, "tr": true,
+	"ul": true,
+}
+
+var inlineTags = map[string]bool{
+	"a": true, "abbr": true, "b": true, "cite": true, "code": true, "em": true,
+	"font": true, "i": true, "mark": true, "q": true, "s": true, "small": true,
+	"span": true, "strong": true, "sub": true, "sup": true, "u": true,
+}
+
+func (h *htmlStripper) Read(p []byte) (int, error) {
+	if h.pos == len(h.out) {
+		h.out, h.pos = h.out[:0], 0
+		for len(h.out) < 4096 && h.err == nil {
+			h.err = h.step()
+		}
+	}
+	n := copy(p, h.out[h.pos:])
+	h.pos += n
+	if n == 0 {
+		return 0, h.err
+	}
+	return n, nil
+}
+
+func (h *htmlStripper) step() error {
+	c, err := h.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	switch c {
+	case '<':
+		return h.tag()
+	case '&':
+		return h.reference()
+	}
+	h.out = append(h.out, c)
+	return nil
+}
+
+// tag handles what follows a '<': a tag, a comment or declaration, or a
+// literal '<' as in "a < b".
+func (h *htmlStripper) tag() error {
+	c, err := h.r.ReadByte()
+	if err != nil {
+		h.out = append(h.out, '<')
+		return err
+	}
+	if c == '!' || c == '?' {
+		if next, _ := h.r.Peek(2); c == '!' && string(next) == "--" {
+			h.r.Discard(2)
+			return h.skipPast("-->")
+		}
+		return h.skipTag()
+	}
+	closing := c == '/'
+	if !closing && !isASCIILetter(c) {
+		h.out = append(h.out, '<')
+		return h.r.UnreadByte()
+	}
+	if !closing {
+		h.r.UnreadByte()
+	}
+	name := h.tagName()
+	if err := h.skipTag(); err != nil {
+		return err
+	}
+	switch {
+	case !closing && (name == "script" || name == "style"):
+		return h.skipRawText(name)
+	case blockTags[name]:
+		h.out = append(h.out, '\n')
+	case !inlineTags[name]:
+		h.out = append(h.out, ' ')
+	}
+	return nil
+}
+
+func (h *htmlStripper) tagName() string {
+	var name []byte
+	for {
+		c, err := h.r.ReadByte()
+		if err != nil {
+			break
+		}
+		if !isASCIILetter(c) && (c < '0' || c > '9') {
+			h.r.UnreadByte()
+			break
+		}
+		if len(name) < maxTagName {
+			name = append(name, c|0x20)
+		}
+	}
+	return string(name)
+}
+
+// skipTag skips to the end of a tag, past '>' in quoted attribute values.
+func (h *htmlStripper) skipTag() error {
+	var quote byte
+	for {
+		c, err := h.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '>':
+			return nil
+		}
+	}
+}
+
+// skipPast skips to the end of the next occurrence of end.
+func (h *htmlStripper) skipPast(end string) error {
+	window := make([]byte, 0, len(end)+1)
+	for string(window) != end {
+		c, err := h.r.ReadByte()
+		if err != nil {
+			return err
+		}
+		if window = append(window, c); len(window) > len(end) {
+			window = append(window[:0], window[1:]...)
+		}
+	}
+	return nil
+}
+
+// skipRawText drops the body of a script or style element and its end
+// tag, matched case-insensitively.
+func (h *htmlStripper) skipRawText(name string) error {
+	end := []byte("/" + name)
+	for {
+		if err := h.skipPast("<"); err != nil {
+			return err
+		}
+		next, _ := h.r.Peek(len(end))
+		if bytes.EqualFold(next, end) {
+			h.r.Discard(len(end))
+			if err := h.skipTag(); err != nil {
+				return err
+			}
+			h.out = append(h.out, ' ')
+			return nil
+		}
+	}
+}
+
+// reference decodes a character reference after '&'. Anything that does
+// not end in ';' within maxReference bytes, as in "AT&T", is kept as is.
+func (h *htmlStripper) reference() error {
+	ref := []byte{'&'}
+	for len(ref) < maxReference {
+		c, err := h.r.ReadByte()
+		if err != nil {
+			h.out = append(h.out, ref...)
+			return err
+		}
+		if c == ';' && len(ref) > 1 {
+			h.out = append(h.out, html.UnescapeString(string(ref)+";")...)
+			return nil
+		}
+		if !isASCIILetter(c) && (c < '0' || c > '9') && !(c == '#' && len(ref) == 1) {
+			h.r.UnreadByte()
+			break
+		}
+		ref = append(ref, c)
+	}
+	h.out = append(h.out, ref...)
+	return nil
+}
+
+func isASCIILetter(c byte) bool {
+	return c|0x20 >= 'a' && c|0x20 <= 'z'
+}
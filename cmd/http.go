@@ -0,0 +1,253 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ------------------- HTTP Inputs -------------------
+
+// Inputs may be http:// or https:// URLs, or object store URLs (see
+// objectStores), streamed without staging them on disk. A broken transfer
+// resumes where it stopped with a Range request, guarded by If-Range so a
+// resource that changed in between fails the run instead of mixing two
+// versions. With --http-concurrency N > 1, servers that accept ranges are
+// read in httpChunk pieces, N of them in flight.
+var httpConcurrency int
+
+const httpChunk = 8 << 20
+
+var httpClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: time.Minute,
+	},
+}
+
+// errUncacheable marks inputs whose content cannot be identified without
+// reading them, which --cache-dir then leaves alone.
+var errUncacheable = errors.New("input cannot be identified for the cache")
+
+// isURL tells inputs read over HTTP, including object store URLs, from
+// local paths.
+func isURL(path string) bool {
+	scheme, _, ok := strings.Cut(path, "://")
+	_, store := objectStores[scheme]
+	return ok && (scheme == "http" || scheme == "https" || store)
+}
+
+// validator returns the strong ETag of a response, or its Last-Modified
+// date, to be sent back in If-Range.
+func validator(resp *http.Response) string {
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		return etag
+	}
+	return resp.Header.Get("Last-Modified")
+}
+
+// openURL requests r.path from r.pos on, recording the resource's validator
+// on the first request.
+func (r *inputReader) openURL() (io.ReadCloser, error) {
+	if httpConcurrency > 1 {
+		if body, err := r.openChunked(); body != nil || err != nil {
+			return body, err
+		}
+	}
+
+	req, err := newInputRequest(http.MethodGet, r.path)
+	if err != nil {
+		return nil, err
+	}
+	if r.pos > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.pos))
+		if r.validator != "" {
+			req.Header.Set("If-Range", r.validator)
+		}
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusPartialContent && r.pos > 0:
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && r.pos > 0:
+		// Nothing is left after the offset.
+		resp.Body.Close()
+		return io.NopCloser(strings.NewReader("")), nil
+	case resp.StatusCode == http.StatusOK && r.pos > 0:
+		if r.validator != "" {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: resource changed while it was read", r.path)
+		}
+		// The server ignores ranges; read past the offset.
+		if _, err := io.CopyN(io.Discard, resp.Body, r.pos); err != nil {
+			resp.Body.Close()
+			return nil, err
+		}
+	case resp.StatusCode == http.StatusOK:
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s: %s", r.path, resp.Status)
+	}
+	if r.validator == "" {
+		r.validator = validator(resp)
+	}
+	return resp.Body, nil
+}
+
+func headInput(url string) (*http.Response, error) {
+	req, err := newInputRequest(http.MethodHead, url)
+	if err != nil {
+		return nil, err
+	}
+	return httpClient.Do(req)
+}
+
+// openChunked returns a chunkedReader if the server accepts ranges and
+// tells the length of the resource, and nil otherwise.
+func (r *inputReader) openChunked() (io.ReadCloser, error) {
+	resp, err := headInput(r.path)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", r.path, resp.Status)
+	}
+	if resp.Header.Get("Accept-Ranges") != "bytes" || resp.ContentLength < 0 {
+		return nil, nil
+	}
+	v := validator(resp)
+	if r.validator != "" && v != r.validator {
+		return nil, fmt.Errorf("%s: resource changed while it was read", r.path)
+	}
+	r.validator = v
+
+	c := &chunkedReader{
+		url:       r.path,
+		validator: v,
+		queue:     make(chan chan chunkResult, httpConcurrency),
+		done:      make(chan struct{}),
+	}
+	go c.fetchAll(r.pos, resp.ContentLength)
+	return c, nil
+}
+
+// chunkedReader reads a resource as consecutive ranges fetched in
+// parallel; queue holds their results in order, so at most
+// httpConcurrency chunks are buffered ahead of the reader.
+type chunkedReader struct {
+	url       string
+	validator string
+	queue     chan chan chunkResult
+	done      chan struct{}
+	closeOnce sync.Once
+	cur       []byte
+}
+
+type chunkResult struct {
+	data []byte
+	err  error
+}
+
+func (c *chunkedReader) fetchAll(from, size int64) {
+	defer close(c.queue)
+	for ; from < size; from += httpChunk {
+		result := make(chan chunkResult, 1)
+		select {
+		case c.queue <- result:
+		case <-c.done:
+			return
+		}
+		go func(from, to int64) {
+			data, err := c.fetch(from, to)
+			result <- chunkResult{data, err}
+		}(from, min(from+httpChunk, size)-1)
+	}
+}
+
+// fetch reads the bytes from..to, retrying failed requests and server
+// errors.
+func (c *chunkedReader) fetch(from, to int64) ([]byte, error) {
+	var err error
+	for attempt := range readRetries + 1 {
+		if attempt > 0 {
+			fmt.Fprintf(os.Stderr, "wordcount: %s: bytes %d-%d: %v; retrying (%d/%d)\n",
+				c.url, from, to, err, attempt, readRetries)
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var req *http.Request
+		req, err = newInputRequest(http.MethodGet, c.url)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to))
+		if c.validator != "" {
+			req.Header.Set("If-Range", c.validator)
+		}
+		var resp *http.Response
+		if resp, err = httpClient.Do(req); err != nil {
+			continue
+		}
+		if resp.StatusCode >= http.StatusInternalServerError {
+			// A transient server error; retried like a broken transfer.
+			resp.Body.Close()
+			err = errors.New(resp.Status)
+			continue
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s: range request answered with %s (resource changed?)", c.url, resp.Status)
+		}
+		data := make([]byte, to-from+1)
+		_, err = io.ReadFull(resp.Body, data)
+		resp.Body.Close()
+		if err == nil {
+			return data, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: bytes %d-%d: %w", c.url, from, to, err)
+}
+
+func (c *chunkedReader) Read(p []byte) (int, error) {
+	for len(c.cur) == 0 {
+		result, ok := <-c.queue
+		if !ok {
+			return 0, io.EOF
+		}
+		chunk := <-result
+		if chunk.err != nil {
+			return 0, chunk.err
+		}
+		c.cur = chunk.data
+	}
+	n := copy(p, c.cur)
+	c.cur = c.cur[n:]
+	return n, nil
+}
+
+func (c *chunkedReader) Close() error {
+	c.closeOnce.Do(func() { close(c.done) })
+	return nil
+}
+
+// urlDigest identifies a URL input for the cache by its validator.
+func urlDigest(url string) (string, error) {
+	resp, err := headInput(url)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	v := validator(resp)
+	if resp.StatusCode != http.StatusOK || v == "" {
+		return "", errUncacheable
+	}
+	return url + " " + v, nil
+}
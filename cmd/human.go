@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// ------------------- Human Formats -------------------
+
+// numberLocale selects digit grouping and the decimal mark for the formats
+// meant for people (table and export); the machine formats stay raw.
+var numberLocale string
+
+var numberLocales = map[string]struct{ group, decimal string }{
+	"en": {",", "."},      // 1,234,567.5
+	"de": {".", ","},      // 1.234.567,5
+	"fr": {"\u202f", ","}, // 1 234 567,5 (narrow no-break space)
+	"ch": {"'", "."},      // 1'234'567.5
+}
+
+// localizeNumber regroups a number formatted by strconv for numberLocale.
+func localizeNumber(s string) string {
+	loc, ok := numberLocales[numberLocale]
+	if !ok {
+		return s
+	}
+	sign, exp := "", ""
+	if strings.HasPrefix(s, "-") {
+		sign, s = "-", s[1:]
+	}
+	if i := strings.IndexAny(s, "eE"); i >= 0 {
+		s, exp = s[:i], s[i:]
+	}
+	whole, frac, hasFrac := strings.Cut(s, ".")
+	if strings.Trim(whole, "0123456789") != "" {
+		return sign + s + exp // NaN, Inf
+	}
+
+	var b strings.Builder
+	b.WriteString(sign)
+	for i := range len(whole) {
+		if i > 0 && (len(whole)-i)%3 == 0 {
+			b.WriteString(loc.group)
+		}
+		b.WriteByte(whole[i])
+	}
+	if hasFrac {
+		b.WriteString(loc.decimal)
+		b.WriteString(frac)
+	}
+	b.WriteString(exp)
+	return b.String()
+}
+
+// tableWriter writes the result for reading: every value right-aligned in
+// a fixed-width column, then the word, like the output of uniq -c.
+type tableWriter struct {
+	w *bufio.Writer
+}
+
+const tableWidth = 15
+
+func newTableWriter(w io.Writer) (recordWriter, error) {
+	return &tableWriter{bufio.NewWriter(w)}, nil
+}
+
+func (t *tableWriter) Write(word string, count tally) error {
+	for i := range valueColumns {
+		fmt.Fprintf(t.w, "%*s  ", tableWidth, localizeNumber(count.column(i).columnString()))
+	}
+	_, err := fmt.Fprintln(t.w, word)
+	return err
+}
+
+func (t *tableWriter) Close() error { return t.w.Flush() }
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ------------------- Incremental Counting -------------------
+
+// With --incremental a count keeps the merged run of every local input
+// file under <cache-dir>/incremental/<options>/, next to a manifest of the
+// size, modification time and SHA-256 of the file it was counted from. A
+// later count with the same options reuses the run of a file whose size
+// and mtime are unchanged, or whose content still hashes the same, and only
+// reads the files that were added or changed; the runs of files no longer
+// among the inputs are dropped. Standard input and URLs are always read.
+var incremental bool
+
+// incrementalInputFlags only choose the inputs, so a change of them keeps
+// the per-file runs of the files still selected.
+var incrementalInputFlags = []string{"files-from", "include", "exclude"}
+
+const incrementalManifest = "manifest.json"
+
+type incrementalEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mtime"`
+	Digest  string    `json:"sha256"`
+	Run     string    `json:"run"` // file name in the store directory
+}
+
+// incrementalStore holds the per-file runs of one set of options, keyed by
+// the absolute path of the input.
+type incrementalStore struct {
+	dir     string
+	entries map[string]incrementalEntry
+	seen    map[string]bool
+
+	unchanged, changed, added int
+}
+
+func openIncrementalStore() (*incrementalStore, error) {
+	h := sha256.New()
+	if err := writeConfig(h, "count", incrementalInputFlags...); err != nil {
+		return nil, err
+	}
+	s := &incrementalStore{
+		dir:     filepath.Join(cacheDir, "incremental", hex.EncodeToString(h.Sum(nil))),
+		entries: make(map[string]incrementalEntry),
+		seen:    make(map[string]bool),
+	}
+	data, err := os.ReadFile(filepath.Join(s.dir, incrementalManifest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.entries); err != nil {
+		// A damaged manifest only costs a full recount.
+		fmt.Fprintf(os.Stderr, "wordcount: ignoring incremental manifest %s: %v\n", s.dir, err)
+		s.entries = make(map[string]incrementalEntry)
+	}
+	return s, nil
+}
+
+// lookup returns a copy in the workspace of the run of inputFile if it is
+// unchanged since it was stored. ok is false for inputs that must be read,
+// eligible is false for those that cannot be kept at all.
+func (s *incrementalStore) lookup(inputFile string) (run string, ok, eligible bool, err error) {
+	if inputFile == stdinPath || isURL(inputFile) {
+		return "", false, false, nil
+	}
+	path := absPath(inputFile)
+	info, err := os.Stat(path)
+	if err != nil || !info.Mode().IsRegular() {
+		return "", false, false, err
+	}
+	s.seen[path] = true
+
+	e, known := s.entries[path]
+	if !known {
+		s.added++
+		return "", false, true, nil
+	}
+	if e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		digest, err := fileDigest(path)
+		if err != nil {
+			return "", false, true, err
+		}
+		if digest != e.Digest {
+			s.changed++
+			return "", false, true, nil
+		}
+		// Touched but not edited: keep the run, remember the new mtime.
+		e.Size, e.ModTime = info.Size(), info.ModTime()
+		s.entries[path] = e
+	}
+
+	run, err = copyToWorkspace(filepath.Join(s.dir, e.Run))
+	if errors.Is(err, fs.ErrNotExist) {
+		s.changed++
+		return "", false, true, nil
+	}
+	if err != nil {
+		return "", false, true, err
+	}
+	s.unchanged++
+	return run, true, true, nil
+}
+
+// keep stores merged, the run of inputFile just counted. The file is
+// hashed after counting, so a file edited meanwhile is counted again next
+// time rather than reused.
+func (s *incrementalStore) keep(inputFile, merged string) error {
+	path := absPath(inputFile)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	digest, err := fileDigest(path)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	name := sha256.Sum256([]byte(path))
+	e := incrementalEntry{Size: info.Size(), ModTime: info.ModTime(), Digest: digest, Run: hex.EncodeToString(name[:16]) + ".run"}
+	if err := copyFileAtomic(merged, filepath.Join(s.dir, e.Run)); err != nil {
+		return err
+	}
+	s.entries[path] = e
+	return nil
+}
+
+// save drops the runs of files that are no longer inputs, writes the
+// manifest and reports what was reused.
+func (s *incrementalStore) save() error {
+	removed := 0
+	for path, e := range s.entries {
+		if !s.seen[path] {
+			os.Remove(filepath.Join(s.dir, e.Run))
+			delete(s.entries, path)
+			removed++
+		}
+	}
+	if err := os.MkdirAll(s.dir, 0755); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(s.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = writeOutputFile(filepath.Join(s.dir, incrementalManifest), func(w io.Writer) error {
+		_, err := w.Write(append(data, '\n'))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	stats.reusedRuns = s.unchanged
+	fmt.Fprintf(os.Stderr, "wordcount: incremental: %d unchanged, %d changed, %d added, %d removed\n",
+		s.unchanged, s.changed, s.added, removed)
+	return nil
+}
+
+// copyToWorkspace copies a kept run into the workspace, where the merge
+// owns and eventually removes it.
+func copyToWorkspace(src string) (string, error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+	tmp, err := os.CreateTemp(workspace, "wordcount_*.tmp")
+	if err != nil {
+		return "", err
+	}
+	defer tmp.Close()
+	if _, err := io.Copy(quotaWriter{tmp}, in); err != nil {
+		removeTemp(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreyflyagin/wordcounter/corpus"
+)
+
+// TestIncremental recounts a directory corpus after each change to it and
+// checks both what was reused and the result, against the reference counts
+// of the files present.
+func TestIncremental(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "corpus"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]map[string]int64)
+	write := func(name string, seed uint64) {
+		files[name] = generate(t, dir, filepath.Join("corpus", name), corpus.Config{Tokens: 3000, Vocabulary: 600, Skew: 1.2, Seed: seed})
+	}
+
+	tests := []struct {
+		name   string
+		change func()
+		report string
+	}{
+		{"first count", func() { write("a.txt", 1); write("b.txt", 2) }, "0 unchanged, 0 changed, 2 added, 0 removed"},
+		{"file changed", func() { write("b.txt", 3) }, "1 unchanged, 1 changed, 0 added, 0 removed"},
+		{"file added", func() { write("c.txt", 4) }, "2 unchanged, 0 changed, 1 added, 0 removed"},
+		{"file removed", func() {
+			os.Remove(filepath.Join(dir, "corpus", "a.txt"))
+			delete(files, "a.txt")
+		}, "2 unchanged, 0 changed, 0 added, 1 removed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change()
+			want := make(map[string]int64)
+			for _, counts := range files {
+				for word, n := range counts {
+					want[word] += n
+				}
+			}
+			out := wordcount(t, dir, "--cache-dir", "cache", "--incremental", "-o", "out.tsv", testMaxWords, "corpus")
+			if !strings.Contains(out, "incremental: "+tt.report) {
+				t.Fatalf("got %q, want incremental: %s", out, tt.report)
+			}
+			verify(t, filepath.Join(dir, "out.tsv"), nil, want)
+		})
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// ------------------- Input Lists -------------------
+
+// filesFrom names a file listing input paths, one per line, or separated
+// by NUL bytes with -0 as written by find -print0; "-" reads the list from
+// standard input. Lists avoid the argv limit for millions of inputs.
+var (
+	filesFrom     string
+	filesFromNull bool
+)
+
+func readFileList(path string) ([]string, error) {
+	var r io.Reader = os.Stdin
+	if path != stdinPath {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	scanner := bufio.NewScanner(r)
+	if filesFromNull {
+		scanner.Split(splitDelimiter([]byte{0}))
+	}
+	var paths []string
+	for scanner.Scan() {
+		p := scanner.Text()
+		if !filesFromNull {
+			p = strings.TrimSuffix(p, "\r")
+		}
+		if p != "" {
+			paths = append(paths, p)
+		}
+	}
+	return paths, scanner.Err()
+}
+
+// includeGlob and excludeGlob filter the files found in directories and
+// by glob patterns by their base name. Files named explicitly are always
+// read.
+var (
+	includeGlob string
+	excludeGlob string
+)
+
+func selectedFile(name string) bool {
+	if includeGlob != "" {
+		if ok, _ := path.Match(includeGlob, name); !ok {
+			return false
+		}
+	}
+	if excludeGlob != "" {
+		if ok, _ := path.Match(excludeGlob, name); ok {
+			return false
+		}
+	}
+	return true
+}
+
+// expandInputs replaces the directories and glob patterns among the inputs
+// by the files they hold, in lexical order. Directories are walked
+// recursively, and "**" in a pattern matches any number of directories;
+// an existing file whose name looks like a pattern is read as is.
+func expandInputs(inputs []string) ([]string, error) {
+	var files []string
+	for _, in := range inputs {
+		info, err := os.Stat(in)
+		switch {
+		case in == stdinPath, isURL(in):
+		case err == nil && info.IsDir():
+			walked, err := walkFiles(in, nil)
+			if err != nil {
+				return nil, err
+			}
+			files = append(files, walked...)
+			continue
+		case err != nil && strings.ContainsAny(in, "*?["):
+			matched, err := globFiles(in)
+			if err != nil {
+				return nil, err
+			}
+			if len(matched) == 0 {
+				return nil, fmt.Errorf("%s: no files match", in)
+			}
+			files = append(files, matched...)
+			continue
+		}
+		files = append(files, in) // open errors are reported when it is read
+	}
+	return files, nil
+}
+
+// globFiles walks the directory that the leading literal segments of
+// pattern name and returns the files whose path below it matches the rest.
+func globFiles(pattern string) ([]string, error) {
+	segments := strings.Split(filepath.ToSlash(pattern), "/")
+	literal := 0
+	for literal < len(segments)-1 && !strings.ContainsAny(segments[literal], "*?[") {
+		literal++
+	}
+	root := strings.Join(segments[:literal], "/")
+	if root == "" && literal > 0 {
+		root = "/"
+	}
+	rest := segments[literal:]
+	for _, seg := range rest {
+		if _, err := path.Match(seg, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %v", pattern, err)
+		}
+	}
+	if root == "" {
+		root = "."
+	}
+	if info, err := os.Stat(root); err != nil || !info.IsDir() {
+		return nil, nil
+	}
+	return walkFiles(filepath.FromSlash(root), rest)
+}
+
+// walkFiles lists the files below root selected by --include and
+// --exclude and, unless pattern is nil, whose relative path matches its
+// segments.
+func walkFiles(root string, pattern []string) ([]string, error) {
+	bounded := pattern != nil && !slices.Contains(pattern, "**")
+	var files []string
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(root, p)
+		parts := strings.Split(filepath.ToSlash(rel), "/")
+		if d.IsDir() {
+			if bounded && rel != "." && len(parts) >= len(pattern) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if pattern != nil && !matchSegments(pattern, parts) || !selectedFile(d.Name()) {
+			return nil
+		}
+		files = append(files, p)
+		return nil
+	})
+	return files, err
+}
+
+// matchSegments matches a slash-separated path against pattern segments,
+// where "**" stands for zero or more segments.
+func matchSegments(pattern, parts []string) bool {
+	if len(pattern) == 0 {
+		return len(parts) == 0
+	}
+	if pattern[0] == "**" {
+		for i := range len(parts) + 1 {
+			if matchSegments(pattern[1:], parts[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(parts) == 0 {
+		return false
+	}
+	ok, _ := path.Match(pattern[0], parts[0])
+	return ok && matchSegments(pattern[1:], parts[1:])
+}
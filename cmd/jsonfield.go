@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ------------------- JSON Field Extraction -------------------
+
+// With --json-field every input line is parsed as a JSON value (JSON
+// Lines, as exported by most log pipelines) and only the string at the
+// dot-separated path, such as "message" or "request.headers.0", is
+// tokenized and counted. Numeric path elements index arrays. Blank lines
+// and lines where the path is missing or null are skipped.
+//
+// --jsonl --text-fields title,body does the same for several paths, whose
+// strings are joined with a space, so the title and body of an API dump
+// are counted as one text.
+var (
+	jsonFieldPath string
+	jsonLines     bool
+	textFields    string
+
+	jsonPaths [][]string
+)
+
+// extractJSONFields returns the strings at jsonPaths in line joined with a
+// space, false if all paths are missing or null, or an error if the line
+// is not JSON or a value not a string.
+func extractJSONFields(line string) (string, bool, error) {
+	if firstByte([]byte(line)) == 0 {
+		// A blank line.
+		return "", false, nil
+	}
+	var root any
+	if err := json.Unmarshal([]byte(line), &root); err != nil {
+		return "", false, fmt.Errorf("invalid JSON")
+	}
+
+	var text strings.Builder
+	found := false
+	for _, path := range jsonPaths {
+		value, ok := jsonValue(root, path)
+		if !ok || value == nil {
+			continue
+		}
+		s, ok := value.(string)
+		if !ok {
+			return "", false, fmt.Errorf("%s is not a string", strings.Join(path, "."))
+		}
+		if found {
+			text.WriteByte(' ')
+		}
+		text.WriteString(s)
+		found = true
+	}
+	return text.String(), found, nil
+}
+
+// jsonValue walks path down from v, false if an element is missing.
+func jsonValue(v any, path []string) (any, bool) {
+	for _, key := range path {
+		switch node := v.(type) {
+		case map[string]any:
+			var ok bool
+			if v, ok = node[key]; !ok {
+				return nil, false
+			}
+		case []any:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return nil, false
+			}
+			v = node[i]
+		default:
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func firstByte(raw []byte) byte {
+	if raw = bytes.TrimLeft(raw, " \t\r\n"); len(raw) == 0 {
+		return 0
+	}
+	return raw[0]
+}
+
+// parseJSONPath splits a --json-field or --text-fields path at its dots.
+func parseJSONPath(path string) ([]string, error) {
+	keys := strings.Split(path, ".")
+	for _, key := range keys {
+		if key == "" {
+			return nil, fmt.Errorf("empty key in %q", path)
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// ------------------- JSON Output -------------------
+
+// jsonWriter streams every record as an object {"word": ..., "count": ...}
+// (value1..valueN with --value-columns), one per line for jsonl, or as the
+// elements of one array for json. Nothing is buffered beyond the current
+// record, so memory stays flat however large the result.
+type jsonWriter struct {
+	w       *bufio.Writer
+	array   bool
+	names   []string
+	buf     []byte
+	records int
+}
+
+func newJSONWriter(w io.Writer) (recordWriter, error) {
+	return &jsonWriter{w: bufio.NewWriter(w), array: true, names: valueColumnNames()}, nil
+}
+
+func newJSONLWriter(w io.Writer) (recordWriter, error) {
+	return &jsonWriter{w: bufio.NewWriter(w), names: valueColumnNames()}, nil
+}
+
+func (j *jsonWriter) Write(word string, t tally) error {
+	b := j.buf[:0]
+	if j.array {
+		if j.records == 0 {
+			b = append(b, "[\n"...)
+		} else {
+			b = append(b, ",\n"...)
+		}
+	}
+	b = append(b, `{"word":`...)
+	b = appendJSONString(b, word)
+	for i, name := range j.names {
+		b = append(b, ',', '"')
+		b = append(b, name...)
+		b = append(b, '"', ':')
+		b = appendJSONNumber(b, t.column(i).columnString())
+	}
+	b = append(b, '}')
+	if !j.array {
+		b = append(b, '\n')
+	}
+	j.buf = b
+	j.records++
+	_, err := j.w.Write(b)
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	if j.array {
+		end := "\n]\n"
+		if j.records == 0 {
+			end = "[]\n"
+		}
+		if _, err := j.w.WriteString(end); err != nil {
+			return err
+		}
+	}
+	return j.w.Flush()
+}
+
+// appendJSONNumber appends a formatted value, or null for the infinities
+// and NaN, which JSON cannot represent.
+func appendJSONNumber(b []byte, value string) []byte {
+	if f, err := strconv.ParseFloat(value, 64); err == nil && (math.IsInf(f, 0) || math.IsNaN(f)) {
+		return append(b, "null"...)
+	}
+	return append(b, value...)
+}
+
+// appendJSONString appends s as a JSON string. Invalid UTF-8 becomes
+// U+FFFD, as with encoding/json.
+func appendJSONString(b []byte, s string) []byte {
+	const hex = "0123456789abcdef"
+	b = append(b, '"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b = append(b, '\\', c)
+			case c == '\n':
+				b = append(b, '\\', 'n')
+			case c == '\r':
+				b = append(b, '\\', 'r')
+			case c == '\t':
+				b = append(b, '\\', 't')
+			case c < 0x20:
+				b = append(b, '\\', 'u', '0', '0', hex[c>>4], hex[c&0xf])
+			default:
+				b = append(b, c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b = append(b, "\ufffd"...)
+		} else {
+			b = append(b, s[i:i+size]...)
+		}
+		i += size
+	}
+	return append(b, '"')
+}
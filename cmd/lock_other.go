@@ -0,0 +1,14 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// Without flock a workspace cannot be told from one left by a crashed run,
+// so clean-temp leaves all workspaces alone here.
+const workspaceLocking = false
+
+// lockFile is a no-op where flock is unavailable.
+func lockFile(f *os.File) error {
+	return nil
+}
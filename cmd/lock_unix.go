@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// workspaceLocking reports whether lockFile tells live workspaces from
+// abandoned ones.
+const workspaceLocking = true
+
+// lockFile takes an exclusive advisory lock on f without blocking. The
+// kernel drops it when the process exits, even after a crash.
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+}
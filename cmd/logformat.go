@@ -0,0 +1,247 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------- Log Formats -------------------
+
+// With --log-format every input line is parsed as a log entry, and only
+// its message is tokenized and counted: the request line of the common and
+// combined (Apache/Nginx) formats, the message of a syslog line (RFC 3164
+// or RFC 5424), or the msg (or message) value of a logfmt line. Lines
+// that do not parse are warned about. With --log-bucket every word is
+// also keyed by the time of its line, truncated to the minute, hour or day
+// in UTC, as <bucket><key-sep><word>, so the result is grouped by time.
+// With --log-field the whole value of another field, such as the path or
+// status of an access log or any logfmt key, is counted instead of the
+// words of the message.
+var (
+	logFormat    string
+	logBucket    string
+	logFieldName string
+
+	logParser       func(dst []logField, line string) ([]logField, bool)
+	logBucketLayout string
+)
+
+type logField struct {
+	name, value string
+}
+
+var logParsers = map[string]func(dst []logField, line string) ([]logField, bool){
+	"":         nil,
+	"common":   parseCommonLog,
+	"combined": parseCombinedLog,
+	"syslog":   parseSyslog,
+	"logfmt":   parseLogfmt,
+}
+
+var logBucketLayouts = map[string]string{
+	"":       "",
+	"minute": "2006-01-02T15:04",
+	"hour":   "2006-01-02T15",
+	"day":    "2006-01-02",
+}
+
+// logTimeLayouts are tried in order on the time field.
+var logTimeLayouts = []string{
+	"02/Jan/2006:15:04:05 -0700", // common log format
+	time.RFC3339Nano,
+	time.Stamp, // RFC 3164 has no year: buckets start with 0000
+}
+
+// logLine parses line with the --log-format parser into fields, reusing
+// dst, and returns the text to count and the --log-bucket of its time.
+func logLine(dst []logField, line string) (fields []logField, text, bucket string, err error) {
+	fields, ok := logParser(dst[:0], line)
+	if !ok {
+		return fields, "", "", fmt.Errorf("not a %s log line", logFormat)
+	}
+	if logFieldName != "" {
+		text = logValue(fields, logFieldName)
+	} else {
+		text = logValue(fields, "request", "message", "msg")
+	}
+	if logBucketLayout == "" {
+		return fields, text, "", nil
+	}
+	stamp := logValue(fields, "time", "ts", "timestamp")
+	for _, layout := range logTimeLayouts {
+		if t, err := time.Parse(layout, stamp); err == nil {
+			return fields, text, t.UTC().Format(logBucketLayout), nil
+		}
+	}
+	return fields, "", "", fmt.Errorf("no time to bucket in log line")
+}
+
+// logValue returns the value of the first of names found in fields.
+func logValue(fields []logField, names ...string) string {
+	for _, name := range names {
+		for _, f := range fields {
+			if f.name == name {
+				return f.value
+			}
+		}
+	}
+	return ""
+}
+
+// clfFields name the fields of the combined log format, of which the
+// common log format has the first seven.
+var clfFields = []string{"host", "ident", "user", "time", "request", "status", "bytes", "referer", "agent"}
+
+func parseCommonLog(dst []logField, line string) ([]logField, bool) {
+	return parseCLF(dst, line, 7)
+}
+
+func parseCombinedLog(dst []logField, line string) ([]logField, bool) {
+	return parseCLF(dst, line, 9)
+}
+
+// parseCLF splits a common or combined log line at spaces, [bracketed]
+// and "quoted" fields being single fields. The request is also split into
+// method, path and protocol.
+func parseCLF(dst []logField, line string, want int) ([]logField, bool) {
+	for i := 0; ; i++ {
+		line = strings.TrimLeft(line, " ")
+		if line == "" {
+			break
+		}
+		var value string
+		switch line[0] {
+		case '[':
+			end := strings.IndexByte(line, ']')
+			if end < 0 {
+				return dst, false
+			}
+			value, line = line[1:end], line[end+1:]
+		case '"':
+			var ok bool
+			if value, line, ok = cutQuoted(line[1:]); !ok {
+				return dst, false
+			}
+		default:
+			value, line, _ = strings.Cut(line, " ")
+		}
+		if i < len(clfFields) {
+			dst = append(dst, logField{clfFields[i], value})
+		}
+	}
+	if len(dst) < want {
+		return dst, false
+	}
+	method, rest, _ := strings.Cut(dst[4].value, " ")
+	path, protocol, _ := strings.Cut(rest, " ")
+	return append(dst, logField{"method", method}, logField{"path", path}, logField{"protocol", protocol}), true
+}
+
+// cutQuoted returns the value of a quoted string whose opening quote has
+// been consumed, with backslash escapes resolved, and the rest after the
+// closing quote.
+func cutQuoted(s string) (value, rest string, ok bool) {
+	escapes := false
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\\':
+			escapes = true
+			i++
+		case '"':
+			if !escapes {
+				return s[:i], s[i+1:], true
+			}
+			if value, err := strconv.Unquote(`"` + s[:i] + `"`); err == nil {
+				return value, s[i+1:], true
+			}
+			return strings.ReplaceAll(s[:i], `\"`, `"`), s[i+1:], true
+		}
+	}
+	return "", "", false
+}
+
+// parseSyslog parses an RFC 5424 line ("<pri>1 time host app procid msgid
+// structured-data message") or a traditional RFC 3164 one ("<pri>Mmm dd
+// hh:mm:ss host tag[pid]: message"); the priority is optional.
+func parseSyslog(dst []logField, line string) ([]logField, bool) {
+	if strings.HasPrefix(line, "<") {
+		end := strings.IndexByte(line, '>')
+		if end < 0 {
+			return dst, false
+		}
+		dst = append(dst, logField{"priority", line[1:end]})
+		line = line[end+1:]
+	}
+	if rest, ok := strings.CutPrefix(line, "1 "); ok {
+		parts := strings.SplitN(rest, " ", 6)
+		if len(parts) < 6 {
+			return dst, false
+		}
+		for i, name := range []string{"time", "host", "app", "pid", "msgid"} {
+			dst = append(dst, logField{name, parts[i]})
+		}
+		msg := parts[5]
+		if rest, ok := strings.CutPrefix(msg, "-"); ok {
+			msg = rest
+		} else {
+			for strings.HasPrefix(msg, "[") {
+				end := strings.IndexByte(msg, ']')
+				if end < 0 {
+					return dst, false
+				}
+				msg = msg[end+1:]
+			}
+		}
+		msg = strings.TrimPrefix(strings.TrimPrefix(msg, " "), "\ufeff")
+		return append(dst, logField{"message", msg}), true
+	}
+
+	if len(line) < len(time.Stamp)+1 || line[len(time.Stamp)] != ' ' {
+		return dst, false
+	}
+	dst = append(dst, logField{"time", line[:len(time.Stamp)]})
+	host, rest, ok := strings.Cut(line[len(time.Stamp)+1:], " ")
+	if !ok {
+		return dst, false
+	}
+	dst = append(dst, logField{"host", host})
+	if tag, msg, ok := strings.Cut(rest, ": "); ok && !strings.Contains(tag, " ") {
+		app, pid, _ := strings.Cut(strings.TrimSuffix(tag, "]"), "[")
+		dst = append(dst, logField{"app", app}, logField{"pid", pid})
+		rest = msg
+	}
+	return append(dst, logField{"message", rest}), true
+}
+
+// parseLogfmt parses key=value pairs separated by spaces; values may be
+// quoted, and a key without "=" is a flag with an empty value.
+func parseLogfmt(dst []logField, line string) ([]logField, bool) {
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return dst, len(dst) > 0
+		}
+		end := strings.IndexAny(line, "= \t")
+		if end == 0 {
+			return dst, false
+		}
+		if end < 0 || line[end] != '=' {
+			key, rest, _ := strings.Cut(line, " ")
+			dst, line = append(dst, logField{key, ""}), rest
+			continue
+		}
+		key, value := line[:end], ""
+		line = line[end+1:]
+		if strings.HasPrefix(line, `"`) {
+			var ok bool
+			if value, line, ok = cutQuoted(line[1:]); !ok {
+				return dst, false
+			}
+		} else {
+			value, line, _ = strings.Cut(line, " ")
+		}
+		dst = append(dst, logField{key, value})
+	}
+}
@@ -2,142 +2,1380 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"container/heap"
+	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"path"
+	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
 )
 
 var MAX_WORDS_IN_MEMORY int
 
+// commands are the subcommands accepted before the options.
+var commands = []string{"merge", "aggregate", "verify", "export", "clean-temp", "simulate", "stopwords", "variants", "check"}
+
+var (
+	notifyURL  string
+	jobID      string
+	jsonResult bool
+
+	resultPath   string
+	outputFormat string
+	runCodecName string
+	runCodec     runfile.Codec
+
+	weighted       bool
+	floatCounts    bool
+	floatPrecision int
+	aggOp          string
+	valueColumns   int
+
+	keySep        string
+	secondarySort string
+
+	limitTokens int
+	limitBytes  int64
+	skipLines   int
+	skipBytes   int64
+)
+
+// stats collects summary figures about the current run for reporting.
+var stats struct {
+	tokens      int
+	inputBytes  int64
+	tempRuns    int
+	mergeRounds int
+	cacheHit    bool
+	warnings    int
+
+	repairedRuns int
+	reusedRuns   int
+	limited      bool
+	deadlineHit  bool
+
+	// spillCodecs counts the spills written with each codec chosen by
+	// --run-codec auto.
+	spillCodecs map[string]int
+
+	// corpus and classes are measured during the final merge with
+	// --entropy and --classes.
+	corpus  *corpusStats
+	classes *classTotals
+
+	// startOffset and endOffset delimit the consumed part of the input
+	// stoppedIn, the last one read: --skip-bytes endOffset continues where
+	// a limited run of that input alone stopped.
+	startOffset, endOffset int64
+	stoppedIn              string
+}
+
+// serve, when set by a build for another host such as WebAssembly (see
+// wasm.go), takes over from the command line.
+var serve func()
+
 func main() {
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: wordcount <max_words_in_memory> <input_file>")
-		os.Exit(1)
+	defineFlags()
+	flag.Usage = usage
+	if serve != nil {
+		serve()
+		return
+	}
+	cmdArgs := os.Args[1:]
+	if len(cmdArgs) > 0 && cmdArgs[0] == "rerun" {
+		if len(cmdArgs) != 2 {
+			failUsage()
+		}
+		replayed, err := readRunArgs(cmdArgs[1])
+		if err == nil {
+			err = applyCredentialEnv(flag.CommandLine)
+		}
+		if err != nil {
+			failRun(err)
+		}
+		cmdArgs = replayed
+	} else if err := applyEnv(flag.CommandLine); err != nil {
+		failRun(err)
+	}
+
+	mode := "count"
+	if len(cmdArgs) > 0 && slices.Contains(commands, cmdArgs[0]) {
+		mode, cmdArgs = cmdArgs[0], cmdArgs[1:]
+	}
+	flag.CommandLine.Parse(cmdArgs)
+
+	if mode == "clean-temp" {
+		if err := cleanTemp(); err != nil {
+			failRun(err)
+		}
+		return
+	}
+	if mode == "simulate" {
+		if err := simulateMerge(os.Stdout); err != nil {
+			failRun(err)
+		}
+		return
+	}
+
+	if _, ok := recordWriters[outputFormat]; !ok {
+		failRun("Invalid format:", outputFormat)
+	}
+	if outputFormat == "packed" && (valueColumns != 1 || keySep != "") {
+		failRun("Invalid format: packed holds one value column in byte-wise key order (no --value-columns or --key-sep)")
+	}
+
+	if _, ok := numberLocales[numberLocale]; numberLocale != "" && !ok {
+		failRun("Invalid locale:", numberLocale)
 	}
 
 	var err error
-	MAX_WORDS_IN_MEMORY, err = strconv.Atoi(os.Args[1])
+	autoCodec = runCodecName == "auto"
+	if !autoCodec {
+		runCodec, err = runfile.ParseCodec(runCodecName)
+	}
+	if err != nil {
+		failRun("Invalid run-codec:", runCodecName)
+	}
+
+	if !slices.Contains(aggOps, aggOp) {
+		failRun("Invalid agg:", aggOp)
+	}
+
+	if valueColumns < 1 || valueColumns > 1 && mode == "count" && !weighted {
+		failRun("Invalid value-columns:", valueColumns, "(more than one needs --weighted or merge)")
+	}
+
+	if !slices.Contains(secondaryOrders, secondarySort) {
+		failRun("Invalid secondary-sort:", secondarySort)
+	}
+
+	outputColumns, err = parseColumns(columnsSpec)
+	if err != nil {
+		failRun("Invalid columns:", err)
+	}
+	if outputColumns != nil && outputFormat != "tsv" && outputFormat != "csv" {
+		failRun("Invalid columns: --columns only applies to --format tsv and csv")
+	}
+
+	if maxTempBytes < 0 {
+		failRun("Invalid max-temp-bytes:", maxTempBytes)
+	}
+
+	if corpusEntropy && aggOp != aggSum && aggOp != aggCount {
+		failRun("Invalid entropy: --entropy needs --agg sum or count")
+	}
+	if !slices.Contains(partitionKeys, partitionBy) {
+		failRun("Invalid partition-by:", partitionBy)
+	}
+	if !slices.Contains(sortOrders, sortOrder) || sortOrder == "count" && (outputFormat == "run" || outputFormat == "packed" || keySep != "") {
+		failRun("Invalid sort:", sortOrder, "(key or count; count not with --format run or packed or --key-sep, which order by key)")
+	}
+	if topWords < 0 || topWords > 0 && (outputFormat == "run" || outputFormat == "packed") {
+		failRun("Invalid top:", topWords, "(not with --format run or packed, whose records must be sorted by key)")
+	}
+	if outputSpecs != "" {
+		if err := parseOutputs(outputSpecs); err != nil {
+			failRun("Invalid outputs:", err)
+		}
+		if dfOutput && (mode != "count" || aggOp != aggSum && aggOp != aggCount) {
+			failRun("Invalid outputs: df is only computed while counting, with --agg sum or count")
+		}
+	}
+
+	if tokenClasses && aggOp != aggSum && aggOp != aggCount {
+		failRun("Invalid classes: --classes needs --agg sum or count")
+	}
+
+	if httpConcurrency < 1 {
+		failRun("Invalid http-concurrency:", httpConcurrency)
+	}
+
+	if !slices.Contains(readErrorPolicies, onReadError) {
+		failRun("Invalid on-read-error:", onReadError)
+	}
+
+	splitRecords, err = parseRecordSeparator(recordSeparator)
+	if err != nil {
+		failRun(err)
+	}
+
+	if !slices.Contains(countModes, countMode) {
+		failRun("Invalid mode:", countMode)
+	}
+	if countMode != "words" {
+		if weighted || splitMode != "lines" || tokenPattern != "" || recordSeparator != "newline" {
+			failRun("Invalid mode:", countMode, "cannot be combined with --weighted, --split, --token-regex or --record-separator")
+		}
+		splitRecords = bufio.ScanRunes
+		if countMode == "bytes" {
+			splitRecords = bufio.ScanBytes
+		}
+	}
+
+	if !slices.Contains(splitModes, splitMode) {
+		failRun("Invalid split:", splitMode)
+	}
+	if splitMode == "words" && weighted {
+		failRun("Invalid split: words cannot be combined with --weighted")
+	}
+
+	if tokenPattern != "" {
+		if splitMode != "lines" || weighted {
+			failRun("Invalid token-regex: cannot be combined with --split=words or --weighted")
+		}
+		if tokenRegex, err = regexp.Compile(tokenPattern); err != nil {
+			failRun("Invalid token-regex:", err)
+		}
+	}
+
+	if fieldIndex < 0 {
+		failRun("Invalid field:", fieldIndex)
+	}
+	if fieldIndex > 0 && (weighted || countMode != "words") {
+		failRun("Invalid field: cannot be combined with --weighted or --mode")
+	}
+	if stripHTML && (limitBytes > 0 || limitTokens > 0) {
+		failRun("Invalid strip-html: offsets would refer to the stripped text, so no --limit-bytes or --limit-tokens")
+	}
+
+	var ok bool
+	if logParser, ok = logParsers[logFormat]; !ok {
+		failRun("Invalid log-format:", logFormat)
+	}
+	if logFormat != "" && (fieldIndex > 0 || jsonFieldPath != "" || jsonLines || weighted || countMode != "words") {
+		failRun("Invalid log-format: cannot be combined with --field, --json-field, --jsonl, --weighted or --mode")
+	}
+	if logFieldName != "" && logFormat == "" {
+		failRun("Invalid log-field:", logFieldName, "(needs --log-format)")
+	}
+	if logBucketLayout, ok = logBucketLayouts[logBucket]; !ok || logBucket != "" && (logFormat == "" || keySep == "") {
+		failRun("Invalid log-bucket:", logBucket, "(minute, hour or day, with --log-format and --key-sep)")
+	}
+
+	if textFields != "" && !jsonLines || jsonLines && (textFields == "" || jsonFieldPath != "") {
+		failRun("Invalid jsonl/text-fields: --jsonl needs --text-fields (and replaces --json-field)")
+	}
+	if paths := jsonFieldPath + textFields; paths != "" {
+		if fieldIndex > 0 || weighted || countMode != "words" || recordSeparator != "newline" {
+			failRun("Invalid json-field/jsonl: cannot be combined with --field, --weighted, --mode or --record-separator")
+		}
+		for _, path := range strings.Split(paths, ",") {
+			keys, err := parseJSONPath(path)
+			if err != nil {
+				failRun("Invalid json-field/text-fields:", err)
+			}
+			jsonPaths = append(jsonPaths, keys)
+		}
+	}
+	if csvInput != (csvColumns != "") {
+		failRun("Invalid csv/column: --csv needs --column and --column needs --csv")
+	}
+	if csvInput {
+		if fieldIndex > 0 || jsonPaths != nil || logFormat != "" || weighted || countMode != "words" || recordSeparator != "newline" {
+			failRun("Invalid csv: cannot be combined with --field, --json-field, --jsonl, --log-format, --weighted, --mode or --record-separator")
+		}
+		csvColumnNames = strings.Split(csvColumns, ",")
+		splitRecords = splitCSVRecords
+	}
+	if fieldDelim, err = strconv.Unquote(`"` + fieldSep + `"`); err != nil || fieldDelim == "" {
+		failRun(fmt.Sprintf("Invalid field-sep: %q", fieldSep))
+	}
+
+	tok, ok := tokenizers[tokenizerName]
+	if !ok {
+		failRun("Invalid tokenizer:", tokenizerName)
+	}
+	if tok != nil && (splitMode != "lines" || tokenPattern != "" || weighted || countMode != "words") {
+		failRun("Invalid tokenizer:", tokenizerName, "cannot be combined with --split=words, --token-regex, --weighted or --mode")
+	}
+	tokenizer = tok
+	if cjkDictFile != "" {
+		if tokenizerName != "cjk" {
+			failRun("Invalid cjk-dict: requires --tokenizer=cjk")
+		}
+		if err := loadCJKDict(cjkDictFile); err != nil {
+			failRun("Invalid cjk-dict:", err)
+		}
+	}
+
+	if !slices.Contains(hyphenPolicies, hyphenPolicy) {
+		failRun("Invalid hyphens:", hyphenPolicy)
+	}
+	if !slices.Contains(apostrophePolicies, apostrophePolicy) {
+		failRun("Invalid apostrophes:", apostrophePolicy)
+	}
+
+	form, ok := unicodeForms[normalizeForm]
+	if !ok {
+		failRun("Invalid normalize:", normalizeForm)
+	}
+	unicodeForm = form
+
+	stem, ok := stemmers[stemName]
+	if !ok {
+		failRun("Invalid stem:", stemName)
+	}
+	stemmer = stem
+	if keysNormalized() && (mode == "merge" || mode == "aggregate") {
+		// Normalized keys are no longer sorted: re-aggregate them like
+		// --rekey does, before any of its rules.
+		rekeyRules = append([]func(string) string{normalizeKey}, rekeyRules...)
+	}
+
+	if collapseDepth < 0 || collapseSep == "" && len(collapsePrefixes) > 0 || slices.Contains(collapsePrefixes, "") {
+		failRun(fmt.Sprintf("Invalid collapse-depth/collapse-sep/collapse-prefix: %d %q %q", collapseDepth, collapseSep, collapsePrefixes))
+	}
+
+	if minLen < 0 || maxLen < 0 || maxLen > 0 && minLen > maxLen {
+		failRun("Invalid min-len/max-len:", minLen, maxLen)
+	}
+
+	if stopwordsFile != "" {
+		if err := loadStopwords(stopwordsFile); err != nil {
+			failRun("Invalid stopwords:", err)
+		}
+	}
+
+	if err := compileLineFilters(); err != nil {
+		failRun(err)
+	}
+
+	if mode == "verify" {
+		if flag.NArg() == 0 {
+			failUsage()
+		}
+		ok, err := verifyRuns(flag.Args())
+		if err != nil {
+			failRun(err)
+		}
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if mode == "export" {
+		if flag.NArg() != 1 || !slices.Contains(exportBucketings, exportBuckets) {
+			failUsage()
+		}
+		if err := exportVocabulary(flag.Arg(0), os.Stdout); err != nil {
+			failRun(err)
+		}
+		return
+	}
+
+	if mode == "stopwords" {
+		if flag.NArg() != 1 || !slices.Contains(stopClasses, stopClass) || stopCoverage <= 0 || stopCoverage > 1 {
+			failUsage()
+		}
+		if err := stopwordList(flag.Arg(0), os.Stdout); err != nil {
+			failRun(err)
+		}
+		return
+	}
+
+	if mode == "variants" {
+		if flag.NArg() != 1 || variantDistance < 1 || variantWindow < 1 || variantRatio < 1 {
+			failUsage()
+		}
+		if err := spellingVariants(flag.Arg(0), os.Stdout); err != nil {
+			failRun(err)
+		}
+		return
+	}
+
+	if repair && strict {
+		failRun("--repair and --strict are mutually exclusive")
+	}
+
+	args := positionalArgs(flag.CommandLine)
+	if mode == "count" && len(args) == 1 && filesFrom == "" {
+		args = append(args, stdinPath)
+	}
+	if n := slices.Index(args, stdinPath); n >= 0 && slices.Contains(args[n+1:], stdinPath) {
+		failRun("Standard input (-) can only be given once")
+	}
+	if len(args) < 2 && (filesFrom == "" || len(args) < 1) {
+		failUsage()
+	}
+
+	replay := resolvedRunArgs(flag.CommandLine, mode, args)
+
+	MAX_WORDS_IN_MEMORY, err = strconv.Atoi(args[0])
 	if err != nil || MAX_WORDS_IN_MEMORY <= 0 {
-		fmt.Println("Invalid MAX_WORDS_IN_MEMORY:", os.Args[1])
+		failRun("Invalid MAX_WORDS_IN_MEMORY:", args[0])
+	}
+
+	inputs := args[1:]
+	outputFile := resultPath
+	partitionBase = outputFile
+	if outputFile == "" {
+		failRun("Invalid output: empty path")
+	}
+	if outputFile == stdoutPath && (schemaManifest || tokenClasses || partitionBy != "" || outputSpecs != "" || jsonResult) {
+		failRun("Invalid output: standard output (-) cannot be combined with --schema, --classes, --partition-by, --outputs or --json")
+	}
+
+	if mode == "count" || mode == "merge" || mode == "check" {
+		for _, glob := range []string{includeGlob, excludeGlob} {
+			if _, err := path.Match(glob, ""); err != nil {
+				failRun("Invalid include/exclude pattern:", glob)
+			}
+		}
+		inputs, err = expandInputs(inputs)
+		if err != nil {
+			failRun(err)
+		}
+	}
+
+	if filesFrom != "" {
+		if mode != "count" && mode != "merge" {
+			failRun("Invalid files-from: only counting and merge take input lists")
+		}
+		if filesFrom == stdinPath && slices.Contains(inputs, stdinPath) {
+			failRun("Invalid files-from: standard input cannot hold both the list and an input")
+		}
+		listed, err := readFileList(filesFrom)
+		if err != nil {
+			failRun(err)
+		}
+		inputs = append(inputs, listed...)
+		if len(inputs) == 0 {
+			failRun("Invalid files-from:", filesFrom, "lists no files")
+		}
+	}
+
+	if mode == "check" {
+		if !slices.Contains(checkReferences, checkAgainst) {
+			failRun("Invalid against:", checkAgainst)
+		}
+		if slices.Contains(inputs, stdinPath) || deadline > 0 || runStore != "" {
+			failRun("Invalid check: the inputs are read twice, so no standard input, --deadline or --run-store")
+		}
+	}
+
+	if incremental {
+		if mode != "count" || cacheDir == "" {
+			failRun("Invalid incremental: only counting with --cache-dir keeps per-file runs")
+		}
+		if deadline > 0 || limitTokens > 0 || limitBytes > 0 || dfOutput {
+			failRun("Invalid incremental: not with --deadline, --limit-tokens, --limit-bytes or --outputs df")
+		}
+	}
+
+	if mode == "aggregate" {
+		inputs, err = selectStoredRuns(inputs[0])
+		if err != nil {
+			failRun(err)
+		}
+	}
+
+	if jobID == "" {
+		jobID = newJobID()
+	}
+
+	start := time.Now()
+	status.started = start
+	runStart, runOutput = start, outputFile
+	release, err := createWorkspace()
+	if err == nil {
+		watchPause()
+		startDeadline()
+		stopWatchdog := startWatchdog(release)
+		err = runCached(mode, inputs, outputFile)
+		stopWatchdog()
+		if err == nil {
+			err = markPartial(outputFile)
+		}
+		if err == nil && schemaManifest {
+			err = writeSchema(outputFile)
+		}
+		if err == nil && stats.classes != nil {
+			err = writeClasses(outputFile, stats.classes)
+		}
+		if err == nil && mode != "check" && outputFile != stdoutPath {
+			err = writeRunArgs(outputFile, replay)
+		}
+		release()
+	}
+	endRun(err, notifyTimeout)
+}
+
+// runStart and runOutput describe the run for endRun.
+var (
+	runStart  time.Time
+	runOutput string
+)
+
+// ending is taken by the first endRun and never released, so a run killed
+// by the watchdog or a signal while it finishes is reported only once.
+var ending sync.Mutex
+
+// endRun reports how the run ended, through the status file, --notify-url
+// (waiting at most timeout) and the summary on stdout with --json or the
+// error on stderr, and exits with status 1 if err is not nil.
+func endRun(err error, timeout time.Duration) {
+	ending.Lock()
+	finishStatus(err)
+	report := newJobReport(runOutput, runStart, err)
+	if notifyURL != "" {
+		if nerr := notify(notifyURL, report, timeout); nerr != nil {
+			fmt.Fprintln(os.Stderr, "notify:", nerr)
+		}
+	}
+	if err == nil && stats.corpus != nil && !jsonResult {
+		printCorpusStats(os.Stderr, stats.corpus)
+	}
+	if jsonResult {
+		json.NewEncoder(os.Stdout).Encode(report)
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if err != nil {
 		os.Exit(1)
 	}
+}
+
+// failRun ends a run that fails before its counting phases, such as one
+// with invalid options, the way a failed run ends: msg goes to stderr, or
+// with --json into the failure summary on stdout, and the exit status is 1.
+func failRun(msg ...any) {
+	err := errors.New(strings.TrimSuffix(fmt.Sprintln(msg...), "\n"))
+	if !jsonResult {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	report := newJobReport("", time.Now(), err)
+	if report.JobID == "" {
+		report.JobID = newJobID()
+	}
+	json.NewEncoder(os.Stdout).Encode(report)
+	os.Exit(1)
+}
+
+// failUsage prints the usage and fails the run for an invalid command line.
+func failUsage() {
+	usage()
+	if jsonResult {
+		failRun("invalid command line, see usage")
+	}
+	os.Exit(1)
+}
+
+// defineFlags defines every option on flag.CommandLine.
+func defineFlags() {
+	flag.StringVar(&notifyURL, "notify-url", "", "POST a JSON job summary to `url` when the run finishes or fails")
+	flag.StringVar(&jobID, "job-id", "", "job identifier reported in notifications and the status file (default: generated)")
+	flag.StringVar(&statusFile, "status-file", "", "keep a JSON progress report at `path`, updated atomically during the run")
+	flag.BoolVar(&jsonResult, "json", false, "print the job summary as JSON on stdout, including failures, which exit with status 1")
+	flag.StringVar(&resultPath, "output", "output.tsv", "write the result to `path`, or to standard output with -")
+	flag.StringVar(&resultPath, "o", "output.tsv", "shorthand for --output")
+	flag.StringVar(&outputFormat, "format", "tsv", "output `format`: tsv, csv (with a header row), run (the binary run format of package runfile), packed (the indexed, memory-mappable format of package result), arrow (an Arrow IPC stream), msgpack, protobuf (length-prefixed records), json (an array of {word, count} objects), jsonl (one such object per line) or table (aligned, for reading)")
+	flag.StringVar(&numberLocale, "locale", "", "group digits in table and export output the `locale` way: en (1,234.5), de (1.234,5), fr (1 234,5) or ch (1'234.5)")
+	flag.StringVar(&runCodecName, "run-codec", "none", "compression `codec` for temporary runs and run output: none, flate, s2, zstd or auto (temporary runs pick the fastest codec as measured during the run; run output is not compressed)")
+	flag.BoolVar(&weighted, "weighted", false, "read input lines as word<TAB>weight and add the weight instead of 1")
+	flag.BoolVar(&floatCounts, "float-counts", false, "sum counts and weights as float64 instead of exact integers")
+	flag.IntVar(&floatPrecision, "float-precision", -1, "`digits` after the decimal point for --float-counts output (-1: shortest exact representation)")
+	flag.StringVar(&aggOp, "agg", aggSum, "`operator` combining the values of a word: "+strings.Join(aggOps, ", "))
+	flag.IntVar(&valueColumns, "value-columns", 1, "`number` of tab-separated value columns per key in --weighted input and merged files, aggregated column-wise")
+	flag.StringVar(&columnsSpec, "columns", "", "comma-separated TSV output `columns`: word, count (or value1..valueN), freq (share of the total) and bytes (count times word length)")
+	flag.BoolVar(&corpusEntropy, "entropy", false, "report the Shannon entropy, redundancy and unigram compressibility of the result (needs --agg sum or count)")
+	flag.BoolVar(&tokenClasses, "classes", false, "write the distinct words and tokens per class (alphabetic, numeric, mixed, punctuation, url, emoji) to <output>.classes.tsv (needs --agg sum or count)")
+	flag.StringVar(&sortOrder, "sort", "key", "output `order`: key, or count (largest first, sorted externally after the final merge)")
+	flag.IntVar(&topWords, "top", 0, "only write the `n` words with the largest values, largest first, without writing the full result (0: all words)")
+	flag.StringVar(&outputSpecs, "outputs", "", "comma-separated extra `outputs` computed in the same pass: top:N (<output>.top.tsv), df (document frequencies, <output>.df.tsv) and by:length|first-letter|script (partitions)")
+	flag.StringVar(&partitionBy, "partition-by", "", "also write the result split into one file per `bucket` (<output>.<bucket>.<ext>, e.g. output.tsv.a.tsv): length, first-letter or script")
+	flag.BoolVar(&schemaManifest, "schema", false, "describe the emitted columns in <output>.schema.json")
+	flag.StringVar(&keySep, "key-sep", "", "treat keys as primary<`SEP`>secondary: output is grouped by primary key and ordered by --secondary-sort within each group")
+	flag.StringVar(&secondarySort, "secondary-sort", "asc", "`order` of secondary keys within a group: "+strings.Join(secondaryOrders, ", "))
+	flag.Var(&rekeySpecs, "rekey", "re-key records during the final merge with `rule` and re-aggregate them: strip-prefix:P, strip-suffix:S, truncate:N, before:SEP or regex:RE (repeatable, applied in order)")
+	flag.Var(&collapsePrefixes, "collapse-prefix", "roll up keys starting with `prefix` during the final merge, cut after --collapse-depth segments (repeatable)")
+	flag.IntVar(&collapseDepth, "collapse-depth", 1, "`number` of --collapse-sep separated segments after a --collapse-prefix kept in roll-up keys")
+	flag.StringVar(&collapseSep, "collapse-sep", "_", "`separator` of the segments of --collapse-prefix keys")
+	flag.BoolVar(&collapseDetail, "collapse-detail", false, "keep the detailed keys next to the roll-ups, which are then marked with a trailing *")
+	flag.StringVar(&cacheDir, "cache-dir", "", "reuse results stored in `dir`, keyed by the input contents and options")
+	flag.BoolVar(&incremental, "incremental", false, "with --cache-dir, keep the run of every input file and only recount the files added or changed since")
+	flag.StringVar(&redisURL, "redis", "", "also load the result into Redis at `url` (redis://[:password@]host[:port][/db])")
+	flag.StringVar(&redisKey, "redis-key", "wordcount", "Redis key `prefix`: counts go to the hash <prefix>:counts, the top words to the sorted set <prefix>:top")
+	flag.IntVar(&redisTopN, "redis-top", 1000, "`number` of most frequent words kept in the <prefix>:top sorted set (0: none)")
+	flag.StringVar(&clickhouseURL, "clickhouse", "", "also insert the result into ClickHouse over the native protocol at `url` (clickhouse://[user[:password]@]host[:port][/db])")
+	flag.StringVar(&clickhouseTable, "clickhouse-table", "wordcount", "ClickHouse `table`, optionally db.table, with columns (word String, count Int64, UInt64 or Float64)")
+	flag.StringVar(&filesFrom, "files-from", "", "also count (or merge) the paths listed in `file`, one per line (- for standard input)")
+	flag.IntVar(&httpConcurrency, "http-concurrency", 1, "read URL inputs as `n` parallel range requests of 8 MiB when the server supports ranges")
+	flag.StringVar(&includeGlob, "include", "", "only read files whose name matches `glob` when walking directories and expanding patterns")
+	flag.StringVar(&excludeGlob, "exclude", "", "skip files whose name matches `glob` when walking directories and expanding patterns")
+	flag.BoolVar(&filesFromNull, "0", false, "--files-from paths are separated by NUL bytes, as written by find -print0")
+	flag.StringVar(&runStore, "run-store", "", "keep the sorted run of each counted input under `dir`/<date>/<name>.run for later aggregation")
+	flag.StringVar(&storeGlob, "runs-matching", "*", "aggregate: only stored runs whose input name matches `glob`")
+	flag.StringVar(&storeSince, "runs-since", "", "aggregate: only runs stored on or after `date` (YYYY-MM-DD)")
+	flag.StringVar(&storeUntil, "runs-until", "", "aggregate: only runs stored on or before `date` (YYYY-MM-DD)")
+	flag.StringVar(&tempDir, "temp-dir", os.TempDir(), "create the private workspace for temporary runs under `dir`")
+	flag.Int64Var(&maxTempBytes, "max-temp-bytes", 0, "fail the run before its temporary runs exceed `bytes` in the workspace, compressing spills past half of it (0: no limit)")
+	flag.BoolVar(&keepTemp, "keep-temp", false, "keep the workspace with the remaining runs and the merge manifest (merge.jsonl) when the run ends, for debugging")
+	flag.DurationVar(&cleanTTL, "ttl", 24*time.Hour, "clean-temp: only remove orphaned workspaces idle for longer than `duration`")
+	flag.BoolVar(&cleanDryRun, "dry-run", false, "clean-temp: list what would be removed without removing it")
+	flag.IntVar(&simRuns, "runs", 5000, "simulate: number of sorted runs to merge")
+	flag.IntVar(&simFanIn, "fanin", 128, "simulate: runs merged per batch (a real run merges max_words_in_memory at a time)")
+	flag.Int64Var(&simRunBytes, "run-bytes", 64<<20, "simulate: size of each run in `bytes`")
+	flag.BoolVar(&strict, "strict", false, "fail on any data problem (invalid UTF-8, malformed lines, skipped files, count overflow) instead of warning")
+	flag.Int64Var(&exportMinCount, "min-count", 1, "export: only words counted at least `n` times")
+	flag.IntVar(&exportMaxRank, "max-rank", 0, "export: only the `n` most frequent words, plus words tied with the last (0: no limit)")
+	flag.StringVar(&exportBuckets, "buckets", "pow2", "export: round counts down to a `bucketing`: pow2 or none")
+	flag.Float64Var(&stopCoverage, "coverage", 0.4, "stopwords: list the most frequent words until they cover this `fraction` of all tokens")
+	flag.IntVar(&stopMinLen, "stop-min-len", 1, "stopwords: only words of at least `n` characters")
+	flag.IntVar(&stopMaxLen, "stop-max-len", 0, "stopwords: only words of at most `n` characters (0: no limit)")
+	flag.StringVar(&stopClass, "stop-class", "letters", "stopwords: only words made of `class` characters: letters (and apostrophes), alnum or any")
+	flag.IntVar(&variantDistance, "variant-distance", 1, "variants: report words within `n` edits (insertions, deletions, substitutions, transpositions) of a canonical form")
+	flag.Int64Var(&variantMaxCount, "variant-max-count", 5, "variants: only words counted at most `n` times can be variants")
+	flag.Float64Var(&variantRatio, "variant-ratio", 10, "variants: the canonical form must be counted at least `ratio` times more often than the variant")
+	flag.IntVar(&variantWindow, "variant-window", 100, "variants: compare each word with the `n` words before it in key order")
+	flag.StringVar(&checkAgainst, "against", "naive", "check: `reference` the counting pipeline is compared with: naive (an unbounded in-memory count)")
+	flag.IntVar(&limitTokens, "limit-tokens", 0, "stop reading input after `n` tokens (0: no limit)")
+	flag.Int64Var(&limitBytes, "limit-bytes", 0, "stop reading input after `n` bytes, at the end of the line that reaches it (0: no limit)")
+	flag.DurationVar(&inputTimeout, "input-timeout", 0, "fail the run if the input phase takes longer than `duration` (0: no limit)")
+	flag.DurationVar(&mergeTimeout, "merge-timeout", 0, "fail the run if the merge phase takes longer than `duration` (0: no limit)")
+	flag.DurationVar(&stallTimeout, "stall-timeout", 0, "fail the run with goroutine stacks if it makes no progress for `duration`, e.g. on a hung read (0: never)")
+	flag.DurationVar(&deadline, "deadline", 0, "stop reading input after `duration`, merge what was read and mark the result as partial (0: no deadline)")
+	flag.IntVar(&skipLines, "skip-lines", 0, "skip the first `n` lines of the input (after --skip-bytes), e.g. a CSV header")
+	flag.Int64Var(&skipBytes, "skip-bytes", 0, "start reading the input at byte `offset`, e.g. the end_offset of an earlier limited run")
+	flag.StringVar(&matchPattern, "match", "", "only count input lines matching the regular expression `re`")
+	flag.StringVar(&excludePattern, "exclude-match", "", "skip input lines matching the regular expression `re`")
+	flag.StringVar(&recordSeparator, "record-separator", "newline", "split the input into records at `sep`: newline, blank (blank lines), json (top-level objects) or a literal delimiter such as \\x1e; every line of a record is a word")
+	flag.Var(&stripPunct, "strip-punct", "strip punctuation from words: at their edges (--strip-punct), or everywhere (--strip-punct=all)")
+	flag.StringVar(&normalizeForm, "normalize", "none", "bring words into a Unicode normal `form` before counting or merging: none, nfc or nfkc (also folds compatibility forms such as ligatures and full-width letters)")
+	flag.StringVar(&hyphenPolicy, "hyphens", "keep", "`policy` for hyphenated words: keep (state-of-the-art), split (state, of, the, art) or join (stateoftheart)")
+	flag.StringVar(&apostrophePolicy, "apostrophes", "keep", "`policy` for apostrophes: keep (don't), strip (dont) or split-clitics (do, n't; she, 's)")
+	flag.IntVar(&minLen, "min-len", 0, "skip words shorter than `n` characters (0: no limit)")
+	flag.IntVar(&maxLen, "max-len", 0, "skip words longer than `n` characters (0: no limit)")
+	flag.StringVar(&stopwordsFile, "stopwords", "", "skip the words listed in `file`, one per line (e.g. the output of the stopwords command)")
+	flag.StringVar(&stemName, "stem", "none", "reduce every word to its stem with `algorithm` before counting: none or porter (English; stems lowercase ASCII words only, combine with --fold-case)")
+	flag.BoolVar(&foldCase, "fold-case", false, "count words case-insensitively, under their Unicode case folding (The, THE -> the)")
+	flag.StringVar(&countMode, "mode", "words", "what to count: words, chars (every rune) or bytes (every byte, as two hex digits)")
+	flag.StringVar(&splitMode, "split", "lines", "`mode` for finding words in a line: lines (the whole line is a word) or words (every whitespace-separated field is a word)")
+	flag.BoolVar(&stripHTML, "strip-html", false, "remove HTML tags, comments and script/style bodies and decode character references before tokenizing")
+	flag.IntVar(&fieldIndex, "field", 0, "only count the words of field `n` (1-based) of every line, e.g. a column of a CSV file (0: the whole line)")
+	flag.StringVar(&fieldSep, "field-sep", "\\t", "`separator` of the fields for --field, with Go escapes such as \\t; fields in double quotes may contain it")
+	flag.StringVar(&logFormat, "log-format", "", "parse every line as a log entry and only count the words of its message (the request for common and combined): common, combined, syslog or logfmt")
+	flag.StringVar(&logBucket, "log-bucket", "", "with --log-format, key every word by the `period` of its line's time (minute, hour or day, in UTC) as <period><key-sep><word>")
+	flag.StringVar(&logFieldName, "log-field", "", "count the whole value of the --log-format field `name` (e.g. path, status, host or a logfmt key) instead of the words of the message")
+	flag.StringVar(&jsonFieldPath, "json-field", "", "parse every line as JSON and only count the words of the string at `path`, e.g. message or request.headers.0")
+	flag.BoolVar(&csvInput, "csv", false, "read the input as CSV with a header row and only count the words of the --column fields; quoted fields may span lines")
+	flag.StringVar(&csvColumns, "column", "", "comma-separated header `names` of the CSV columns counted with --csv, joined with a space")
+	flag.BoolVar(&jsonLines, "jsonl", false, "parse every line as JSON and only count the words of the --text-fields strings")
+	flag.StringVar(&textFields, "text-fields", "", "comma-separated `paths` of the JSON strings counted with --jsonl, joined with a space, e.g. title,body")
+	flag.StringVar(&tokenizerName, "tokenizer", "none", "segmentation `backend` for text without spaces: none or cjk (Chinese and Japanese runs are split into dictionary words or bigrams)")
+	flag.StringVar(&cjkDictFile, "cjk-dict", "", "`file` of known words, one per line, preferred by --tokenizer=cjk over bigrams")
+	flag.StringVar(&tokenPattern, "token-regex", "", "count every match of the regular expression `re` in a line as a word, e.g. '[A-Za-z0-9_]+' or '#\\w+'")
+	flag.BoolVar(&uniquePerRecord, "unique-per-record", false, "count each word at most once per record (a line unless --record-separator is set)")
+	flag.StringVar(&onReadError, "on-read-error", "fail", "`policy` for input read errors: fail, retry (reopen at the same offset, 3 attempts) or warn (keep what was read)")
+	flag.BoolVar(&repair, "repair", false, "merge: salvage damaged runs by skipping malformed lines, re-sorting out-of-order records and dropping corrupt tails")
+}
 
-	inputFile := os.Args[2]
-	outputFile := "output.tsv"
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: wordcount [options] <max_words_in_memory> [<input_file>... | -]")
+	fmt.Fprintln(os.Stderr, "       wordcount merge [options] <max_words_in_memory> <sorted_run>...")
+	fmt.Fprintln(os.Stderr, "       wordcount aggregate [options] <max_words_in_memory> <run_store_dir>")
+	fmt.Fprintln(os.Stderr, "       wordcount verify [options] <run>...")
+	fmt.Fprintln(os.Stderr, "       wordcount export [options] <result>")
+	fmt.Fprintln(os.Stderr, "       wordcount check [--against naive] [options] <max_words_in_memory> <input_file>...")
+	fmt.Fprintln(os.Stderr, "       wordcount stopwords [--coverage fraction] [options] <result>")
+	fmt.Fprintln(os.Stderr, "       wordcount variants [options] <result>")
+	fmt.Fprintln(os.Stderr, "       wordcount clean-temp [--temp-dir dir] [--ttl duration] [--dry-run]")
+	fmt.Fprintln(os.Stderr, "       wordcount simulate [--runs n] [--fanin n] [--run-bytes bytes]")
+	fmt.Fprintln(os.Stderr, "       wordcount rerun <output>.args.json")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "merge combines already-sorted runs, binary or legacy word<TAB>count files,")
+	fmt.Fprintln(os.Stderr, "through the same k-way merge as the final counting phase. aggregate merges")
+	fmt.Fprintln(os.Stderr, "the runs kept by --run-store, optionally narrowed by name and date. verify")
+	fmt.Fprintln(os.Stderr, "checks that runs are well-formed and sorted (merge --repair salvages those that")
+	fmt.Fprintln(os.Stderr, "are not). check counts small inputs both through the pipeline and naively in")
+	fmt.Fprintln(os.Stderr, "memory, and reports any difference. export prints the frequent words of a")
+	fmt.Fprintln(os.Stderr, "result with bucketed counts for sharing. stopwords lists the frequent words of")
+	fmt.Fprintln(os.Stderr, "a result that cover a share of its tokens; variants reports rare words that")
+	fmt.Fprintln(os.Stderr, "look like typos of frequent ones. clean-temp removes workspaces left behind by")
+	fmt.Fprintln(os.Stderr, "crashed runs. simulate plays the merge plan for hypothetical run counts and")
+	fmt.Fprintln(os.Stderr, "fan-ins without any data. rerun repeats a run with the configuration recorded")
+	fmt.Fprintln(os.Stderr, "in its <output>.args.json; --redis, --clickhouse and --notify-url are not")
+	fmt.Fprintln(os.Stderr, "recorded and come from their environment variables.")
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "Every option can also be set through the environment as "+envPrefix+"<NAME>,")
+	fmt.Fprintln(os.Stderr, "e.g. "+envName("status-file")+"; the positional arguments fall back to")
+	fmt.Fprintln(os.Stderr, envMaxWords+" and "+envInput+".")
+	fmt.Fprintln(os.Stderr)
+	flag.PrintDefaults()
+}
+
+// runCached serves the result from --cache-dir when an identical run was
+// done before, and stores fresh results there otherwise.
+func runCached(mode string, inputs []string, outputFile string) error {
+	if cacheDir == "" || mode == "check" || sinksConfigured() || slices.Contains(inputs, stdinPath) || outputFile == stdoutPath {
+		// Sinks are fed by the final merge, which a cache hit skips,
+		// standard input cannot be hashed without consuming it, and a
+		// result written to standard output cannot be stored.
+		return runMode(mode, inputs, outputFile)
+	}
 
-	tempFiles, err := processInputFile(inputFile)
+	key, err := cacheKey(mode, inputs)
+	if errors.Is(err, errUncacheable) {
+		return runMode(mode, inputs, outputFile)
+	}
 	if err != nil {
-		panic(err)
+		return err
+	}
+	cached := cachePath(key)
+	if _, err := os.Stat(cached); err == nil {
+		stats.cacheHit = true
+		return copyFileAtomic(cached, outputFile)
 	}
 
-	finalFile, err := mergeInBatches(tempFiles)
+	if err := runMode(mode, inputs, outputFile); err != nil {
+		return err
+	}
+	if stats.deadlineHit {
+		// What a deadline cuts off depends on timing; never reuse it.
+		return nil
+	}
+	if err := os.MkdirAll(cacheDir, 0755); err != nil {
+		return err
+	}
+	return copyFileAtomic(outputFile, cached)
+}
+
+func runMode(mode string, inputs []string, outputFile string) error {
+	switch mode {
+	case "merge":
+		if repair {
+			return runRepairMerge(inputs, outputFile)
+		}
+		return runMerge(inputs, outputFile)
+	case "aggregate":
+		return runAggregate(inputs, outputFile)
+	case "check":
+		return runCheck(inputs)
+	}
+	return run(inputs, outputFile)
+}
+
+// run counts the inputs one after the other into a single result; every
+// input gets the same per-file options (--skip-bytes, --skip-lines, ...).
+func run(inputFiles []string, outputFile string) error {
+	size := inputSize(inputFiles)
+	setPhase("input", size)
+
+	var store *incrementalStore
+	if incremental {
+		var err error
+		if store, err = openIncrementalStore(); err != nil {
+			return err
+		}
+	}
+
+	var tempFiles []string
+	for _, inputFile := range inputFiles {
+		keep := false
+		if store != nil {
+			run, ok, eligible, err := store.lookup(inputFile)
+			if err != nil {
+				return err
+			}
+			if ok {
+				tempFiles = append(tempFiles, run)
+				inputDone += inputSize([]string{inputFile})
+				updateProgress(inputDone)
+				continue
+			}
+			keep = eligible
+		}
+
+		runs, err := processInputFile(inputFile)
+		if err != nil {
+			return err
+		}
+		stats.tempRuns += len(runs)
+
+		if runStore != "" || keep {
+			merged, err := mergeInputRuns(runs, inputFile)
+			if err != nil {
+				return err
+			}
+			if keep {
+				if err := store.keep(inputFile, merged); err != nil {
+					return err
+				}
+			}
+			runs = []string{merged}
+			setPhase("input", size)
+			updateProgress(inputDone)
+		}
+		tempFiles = append(tempFiles, runs...)
+		if stats.limited {
+			limitHint(inputFiles, inputFile)
+			break
+		}
+	}
+
+	finalFile, err := reduce(tempFiles, spillFormat, true)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	err = os.Rename(finalFile, outputFile)
+	err = publishOutput(finalFile, outputFile)
 	if err != nil {
-		panic(err)
+		return err
+	}
+	if store != nil {
+		if err := store.save(); err != nil {
+			return err
+		}
 	}
 
 	for _, f := range tempFiles {
-		os.Remove(f)
+		removeTemp(f)
+	}
+	if dfOutput {
+		return writeDocumentFrequencies()
+	}
+	return nil
+}
+
+// limitHint tells how to continue a run that a limit stopped in
+// inputFile. --skip-bytes applies to every input, so it only continues a
+// run of a single input as is; with several, the hint names the input and
+// the offset within it.
+func limitHint(inputFiles []string, inputFile string) {
+	msg := fmt.Sprintf("stopped after %d tokens and %d bytes, in %s", stats.tokens, stats.inputBytes, stats.stoppedIn)
+	switch {
+	case isArchive(inputFile):
+		msg += "; archive members cannot be continued with --skip-bytes"
+	case len(inputFiles) == 1:
+		msg += fmt.Sprintf("; continue it with --skip-bytes %d", stats.endOffset)
+	default:
+		msg += fmt.Sprintf(" at byte %d of it; --skip-bytes applies to every input, so continue with %s alone and --skip-bytes %d, then the inputs after it",
+			stats.endOffset, stats.stoppedIn, stats.endOffset)
+	}
+	fmt.Fprintln(os.Stderr, msg)
+}
+
+// inputSize is the number of bytes the input phase will read, as far as
+// the inputs' sizes are known. Progress counts bytes as stored, before
+// decompression; inputDone holds those of the inputs already read.
+var inputDone int64
+
+func inputSize(inputFiles []string) int64 {
+	var size int64
+	for _, path := range inputFiles {
+		var info os.FileInfo
+		var err error
+		if path == stdinPath {
+			info, err = os.Stdin.Stat()
+		} else {
+			info, err = os.Stat(path)
+		}
+		if err == nil && info.Mode().IsRegular() && (decoderByName(path) != nil || isArchive(path)) {
+			size += info.Size() // skipped by decompressing
+		} else if err == nil && info.Mode().IsRegular() {
+			size += max(info.Size()-skipBytes, 0)
+		}
+	}
+	return size
+}
+
+// runMerge merges externally produced sorted runs into outputFile. The runs
+// belong to the caller, so they are only read, never moved or removed.
+func runMerge(runFiles []string, outputFile string) error {
+	stats.tempRuns = len(runFiles)
+	setPhase("merge", 0)
+
+	finalFile, err := reduce(runFiles, "auto", false)
+	if err != nil {
+		return err
+	}
+	return publishOutput(finalFile, outputFile)
+}
+
+// stdoutPath stands for standard output as --output.
+const stdoutPath = "-"
+
+// publishOutput moves the finished result from the workspace to
+// outputFile, copying it when the workspace is on another file system,
+// or writes it to standard output.
+func publishOutput(finalFile, outputFile string) error {
+	if outputFile == stdoutPath {
+		defer removeTemp(finalFile)
+		f, err := os.Open(finalFile)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(os.Stdout, f)
+		return err
+	}
+	err := os.Rename(finalFile, outputFile)
+	if errors.Is(err, syscall.EXDEV) {
+		if err = copyFileAtomic(finalFile, outputFile); err == nil {
+			removeTemp(finalFile)
+		}
 	}
+	return err
 }
 
 // ------------------- Input Phase -------------------
 
 func processInputFile(filePath string) ([]string, error) {
-	file, err := os.Open(filePath)
+	if isArchive(filePath) {
+		return processArchive(filePath)
+	}
+	content, file, err := openContent(filePath, skipBytes)
 	if err != nil {
 		return nil, err
 	}
 	defer file.Close()
+	defer content.Close()
+	start := file.pos
+	defer func() { inputDone += file.pos - start }()
+
+	return countContent(inputName(filePath), content, func() int64 { return inputDone + file.pos - start })
+}
+
+// countContent counts the records of one input, positioned at --skip-bytes,
+// into spilled runs. progress reports how far the input phase has read.
+func countContent(name string, content io.Reader, progress func() int64) ([]string, error) {
+	if stripHTML {
+		content = newHTMLStripper(content)
+	}
+	reader := bufio.NewReader(content)
+	offset := skipBytes
+	lineNo := 0
+	for ; lineNo < skipLines; lineNo++ {
+		n, err := skipLine(reader)
+		offset += n
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, inputError(err, name, offset)
+		}
+	}
+	stats.startOffset = offset
+	stats.endOffset = offset
+	bytesBefore := stats.inputBytes
+
+	// offset and newlines follow the scanner through the file, so reported
+	// offsets and line numbers are exact whatever the record separator.
+	newlines := lineNo
+	scanner := bufio.NewScanner(reader)
+	scanner.Split(func(data []byte, atEOF bool) (int, []byte, error) {
+		advance, token, err := splitRecords(data, atEOF)
+		offset += int64(advance)
+		newlines += bytes.Count(data[:advance], []byte{'\n'})
+		return advance, token, err
+	})
 
-	wordCount := make(map[string]int)
+	wordCount := make(map[string]tally)
 	var tempFiles []string
-	scanner := bufio.NewScanner(file)
+	unit := unitTally()
+	seen := make(map[string]bool)
+	var logFields []logField
+	var lineBucket string // --log-bucket of the current line
+	var csvIndices []int  // of the --column fields, from the CSV header
+
+	flush := func() error {
+		if len(wordCount) == 0 {
+			return nil
+		}
+		tmp, err := flushToTempFile(wordCount)
+		if err != nil {
+			return err
+		}
+		tempFiles = append(tempFiles, tmp)
+		wordCount = make(map[string]tally)
+		return nil
+	}
+
+	// The document frequency pipeline of --outputs df: every word once per
+	// record, into its own map and runs.
+	dfCount := make(map[string]tally)
+	dfSeen := make(map[string]bool)
+	flushDF := func() error {
+		if len(dfCount) == 0 {
+			return nil
+		}
+		tmp, err := flushToTempFile(dfCount)
+		if err != nil {
+			return err
+		}
+		dfRuns = append(dfRuns, tmp)
+		dfCount = make(map[string]tally)
+		return nil
+	}
+
+	countWord := func(word string, weight tally, lineNo int) error {
+		if !wordSelected(word) {
+			return nil
+		}
+		if lineBucket != "" {
+			word = lineBucket + keySep + word
+		}
+		if uniquePerRecord {
+			if seen[word] {
+				return nil
+			}
+			seen[word] = true
+		}
+		if !utf8.ValidString(word) {
+			if err := warn(lineLoc(name, lineNo), "invalid UTF-8 in %q", word); err != nil {
+				return err
+			}
+		}
+		if combineInto(wordCount, word, weight) {
+			if err := overflowWarning(lineLoc(name, lineNo), word); err != nil {
+				return err
+			}
+		}
+		stats.tokens++
+		if dfOutput && !dfSeen[word] {
+			dfSeen[word] = true
+			combineInto(dfCount, word, unit)
+			if len(dfCount) >= MAX_WORDS_IN_MEMORY {
+				if err := flushDF(); err != nil {
+					return err
+				}
+			}
+		}
+		if len(wordCount) >= MAX_WORDS_IN_MEMORY {
+			return flush()
+		}
+		return nil
+	}
+
+	// The weight and number of the line being split, for countLineWord.
+	var splitter wordSplitter
+	var lineWeight tally
+	var lineNum int
+	countLineWord := func(word string) error {
+		return countWord(word, lineWeight, lineNum)
+	}
+
+	countLine := func(line string, lineNo int) error {
+		weight := unit
+		if weighted {
+			var err error
+			line, weight, err = parseLine(strings.TrimSuffix(line, "\r"))
+			if err != nil {
+				return warn(lineLoc(name, lineNo), "malformed line: %v", err)
+			}
+		}
+		if fieldIndex > 0 {
+			var ok bool
+			if line, ok = extractField(strings.TrimSuffix(line, "\r")); !ok {
+				return warn(lineLoc(name, lineNo), "no field %d", fieldIndex)
+			}
+		}
+		if logParser != nil {
+			var err error
+			if logFields, line, lineBucket, err = logLine(logFields, line); err != nil {
+				return warn(lineLoc(name, lineNo), "malformed line: %v", err)
+			}
+			if logFieldName != "" {
+				if line == "" {
+					return nil
+				}
+				lineWeight, lineNum = weight, lineNo
+				return splitter.token(line, countLineWord)
+			}
+		}
+		if jsonPaths != nil {
+			value, ok, err := extractJSONFields(line)
+			if err != nil {
+				return warn(lineLoc(name, lineNo), "malformed line: %v", err)
+			}
+			if !ok {
+				return nil
+			}
+			line = value
+		}
+		lineWeight, lineNum = weight, lineNo
+		return splitter.line(line, countLineWord)
+	}
 
+	ingesting.Store(true)
+	defer ingesting.Store(false)
+
+	nextLine := lineNo + 1
 	for scanner.Scan() {
-		word := strings.TrimSpace(scanner.Text())
-		if word == "" {
+		if budgetSpent() {
+			break
+		}
+		if err := pausePoint(flush); err != nil {
+			return nil, err
+		}
+		lineNo, nextLine = nextLine, newlines+1
+		stats.endOffset = offset
+		stats.inputBytes = bytesBefore + offset - stats.startOffset
+		updateProgress(progress())
+		if countMode != "words" {
+			if err := countWord(symbolKey(scanner.Bytes()), unit, lineNo); err != nil {
+				return nil, err
+			}
 			continue
 		}
-		wordCount[word]++
-		if len(wordCount) >= MAX_WORDS_IN_MEMORY {
-			tmp, err := flushToTempFile(wordCount)
+		record := strings.TrimSuffix(scanner.Text(), "\n")
+		if csvInput {
+			if record == "" {
+				continue
+			}
+			if csvIndices == nil {
+				var err error
+				if csvIndices, err = csvHeader(record); err != nil {
+					return nil, fmt.Errorf("%s: %v", name, err)
+				}
+				continue
+			}
+		}
+		if !lineSelected(record) {
+			continue
+		}
+		if csvIndices != nil {
+			text, err := csvText(record, csvIndices)
 			if err != nil {
+				if err := warn(lineLoc(name, lineNo), "malformed record: %v", err); err != nil {
+					return nil, err
+				}
+				continue
+			}
+			record = text
+		}
+		clear(seen)
+		clear(dfSeen)
+		for rest := record; ; lineNo++ {
+			line, more, found := strings.Cut(rest, "\n")
+			if err := countLine(line, lineNo); err != nil {
 				return nil, err
 			}
-			tempFiles = append(tempFiles, tmp)
-			wordCount = make(map[string]int)
+			if !found {
+				break
+			}
+			rest = more
 		}
 	}
-
-	if len(wordCount) > 0 {
-		tmp, err := flushToTempFile(wordCount)
-		if err != nil {
+	if err := scanner.Err(); err != nil {
+		if err := inputError(err, name, stats.endOffset); err != nil {
 			return nil, err
 		}
-		tempFiles = append(tempFiles, tmp)
+	}
+
+	if err := flush(); err != nil {
+		return nil, err
+	}
+	if err := flushDF(); err != nil {
+		return nil, err
+	}
+	if stats.limited {
+		stats.stoppedIn = name
 	}
 	return tempFiles, nil
 }
 
-func flushToTempFile(wordCount map[string]int) (string, error) {
-	tmpFile, err := os.CreateTemp("", "wordcount_*.tmp")
+// wordSplitter splits the text of a line into words: tokens as delimited
+// by --token-regex, --tokenizer or --split, each normalized into the
+// words counted. The WebAssembly build uses it too, so both tokenize
+// alike.
+type wordSplitter struct {
+	words, segments []string
+}
+
+// line calls fn with every word of line.
+func (s *wordSplitter) line(line string, fn func(word string) error) error {
+	var tokens []string
+	switch {
+	case tokenRegex != nil:
+		tokens = tokenRegex.FindAllString(line, -1)
+	case tokenizer != nil:
+		s.segments = tokenizer(s.segments[:0], line)
+		tokens = s.segments
+	case splitMode == "words":
+		tokens = strings.Fields(line)
+	default:
+		word := strings.TrimSpace(line)
+		if word == "" {
+			return nil
+		}
+		return s.token(word, fn)
+	}
+	for _, token := range tokens {
+		if err := s.token(token, fn); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// token calls fn with every word token normalizes into.
+func (s *wordSplitter) token(token string, fn func(word string) error) error {
+	s.words = normalizeWords(s.words[:0], token)
+	for _, word := range s.words {
+		if err := fn(word); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skipLine consumes one line of r, however long, and returns its length.
+func skipLine(r *bufio.Reader) (int64, error) {
+	var n int64
+	for {
+		chunk, err := r.ReadSlice('\n')
+		n += int64(len(chunk))
+		if err != bufio.ErrBufferFull {
+			return n, err
+		}
+	}
+}
+
+// budgetSpent reports whether --limit-tokens, --limit-bytes or --deadline
+// has been reached while input remains, recording it in stats so the result is
+// marked as partial.
+func budgetSpent() bool {
+	stats.deadlineHit = deadlineReached.Load()
+	stats.limited = limitTokens > 0 && stats.tokens >= limitTokens ||
+		limitBytes > 0 && stats.inputBytes >= limitBytes || stats.deadlineHit
+	return stats.limited
+}
+
+func flushToTempFile(wordCount map[string]tally) (string, error) {
+	tmpFile, err := os.CreateTemp(workspace, "wordcount_*.tmp")
 	if err != nil {
 		return "", err
 	}
 	defer tmpFile.Close()
 
-	words := make([]string, 0, len(wordCount))
-	for word := range wordCount {
-		words = append(words, word)
+	start := time.Now()
+	writer, err := newRecordWriter(quotaWriter{tmpFile}, spillFormat)
+	if err != nil {
+		return "", err
 	}
-	sort.Strings(words)
-
-	writer := bufio.NewWriter(tmpFile)
-	for _, word := range words {
-		fmt.Fprintf(writer, "%s\t%d\n", word, wordCount[word])
+	if err := flushBufferToWriter(wordCount, writer); err != nil {
+		return "", err
+	}
+	if err := writer.Close(); err != nil {
+		return "", err
+	}
+	if autoCodec {
+		recordSpillCost(writer.(*runWriter).w.Header().Codec, len(wordCount), time.Since(start))
 	}
-	writer.Flush()
 	return tmpFile.Name(), nil
 }
 
 // ------------------- K-Way Merge with Batching -------------------
 
-func mergeInBatches(files []string) (string, error) {
-	for len(files) > 1 {
+// reduce merges sorted runs in inputFormat into a single file in
+// outputFormat. With --rekey or --collapse-prefix the runs are first
+// merged into one spill run whose re-keyed records go through another
+// spill/merge pass, since new keys are no longer sorted. With --sort=count the result is sorted by
+// count in a last external pass.
+func reduce(files []string, inputFormat string, owned bool) (string, error) {
+	if len(rekeyRules) > 0 || len(collapsePrefixes) > 0 {
+		merged, err := mergeInBatches(files, inputFormat, owned, spillFormat)
+		if err != nil {
+			return "", err
+		}
+		files, err = rekeyRun(merged)
+		removeTemp(merged)
+		if err != nil {
+			return "", err
+		}
+		inputFormat, owned = spillFormat, true
+	}
+	if columnsNeedTotal() {
+		merged, err := mergeInBatches(files, inputFormat, owned, spillFormat)
+		if err != nil {
+			return "", err
+		}
+		if resultTotal, err = sumRun(merged); err != nil {
+			removeTemp(merged)
+			return "", err
+		}
+		files, inputFormat, owned = []string{merged}, spillFormat, true
+	}
+	if sortByCount() {
+		merged, err := mergeInBatches(files, inputFormat, owned, spillFormat)
+		if err != nil {
+			return "", err
+		}
+		return sortRunByCount(merged)
+	}
+	return mergeInBatches(files, inputFormat, owned, outputFormat)
+}
+
+// mergeInBatches merges sorted runs in rounds of at most MAX_WORDS_IN_MEMORY
+// files until one final batch is left, which is merged into format.
+// When owned is false the initial files belong to the caller and are never
+// removed.
+func mergeInBatches(files []string, inputFormat string, owned bool, format string) (string, error) {
+	// A batch needs at least two files for the rounds to make progress.
+	fanIn := max(MAX_WORDS_IN_MEMORY, 2)
+
+	for len(files) > fanIn {
 		var nextRoundFiles []string
+		stats.mergeRounds++
+		batches := (len(files) + fanIn - 1) / fanIn
+		setPhase("merge", int64(batches))
 
-		for i := 0; i < len(files); i += MAX_WORDS_IN_MEMORY {
-			end := i + MAX_WORDS_IN_MEMORY
+		for i := 0; i < len(files); i += fanIn {
+			end := i + fanIn
 			if end > len(files) {
 				end = len(files)
 			}
 			batch := files[i:end]
-			merged, err := mergeBatch(batch)
+			merged, err := loggedMergeBatch(i/fanIn, batch, inputFormat, spillFormat)
 			if err != nil {
 				return "", err
 			}
 			nextRoundFiles = append(nextRoundFiles, merged)
+			updateProgress(int64(len(nextRoundFiles)))
 
-			for _, f := range batch {
-				os.Remove(f)
+			if owned {
+				for _, f := range batch {
+					removeTemp(f)
+				}
 			}
 		}
 		files = nextRoundFiles
+		owned = true
+		inputFormat = spillFormat
 	}
 
-	return files[0], nil
+	stats.mergeRounds++
+	setPhase("merge", 1)
+	final, err := loggedMergeBatch(0, files, inputFormat, format)
+	if err != nil {
+		return "", err
+	}
+	if owned {
+		for _, f := range files {
+			removeTemp(f)
+		}
+	}
+	return final, nil
 }
 
-func mergeBatch(tempFiles []string) (string, error) {
-	readers := make([]*bufio.Scanner, len(tempFiles))
+func mergeBatch(tempFiles []string, inputFormat, format string) (string, error) {
+	readers := make([]recordReader, len(tempFiles))
 	files := make([]*os.File, len(tempFiles))
 	defer func() {
 		for _, f := range files {
@@ -156,44 +1394,76 @@ func mergeBatch(tempFiles []string) (string, error) {
 			return "", err
 		}
 		files[i] = f
-		scanner := bufio.NewScanner(f)
-		readers[i] = scanner
+		reader, err := newRecordReader(f, inputFormat, tempFile)
+		if err != nil {
+			return "", fmt.Errorf("%s: %w", tempFile, err)
+		}
+		readers[i] = reader
 
-		if scanner.Scan() {
-			word, count := parseLine(scanner.Text())
+		word, count, err := reader.Next()
+		if err == nil {
 			heap.Push(h, &fileEntry{word, count, i})
+		} else if err != io.EOF {
+			return "", inFile(tempFile, err)
 		}
 	}
 
-	tmpOutFile, err := os.CreateTemp("", "merged_*.tmp")
+	tmpOutFile, err := os.CreateTemp(workspace, "merged_*.tmp")
 	if err != nil {
 		return "", err
 	}
-	writer := bufio.NewWriter(tmpOutFile)
+	defer tmpOutFile.Close()
+	writer, err := newRecordWriter(quotaWriter{tmpOutFile}, format)
+	if err != nil {
+		return "", err
+	}
+	if format != spillFormat && topWords > 0 {
+		writer = newTopWriter(writer)
+	}
+	if format != spillFormat {
+		if writer, err = withSinks(writer); err != nil {
+			return "", err
+		}
+	}
+	done := false
 	defer func() {
-		writer.Flush()
-		tmpOutFile.Close()
+		if !done {
+			abortWriter(writer)
+		}
 	}()
 
-	wordBuffer := make(map[string]int)
+	wordBuffer := make(map[string]tally)
 
-	for h.Len() > 0 {
+	for records := 1; h.Len() > 0; records++ {
 		entry := heap.Pop(h).(*fileEntry)
+		if records%(1<<16) == 0 {
+			heartbeat()
+		}
 
 		if _, ok := wordBuffer[entry.word]; !ok && len(wordBuffer) >= MAX_WORDS_IN_MEMORY {
 			if err := flushBufferToWriter(wordBuffer, writer); err != nil {
 				return "", err
 			}
-			wordBuffer = make(map[string]int)
+			wordBuffer = make(map[string]tally)
 		}
 
-		wordBuffer[entry.word] += entry.count
+		if combineInto(wordBuffer, entry.word, entry.count) {
+			if err := overflowWarning("merging "+tempFiles[entry.fileIdx], entry.word); err != nil {
+				return "", err
+			}
+		}
 
-		scanner := readers[entry.fileIdx]
-		if scanner.Scan() {
-			word, count := parseLine(scanner.Text())
-			heap.Push(h, &fileEntry{word, count, entry.fileIdx})
+		word, count, err := readers[entry.fileIdx].Next()
+		if err == io.EOF {
+			continue
 		}
+		if err != nil {
+			return "", inFile(tempFiles[entry.fileIdx], err)
+		}
+		if keyLess(word, entry.word) {
+			return "", fmt.Errorf("%s is not sorted: %q follows %q", tempFiles[entry.fileIdx], word, entry.word)
+		}
+		heap.Push(h, &fileEntry{word, count, entry.fileIdx})
 	}
 
 	if len(wordBuffer) > 0 {
@@ -202,21 +1472,22 @@ func mergeBatch(tempFiles []string) (string, error) {
 		}
 	}
 
-	return tmpOutFile.Name(), nil
+	done = true
+	return tmpOutFile.Name(), writer.Close()
 }
 
 // ------------------- Utility -------------------
 
 type fileEntry struct {
 	word    string
-	count   int
+	count   tally
 	fileIdx int
 }
 
 type fileEntryHeap []*fileEntry
 
 func (h fileEntryHeap) Len() int           { return len(h) }
-func (h fileEntryHeap) Less(i, j int) bool { return h[i].word < h[j].word }
+func (h fileEntryHeap) Less(i, j int) bool { return keyLess(h[i].word, h[j].word) }
 func (h fileEntryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
 
 func (h *fileEntryHeap) Push(x interface{}) {
@@ -231,27 +1502,17 @@ func (h *fileEntryHeap) Pop() interface{} {
 	return item
 }
 
-func parseLine(line string) (string, int) {
-	parts := strings.SplitN(line, "\t", 2)
-	if len(parts) != 2 {
-		return "", 0
-	}
-	count, _ := strconv.Atoi(parts[1])
-	return parts[0], count
-}
-
-func flushBufferToWriter(buffer map[string]int, writer *bufio.Writer) error {
+func flushBufferToWriter(buffer map[string]tally, writer recordWriter) error {
 	words := make([]string, 0, len(buffer))
 	for word := range buffer {
 		words = append(words, word)
 	}
-	sort.Strings(words)
+	sort.Slice(words, func(i, j int) bool { return keyLess(words[i], words[j]) })
 
 	for _, word := range words {
-		_, err := fmt.Fprintf(writer, "%s\t%d\n", word, buffer[word])
-		if err != nil {
+		if err := writer.Write(word, buffer[word]); err != nil {
 			return err
 		}
 	}
-	return writer.Flush()
+	return nil
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ------------------- Merge Manifest -------------------
+
+// Every merge batch is logged to merge.jsonl in the workspace, one line
+// when it starts and one when it ends, synced to disk each time, so the
+// manifest survives crashes. With --keep-temp the workspace, manifest and
+// remaining runs are left behind for post-mortem debugging.
+var keepTemp bool
+
+const mergeManifest = "merge.jsonl"
+
+type manifestRun struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+}
+
+type manifestEntry struct {
+	Event      string        `json:"event"` // start, done or failed
+	Round      int           `json:"round"`
+	Batch      int           `json:"batch"`
+	Time       time.Time     `json:"time"`
+	Format     string        `json:"format"`
+	Inputs     []manifestRun `json:"inputs,omitempty"`
+	Output     *manifestRun  `json:"output,omitempty"`
+	DurationMS int64         `json:"duration_ms,omitempty"`
+	Error      string        `json:"error,omitempty"`
+}
+
+// loggedMergeBatch runs mergeBatch, recording it in the manifest.
+func loggedMergeBatch(batch int, files []string, inputFormat, format string) (string, error) {
+	start := time.Now()
+	entry := manifestEntry{Event: "start", Round: stats.mergeRounds, Batch: batch, Time: start, Format: format}
+	for _, f := range files {
+		entry.Inputs = append(entry.Inputs, manifestRun{f, fileSize(f)})
+	}
+	logManifest(entry)
+
+	merged, err := mergeBatch(files, inputFormat, format)
+	entry.Event, entry.Time, entry.Inputs = "done", time.Now(), nil
+	entry.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		entry.Event, entry.Error = "failed", err.Error()
+	} else {
+		entry.Output = &manifestRun{merged, fileSize(merged)}
+	}
+	logManifest(entry)
+	return merged, err
+}
+
+// logManifest appends an entry to the manifest. The manifest only helps
+// debugging, so failing to write it does not fail the run.
+func logManifest(entry manifestEntry) {
+	f, err := os.OpenFile(filepath.Join(workspace, mergeManifest), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	if err := json.NewEncoder(f).Encode(entry); err == nil {
+		f.Sync()
+	}
+}
+
+func fileSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return -1
+	}
+	return info.Size()
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+// ------------------- Word Normalization -------------------
+
+// normalizeWords appends to dst the words a token is counted as, before
+// they reach the in-memory map, so spilled runs are already normalized and
+// merge like any others:
+//
+//   - --strip-punct removes punctuation, at the edges of the token ("word,"
+//     and "(word)" are "word") or everywhere with --strip-punct=all;
+//   - --hyphens and --apostrophes may split the token into several words
+//     or join its parts;
+//   - --fold-case applies full Unicode case folding to every word: "The",
+//     "THE" and "the" are one word, as are "Straße" and "STRASSE";
+//   - --normalize brings it into a Unicode normal form, so that composed
+//     and decomposed spellings of "é" are one word;
+//   - --stem reduces it to its stem, so "running" and "runs" are "run".
+//
+// Empty words are dropped, and so are words outside --min-len and --max-len
+// (see lengthSelected).
+var (
+	minLen int
+	maxLen int
+
+	foldCase         bool
+	stripPunct       punctFlag
+	normalizeForm    string
+	hyphenPolicy     string
+	apostrophePolicy string
+	stemName         string
+
+	unicodeForm func(string) string
+	stemmer     func(string) string
+)
+
+// unicodeForms are the normal forms selectable with --normalize.
+var unicodeForms = map[string]func(string) string{
+	"none": nil,
+	"nfc":  norm.NFC.String,
+	"nfkc": norm.NFKC.String,
+}
+
+// stemmers are the stemming algorithms selectable with --stem. A stemmer
+// sees words after case folding and normalization.
+var stemmers = map[string]func(string) string{
+	"none":   nil,
+	"porter": porterStem,
+}
+
+// Policies selectable with --hyphens and --apostrophes.
+var (
+	hyphenPolicies     = []string{"keep", "split", "join"}
+	apostrophePolicies = []string{"keep", "strip", "split-clitics"}
+)
+
+var folder = cases.Fold()
+
+func normalizeWords(dst []string, token string) []string {
+	token = stripWord(token)
+	if hyphenPolicy == "keep" && apostrophePolicy == "keep" {
+		if word := canonicalWord(token); word != "" {
+			dst = append(dst, word)
+		}
+		return dst
+	}
+
+	parts := []string{token}
+	switch hyphenPolicy {
+	case "split":
+		parts = strings.FieldsFunc(token, isHyphen)
+	case "join":
+		parts[0] = strings.Map(dropRune(isHyphen), token)
+	}
+	for _, part := range parts {
+		switch apostrophePolicy {
+		case "strip":
+			part = strings.Map(dropRune(isApostrophe), part)
+		case "split-clitics":
+			if stem, clitic := splitClitic(part); clitic != "" {
+				if word := canonicalWord(stem); word != "" {
+					dst = append(dst, word)
+				}
+				part = clitic
+			}
+		}
+		if word := canonicalWord(part); word != "" {
+			dst = append(dst, word)
+		}
+	}
+	return dst
+}
+
+// wordSelected reports whether a normalized word is counted: it is not a
+// stopword and its length is selected.
+func wordSelected(word string) bool {
+	return !stopwordSet[word] && lengthSelected(word)
+}
+
+// lengthSelected reports whether a normalized word is within --min-len and
+// --max-len characters.
+func lengthSelected(word string) bool {
+	if minLen == 0 && maxLen == 0 {
+		return true
+	}
+	n := utf8.RuneCountInString(word)
+	return n >= minLen && (maxLen == 0 || n <= maxLen)
+}
+
+func stripWord(word string) string {
+	switch stripPunct {
+	case punctEdges:
+		return strings.TrimFunc(word, unicode.IsPunct)
+	case punctAll:
+		return strings.Map(dropRune(unicode.IsPunct), word)
+	}
+	return word
+}
+
+func canonicalWord(word string) string {
+	if foldCase {
+		word = folder.String(word)
+	}
+	if unicodeForm != nil {
+		word = unicodeForm(word)
+	}
+	if stemmer != nil {
+		word = stemmer(word)
+	}
+	return word
+}
+
+// keysNormalized reports whether normalizeKey changes keys.
+func keysNormalized() bool {
+	return stripPunct != punctNone || foldCase || unicodeForm != nil || stemmer != nil
+}
+
+// normalizeKey brings a key of a merged or aggregated count file into the
+// form a counted word would have with the same --strip-punct, --fold-case,
+// --normalize and --stem options, so files counted with inconsistent
+// preprocessing still combine. Hyphens and apostrophes are kept, since
+// splitting a key would double its count.
+func normalizeKey(key string) string {
+	return canonicalWord(stripWord(key))
+}
+
+func dropRune(drop func(rune) bool) func(rune) rune {
+	return func(r rune) rune {
+		if drop(r) {
+			return -1
+		}
+		return r
+	}
+}
+
+func isHyphen(r rune) bool { return r == '-' || r == '\u2010' || r == '\u2011' }
+
+func isApostrophe(r rune) bool { return r == '\'' || r == '\u2019' }
+
+// clitics are the English contractions split off by
+// --apostrophes=split-clitics, as in the Penn Treebank: "don't" is "do"
+// and "n't", "she's" is "she" and "'s".
+var clitics = []string{"n't", "'s", "'re", "'ve", "'ll", "'d", "'m"}
+
+// splitClitic splits a trailing clitic off word, matching it
+// case-insensitively and with either apostrophe. The clitic keeps its
+// spelling from word.
+func splitClitic(word string) (stem, clitic string) {
+	folded := strings.ToLower(strings.ReplaceAll(word, "\u2019", "'"))
+	for _, c := range clitics {
+		if strings.HasSuffix(folded, c) && len(folded) > len(c) {
+			// Suffixes are ASCII after the replacement; count back in runes
+			// since the typographic apostrophe is longer in word.
+			n := len(word)
+			for range len(c) {
+				_, size := utf8.DecodeLastRuneInString(word[:n])
+				n -= size
+			}
+			return word[:n], word[n:]
+		}
+	}
+	return word, ""
+}
+
+// punctFlag is --strip-punct, which may be given without a value for the
+// edges mode.
+type punctFlag string
+
+const (
+	punctNone  punctFlag = ""
+	punctEdges punctFlag = "edges"
+	punctAll   punctFlag = "all"
+)
+
+func (p *punctFlag) String() string   { return string(*p) }
+func (p *punctFlag) IsBoolFlag() bool { return true }
+
+func (p *punctFlag) Set(v string) error {
+	switch v {
+	case "true", "edges":
+		*p = punctEdges
+	case "all":
+		*p = punctAll
+	case "", "false", "none":
+		*p = punctNone
+	default:
+		return fmt.Errorf("want edges or all")
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+)
+
+// ------------------- Completion Webhook -------------------
+
+type jobReport struct {
+	JobID      string    `json:"job_id"`
+	Status     string    `json:"status"`
+	Error      string    `json:"error,omitempty"`
+	Output     string    `json:"output,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Stats      jobStats  `json:"stats"`
+}
+
+type jobStats struct {
+	Tokens      int            `json:"tokens"`
+	InputBytes  int64          `json:"input_bytes"`
+	TempRuns    int            `json:"temp_runs"`
+	MergeRounds int            `json:"merge_rounds"`
+	CacheHit    bool           `json:"cache_hit,omitempty"`
+	Warnings    int            `json:"warnings"`
+	Repaired    int            `json:"repaired_runs,omitempty"`
+	Reused      int            `json:"reused_runs,omitempty"`
+	Limited     bool           `json:"limited,omitempty"`
+	StartOffset int64          `json:"start_offset,omitempty"`
+	EndOffset   int64          `json:"end_offset,omitempty"`
+	DurationSec float64        `json:"duration_sec"`
+	SpillCodecs map[string]int `json:"spill_codecs,omitempty"`
+	Corpus      *corpusStats   `json:"corpus,omitempty"`
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func newJobReport(outputFile string, start time.Time, runErr error) jobReport {
+	finished := time.Now()
+	report := jobReport{
+		JobID:      jobID,
+		Status:     "succeeded",
+		StartedAt:  start,
+		FinishedAt: finished,
+		Stats: jobStats{
+			Tokens:      stats.tokens,
+			InputBytes:  stats.inputBytes,
+			TempRuns:    stats.tempRuns,
+			MergeRounds: stats.mergeRounds,
+			CacheHit:    stats.cacheHit,
+			Warnings:    stats.warnings,
+			Repaired:    stats.repairedRuns,
+			Reused:      stats.reusedRuns,
+			Limited:     stats.limited,
+			StartOffset: stats.startOffset,
+			EndOffset:   stats.endOffset,
+			DurationSec: finished.Sub(start).Seconds(),
+			SpillCodecs: stats.spillCodecs,
+			Corpus:      stats.corpus,
+		},
+	}
+	if runErr != nil {
+		report.Status = "failed"
+		report.Error = runErr.Error()
+		return report
+	}
+	if stats.deadlineHit {
+		report.Status = "partial"
+	}
+	if abs, err := filepath.Abs(outputFile); err == nil {
+		report.Output = abs
+	} else {
+		report.Output = outputFile
+	}
+	return report
+}
+
+// Timeouts of the --notify-url request: a run that was killed keeps its
+// scheduler waiting for less.
+const (
+	notifyTimeout      = 30 * time.Second
+	abortNotifyTimeout = 5 * time.Second
+)
+
+func notify(url string, report jobReport, timeout time.Duration) error {
+	body, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"cmp"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ------------------- Object Stores -------------------
+
+// An objectStore serves inputs named <scheme>://<bucket>/<key> over HTTP:
+// it turns such a URL into a (signed) request, which the HTTP input code
+// then streams, resumes and caches like any other URL. Further stores are
+// added by implementing it and registering their scheme in objectStores.
+type objectStore interface {
+	request(method, bucket, key string) (*http.Request, error)
+}
+
+var objectStores = map[string]objectStore{
+	"s3": s3Store{},
+	"gs": gcsStore{},
+}
+
+// newInputRequest builds a request for a URL input.
+func newInputRequest(method, rawURL string) (*http.Request, error) {
+	scheme, rest, _ := strings.Cut(rawURL, "://")
+	store, ok := objectStores[scheme]
+	if !ok {
+		return http.NewRequest(method, rawURL, nil)
+	}
+	bucket, key, _ := strings.Cut(rest, "/")
+	if bucket == "" || key == "" {
+		return nil, fmt.Errorf("invalid object URL %q, expected %s://bucket/key", rawURL, scheme)
+	}
+	return store.request(method, bucket, key)
+}
+
+// s3Store reads Amazon S3 and compatible stores, signing requests with
+// AWS Signature Version 4 when AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY
+// (and AWS_SESSION_TOKEN for temporary credentials) are set. The region
+// comes from AWS_REGION, and AWS_ENDPOINT_URL selects another endpoint,
+// e.g. MinIO, addressed path-style.
+type s3Store struct{}
+
+func (s3Store) request(method, bucket, key string) (*http.Request, error) {
+	region := cmp.Or(os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION"), "us-east-1")
+	objectPath := "/" + awsEscape(key)
+	endpoint := "https://" + bucket + ".s3." + region + ".amazonaws.com"
+	if e := os.Getenv("AWS_ENDPOINT_URL"); e != "" {
+		endpoint = strings.TrimSuffix(e, "/")
+		objectPath = "/" + awsEscape(bucket) + objectPath
+	}
+	req, err := http.NewRequest(method, endpoint+objectPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.URL.RawPath = objectPath
+
+	accessKey, secretKey := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY")
+	if accessKey != "" && secretKey != "" {
+		signV4(req, accessKey, secretKey, os.Getenv("AWS_SESSION_TOKEN"), region, time.Now())
+	}
+	return req, nil
+}
+
+// signV4 signs req for S3 with AWS Signature Version 4. The payload is
+// left unsigned, and only the host and x-amz-* headers are signed, so
+// Range and If-Range can be added afterwards.
+func signV4(req *http.Request, accessKey, secretKey, sessionToken, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", "UNSIGNED-PAYLOAD")
+	if sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		if name = strings.ToLower(name); strings.HasPrefix(name, "x-amz-") {
+			headers[name] = strings.TrimSpace(values[0])
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&canonicalHeaders, "%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		"UNSIGNED-PAYLOAD",
+	}, "\n")
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex(canonicalRequest)
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	for _, part := range []string{region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// awsEscape percent-encodes a key the way Signature Version 4 expects:
+// everything but unreserved characters and the slashes between segments.
+func awsEscape(key string) string {
+	var b strings.Builder
+	for i := range len(key) {
+		c := key[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-._~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// gcsStore reads Google Cloud Storage through its XML API, authorized by
+// the OAuth token in GOOGLE_OAUTH_ACCESS_TOKEN (e.g. from
+// gcloud auth print-access-token) if set. STORAGE_EMULATOR_HOST selects
+// an emulator instead.
+type gcsStore struct{}
+
+func (gcsStore) request(method, bucket, key string) (*http.Request, error) {
+	endpoint := "https://storage.googleapis.com"
+	if e := os.Getenv("STORAGE_EMULATOR_HOST"); e != "" {
+		endpoint = strings.TrimSuffix(e, "/")
+		if !strings.Contains(endpoint, "://") {
+			endpoint = "http://" + endpoint
+		}
+	}
+	req, err := http.NewRequest(method, endpoint+"/"+url.PathEscape(bucket)+"/"+awsEscape(key), nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("GOOGLE_OAUTH_ACCESS_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
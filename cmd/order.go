@@ -0,0 +1,73 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ------------------- Key Order -------------------
+
+// Secondary orderings selectable with --secondary-sort.
+var secondaryOrders = []string{"asc", "desc", "numeric", "numeric-desc"}
+
+// keyLess is the order of keys in runs and in the output. By default it is
+// plain byte-wise order. With --key-sep, keys are composite
+// "primary<SEP>secondary" values: they are ordered by primary key first,
+// so every primary key forms one contiguous group, and by --secondary-sort
+// within the group.
+func keyLess(a, b string) bool {
+	if keySep == "" {
+		return a < b
+	}
+
+	pa, sa, _ := strings.Cut(a, keySep)
+	pb, sb, _ := strings.Cut(b, keySep)
+	if pa != pb {
+		return pa < pb
+	}
+
+	switch secondarySort {
+	case "desc":
+		if sa != sb {
+			return sa > sb
+		}
+	case "numeric", "numeric-desc":
+		if less, ok := numericLess(sa, sb, secondarySort == "numeric-desc"); ok {
+			return less
+		}
+	}
+	if sa != sb {
+		return sa < sb
+	}
+	// Still distinct keys, such as "a" and "a<SEP>": keep the order total.
+	return a < b
+}
+
+// numericLess orders numeric secondary keys before non-numeric ones. It
+// reports ok=false when neither key is a number or both are equal numbers,
+// leaving the tie to byte-wise order. NaN is not a number here: it compares
+// equal to nothing, which would break the ordering sorts and merges rely on.
+func numericLess(a, b string, desc bool) (less, ok bool) {
+	fa, okA := parseNumber(a)
+	fb, okB := parseNumber(b)
+	switch {
+	case !okA && !okB:
+		return false, false
+	case !okA:
+		return false, true
+	case !okB:
+		return true, true
+	case fa == fb:
+		return false, false
+	case desc:
+		return fa > fb, true
+	default:
+		return fa < fb, true
+	}
+}
+
+func parseNumber(s string) (float64, bool) {
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil && !math.IsNaN(f)
+}
@@ -0,0 +1,32 @@
+package main
+
+import "testing"
+
+// TestKeyLessOrder checks that keyLess is a strict total order on distinct
+// keys for every --secondary-sort, including keys without a secondary part
+// and secondaries that do not parse as numbers.
+func TestKeyLessOrder(t *testing.T) {
+	defer func(sep, order string) { keySep, secondarySort = sep, order }(keySep, secondarySort)
+	keySep = "|"
+	keys := []string{"a", "a|", "a|1", "a|1.0", "a|01", "a|-2", "a|NaN", "a|nan", "a|inf", "a|x", "a||", "b", "b|2"}
+	for _, order := range secondaryOrders {
+		secondarySort = order
+		t.Run(order, func(t *testing.T) {
+			for _, a := range keys {
+				if keyLess(a, a) {
+					t.Errorf("keyLess(%q, %q) = true", a, a)
+				}
+				for _, b := range keys {
+					if a != b && keyLess(a, b) == keyLess(b, a) {
+						t.Errorf("%q and %q are not ordered", a, b)
+					}
+					for _, c := range keys {
+						if keyLess(a, b) && keyLess(b, c) && !keyLess(a, c) {
+							t.Errorf("not transitive: %q < %q < %q", a, b, c)
+						}
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ------------------- Output Fan-Out -------------------
+
+// --outputs adds results computed in the same pass over the input, so
+// that a corpus too large to read twice still yields several analyses.
+// They are written next to the output file, named like partitions:
+//
+//   - top:N, the N words with the largest values, largest first
+//     (<output>.top.tsv), kept in a heap fed by the final merge;
+//   - by:length, by:first-letter, by:script, the result split like
+//     --partition-by (by:script gives one file per writing system);
+//   - df, document frequencies: the number of records every word occurs
+//     in (<output>.df.tsv). The token stream is fanned out to a second
+//     aggregation pipeline, with its own in-memory map and spilled runs,
+//     which is merged after the result; it doubles the memory of the
+//     input phase, and needs --agg sum or count.
+var (
+	outputSpecs string
+
+	topOutput        int
+	partitionOutputs []string
+	dfOutput         bool
+
+	dfRuns []string
+)
+
+// parseOutputs reads the comma-separated --outputs list.
+func parseOutputs(specs string) error {
+	for _, spec := range strings.Split(specs, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+		switch name {
+		case "top":
+			n, err := strconv.Atoi(arg)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("top needs a positive number of words, not %q", arg)
+			}
+			topOutput = n
+		case "by":
+			if arg == "" || !slices.Contains(partitionKeys, arg) {
+				return fmt.Errorf("by needs length, first-letter or script, not %q", arg)
+			}
+			partitionOutputs = append(partitionOutputs, arg)
+		case "df":
+			dfOutput = true
+		default:
+			return fmt.Errorf("unknown output %q", spec)
+		}
+	}
+	return nil
+}
+
+// outputPath names an extra output after partitionBase, with ext.
+func outputPath(name, ext string) string {
+	return partitionBase + "." + name + ext
+}
+
+// topSink writes the topOutput best records of the final merge to
+// <output>.top.tsv.
+type topSink struct{ top topRecords }
+
+func (s *topSink) Write(word string, t tally) error {
+	s.top.add(word, t)
+	return nil
+}
+
+func (s *topSink) Close() error {
+	return writeOutputFile(outputPath("top", ".tsv"), func(w io.Writer) error {
+		for _, word := range s.top.sorted() {
+			if _, err := io.WriteString(w, word+"\t"+s.top.values[word].String()+"\n"); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// writeDocumentFrequencies merges the document frequency runs into
+// <output>.df.tsv, word<TAB>records lines sorted like the output.
+func writeDocumentFrequencies() error {
+	if len(dfRuns) == 0 {
+		return writeOutputFile(outputPath("df", ".tsv"), func(io.Writer) error { return nil })
+	}
+	merged, err := mergeInBatches(dfRuns, spillFormat, true, spillFormat)
+	if err != nil {
+		return err
+	}
+	defer removeTemp(merged)
+	f, err := os.Open(merged)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader, err := newRecordReader(f, spillFormat, merged)
+	if err != nil {
+		return err
+	}
+	return writeOutputFile(outputPath("df", ".tsv"), func(w io.Writer) error {
+		for {
+			word, t, err := reader.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(w, "%s\t%s\n", word, t.columnString()); err != nil {
+				return err
+			}
+		}
+	})
+}
+
+// writeOutputFile writes path under a temporary name and renames it into
+// place once write succeeded.
+func writeOutputFile(path string, write func(w io.Writer) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), ".wordcount_out_*.tmp")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
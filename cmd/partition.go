@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ------------------- Output Partitions -------------------
+
+// With --partition-by the final merge also writes every record to the
+// partition of its bucket, <output>.<bucket><ext> next to the output file
+// like every other sidecar (output.tsv gives output.tsv.a.tsv,
+// output.tsv.Latin.tsv, output.tsv.len5.tsv), in the output format. Each partition is sorted like the output. Partitions
+// are written under temporary names and renamed into place when the merge
+// completes.
+var (
+	partitionBy   string
+	partitionBase string // the output file the partitions are named after
+)
+
+var partitionKeys = []string{"", "length", "first-letter", "script"}
+
+const (
+	maxPartitions = 1024 // open files during the final merge
+	maxLenBucket  = 32   // longer words share the len32+ partition
+)
+
+type partitionSink struct {
+	key     string
+	bucket  func(word string) string
+	writers map[string]recordWriter
+	files   map[string]*os.File
+}
+
+func newPartitionSink(key string) *partitionSink {
+	p := &partitionSink{key: key, writers: make(map[string]recordWriter), files: make(map[string]*os.File)}
+	switch key {
+	case "length":
+		p.bucket = lengthBucket
+	case "first-letter":
+		p.bucket = firstLetterBucket
+	case "script":
+		p.bucket = scriptBucket
+	}
+	return p
+}
+
+func (p *partitionSink) Write(word string, t tally) error {
+	bucket := p.bucket(word)
+	w, ok := p.writers[bucket]
+	if !ok {
+		if len(p.writers) == maxPartitions {
+			return fmt.Errorf("partition-by %s: more than %d partitions", p.key, maxPartitions)
+		}
+		f, err := os.CreateTemp(filepath.Dir(partitionBase), ".wordcount_part_*.tmp")
+		if err != nil {
+			return err
+		}
+		p.files[bucket] = f
+		if w, err = newRecordWriter(f, outputFormat); err != nil {
+			return err
+		}
+		p.writers[bucket] = w
+	}
+	return w.Write(word, t)
+}
+
+func (p *partitionSink) Close() error {
+	var first error
+	for bucket, w := range p.writers {
+		f := p.files[bucket]
+		err := w.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			err = os.Rename(f.Name(), partitionPath(bucket))
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// partitionPath names the partition of bucket after partitionBase.
+func partitionPath(bucket string) string {
+	return partitionBase + "." + bucket + filepath.Ext(partitionBase)
+}
+
+func lengthBucket(word string) string {
+	n := utf8.RuneCountInString(word)
+	if n >= maxLenBucket {
+		return "len" + strconv.Itoa(maxLenBucket) + "+"
+	}
+	return "len" + strconv.Itoa(n)
+}
+
+// firstLetterBucket is the lowercased first character of the word when it
+// is a letter or digit, and "other" for anything else (or a character that
+// cannot be part of a file name).
+func firstLetterBucket(word string) string {
+	r, _ := utf8.DecodeRuneInString(word)
+	if !unicode.IsLetter(r) && !unicode.IsDigit(r) {
+		return "other"
+	}
+	return string(unicode.ToLower(r))
+}
+
+// scriptBucket is the Unicode script of the first letter of the word, or
+// Common when it has none.
+func scriptBucket(word string) string {
+	for _, r := range word {
+		if !unicode.IsLetter(r) {
+			continue
+		}
+		if name, ok := scriptOf[r]; ok {
+			return name
+		}
+		for name, table := range unicode.Scripts {
+			if unicode.Is(table, r) {
+				scriptOf[r] = name
+				return name
+			}
+		}
+	}
+	return "Common"
+}
+
+var scriptOf = make(map[rune]string)
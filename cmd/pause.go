@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+// ------------------- Pause and Resume -------------------
+
+// Ctrl-Z (SIGTSTP) pauses a run to yield memory, disk and CPU to other
+// jobs. During the input phase the in-memory counts are spilled first, so
+// a paused run holds no more than its open files; fg or kill -CONT resumes
+// it where it stopped.
+var (
+	ingesting      atomic.Bool
+	pauseRequested atomic.Bool
+)
+
+// pausePoint is called by the input phase between records. If a pause was
+// requested it spills the in-memory counts with flush and pauses.
+func pausePoint(flush func() error) error {
+	if !pauseRequested.Swap(false) {
+		return nil
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "wordcount: paused after %d tokens, in-memory counts spilled\n", stats.tokens)
+	pause()
+	return nil
+}
+
+// pause stops the process until it is continued. The pause is a phase of
+// its own in the status file and for the watchdog, which resumes the
+// interrupted phase with a fresh heartbeat and without the time stopped.
+func pause() {
+	status.Lock()
+	phase := status.phase
+	status.phase = "paused"
+	writeStatus()
+	status.Unlock()
+
+	resume := pauseWatch()
+	suspend()
+	resume()
+
+	status.Lock()
+	if status.phase == "paused" {
+		status.phase = phase
+		writeStatus()
+	}
+	status.Unlock()
+}
@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+// Job control signals do not exist on this platform.
+func watchPause() {}
+
+func suspend() {}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchPause handles SIGTSTP: during the input phase the pause is
+// deferred to the next pausePoint, elsewhere the process stops at once.
+func watchPause() {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTSTP)
+	go func() {
+		for range sigs {
+			if ingesting.Load() {
+				pauseRequested.Store(true)
+			} else {
+				pause()
+			}
+		}
+	}()
+}
+
+// suspend stops the process with SIGSTOP, which unlike SIGTSTP cannot be
+// caught, and returns once it receives SIGCONT.
+func suspend() {
+	cont := make(chan os.Signal, 1)
+	signal.Notify(cont, syscall.SIGCONT)
+	defer signal.Stop(cont)
+	// The stop can take effect after Kill returns; wait for the SIGCONT.
+	if syscall.Kill(os.Getpid(), syscall.SIGSTOP) == nil {
+		<-cont
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import "strings"
+
+// ------------------- Porter Stemmer -------------------
+
+// porterStem reduces an English word to its stem with the algorithm of
+// M.F. Porter, "An algorithm for suffix stripping" (1980): "running" and
+// "runs" become "run", "generalizations" becomes "gener". Only words of
+// lowercase ASCII letters longer than two are stemmed; others are kept.
+func porterStem(word string) string {
+	if len(word) <= 2 || strings.ContainsFunc(word, func(r rune) bool { return r < 'a' || r > 'z' }) {
+		return word
+	}
+	s := &porterWord{b: []byte(word)}
+	s.step1a()
+	s.step1b()
+	s.step1c()
+	s.step2()
+	s.step3()
+	s.step4()
+	s.step5()
+	return string(s.b)
+}
+
+type porterWord struct{ b []byte }
+
+// cons reports whether b[i] is a consonant: not a vowel, and not a y
+// after a consonant.
+func (s *porterWord) cons(i int) bool {
+	switch s.b[i] {
+	case 'a', 'e', 'i', 'o', 'u':
+		return false
+	case 'y':
+		return i == 0 || !s.cons(i-1)
+	}
+	return true
+}
+
+// measure is m in [C](VC)^m[V] for the first n letters.
+func (s *porterWord) measure(n int) int {
+	m, i := 0, 0
+	for i < n && s.cons(i) {
+		i++
+	}
+	for i < n {
+		for i < n && !s.cons(i) {
+			i++
+		}
+		if i == n {
+			break
+		}
+		m++
+		for i < n && s.cons(i) {
+			i++
+		}
+	}
+	return m
+}
+
+// hasVowel reports whether the first n letters contain a vowel (*v*).
+func (s *porterWord) hasVowel(n int) bool {
+	for i := range n {
+		if !s.cons(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// doubleCons reports whether the first n letters end with a double
+// consonant (*d).
+func (s *porterWord) doubleCons(n int) bool {
+	return n >= 2 && s.b[n-1] == s.b[n-2] && s.cons(n-1)
+}
+
+// cvc reports whether the first n letters end consonant-vowel-consonant,
+// the last not w, x or y (*o).
+func (s *porterWord) cvc(n int) bool {
+	if n < 3 || !s.cons(n-1) || s.cons(n-2) || !s.cons(n-3) {
+		return false
+	}
+	c := s.b[n-1]
+	return c != 'w' && c != 'x' && c != 'y'
+}
+
+func (s *porterWord) ends(suffix string) bool {
+	return strings.HasSuffix(string(s.b), suffix)
+}
+
+// stem is the length of the word without suffix.
+func (s *porterWord) stem(suffix string) int { return len(s.b) - len(suffix) }
+
+func (s *porterWord) replace(suffix, with string) {
+	s.b = append(s.b[:s.stem(suffix)], with...)
+}
+
+// rule is a suffix replacement applied when the stem's measure exceeds
+// min.
+type rule struct {
+	suffix, with string
+}
+
+// applyLongest applies the rule with the longest matching suffix if the
+// measure of its stem is above min. Only that rule is considered, even
+// when its condition fails.
+func (s *porterWord) applyLongest(rules []rule, min int, cond func(n int) bool) {
+	best := -1
+	for i, r := range rules {
+		if s.ends(r.suffix) && (best < 0 || len(r.suffix) > len(rules[best].suffix)) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return
+	}
+	r := rules[best]
+	n := s.stem(r.suffix)
+	if s.measure(n) > min && (cond == nil || cond(n)) {
+		s.replace(r.suffix, r.with)
+	}
+}
+
+func (s *porterWord) step1a() {
+	switch {
+	case s.ends("sses"):
+		s.replace("sses", "ss")
+	case s.ends("ies"):
+		s.replace("ies", "i")
+	case s.ends("ss"):
+	case s.ends("s"):
+		s.replace("s", "")
+	}
+}
+
+func (s *porterWord) step1b() {
+	if s.ends("eed") {
+		if s.measure(s.stem("eed")) > 0 {
+			s.replace("eed", "ee")
+		}
+		return
+	}
+	removed := false
+	for _, suffix := range []string{"ed", "ing"} {
+		if s.ends(suffix) && s.hasVowel(s.stem(suffix)) {
+			s.replace(suffix, "")
+			removed = true
+			break
+		}
+	}
+	if !removed {
+		return
+	}
+	n := len(s.b)
+	switch {
+	case s.ends("at"), s.ends("bl"), s.ends("iz"):
+		s.b = append(s.b, 'e')
+	case s.doubleCons(n) && s.b[n-1] != 'l' && s.b[n-1] != 's' && s.b[n-1] != 'z':
+		s.b = s.b[:n-1]
+	case s.measure(n) == 1 && s.cvc(n):
+		s.b = append(s.b, 'e')
+	}
+}
+
+func (s *porterWord) step1c() {
+	if s.ends("y") && s.hasVowel(s.stem("y")) {
+		s.replace("y", "i")
+	}
+}
+
+var porterStep2 = []rule{
+	{"ational", "ate"}, {"tional", "tion"}, {"enci", "ence"}, {"anci", "ance"},
+	{"izer", "ize"}, {"abli", "able"}, {"alli", "al"}, {"entli", "ent"},
+	{"eli", "e"}, {"ousli", "ous"}, {"ization", "ize"}, {"ation", "ate"},
+	{"ator", "ate"}, {"alism", "al"}, {"iveness", "ive"}, {"fulness", "ful"},
+	{"ousness", "ous"}, {"aliti", "al"}, {"iviti", "ive"}, {"biliti", "ble"},
+}
+
+var porterStep3 = []rule{
+	{"icate", "ic"}, {"ative", ""}, {"alize", "al"}, {"iciti", "ic"},
+	{"ical", "ic"}, {"ful", ""}, {"ness", ""},
+}
+
+var porterStep4 = []rule{
+	{"al", ""}, {"ance", ""}, {"ence", ""}, {"er", ""}, {"ic", ""}, {"able", ""},
+	{"ible", ""}, {"ant", ""}, {"ement", ""}, {"ment", ""}, {"ent", ""},
+	{"ion", ""}, {"ou", ""}, {"ism", ""}, {"ate", ""}, {"iti", ""}, {"ous", ""},
+	{"ive", ""}, {"ize", ""},
+}
+
+func (s *porterWord) step2() { s.applyLongest(porterStep2, 0, nil) }
+func (s *porterWord) step3() { s.applyLongest(porterStep3, 0, nil) }
+
+func (s *porterWord) step4() {
+	s.applyLongest(porterStep4, 1, func(n int) bool {
+		// -ion is only removed after s or t.
+		return !s.ends("ion") || n > 0 && (s.b[n-1] == 's' || s.b[n-1] == 't')
+	})
+}
+
+func (s *porterWord) step5() {
+	if s.ends("e") {
+		n := s.stem("e")
+		if m := s.measure(n); m > 1 || m == 1 && !s.cvc(n) {
+			s.b = s.b[:n]
+		}
+	}
+	if n := len(s.b); s.measure(n) > 1 && s.doubleCons(n) && s.b[n-1] == 'l' {
+		s.b = s.b[:n-1]
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Temp Quota -------------------
+
+// With --max-temp-bytes every byte written to the workspace is counted
+// until the file holding it is removed, so the live size of the runs is
+// known at all times. Past half of the quota, spills written without
+// compression switch to flate; a write that would exceed the quota fails
+// the run before the scratch volume fills up for everyone sharing it.
+var (
+	maxTempBytes int64
+
+	tempBytes      atomic.Int64
+	compressSpills atomic.Bool
+)
+
+// quotaWriter counts the bytes written to a file in the workspace.
+type quotaWriter struct{ w io.Writer }
+
+func (q quotaWriter) Write(p []byte) (int, error) {
+	if maxTempBytes == 0 {
+		return q.w.Write(p)
+	}
+	live := tempBytes.Load() + int64(len(p))
+	if live > maxTempBytes {
+		return 0, fmt.Errorf("temporary runs would exceed --max-temp-bytes %d (%s live)", maxTempBytes, byteSize(live-int64(len(p))))
+	}
+	n, err := q.w.Write(p)
+	live = tempBytes.Add(int64(n))
+	if live > maxTempBytes/2 && runCodec == runfile.CodecNone && !compressSpills.Swap(true) {
+		fmt.Fprintf(os.Stderr, "wordcount: temporary runs use %s of --max-temp-bytes, compressing further spills\n", byteSize(live))
+	}
+	return n, err
+}
+
+// spillCodec is the codec of newly written spill runs.
+func spillCodec() runfile.Codec {
+	if compressSpills.Load() {
+		return runfile.CodecFlate
+	}
+	if autoCodec {
+		return chooseCodec()
+	}
+	return runCodec
+}
+
+// removeTemp removes a file of the workspace and releases its quota.
+func removeTemp(path string) {
+	info, err := os.Stat(path)
+	if os.Remove(path) == nil && err == nil {
+		tempBytes.Add(-info.Size())
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// ------------------- Read Errors -------------------
+
+// onReadError decides what a failed read of the input does: fail the run,
+// retry by reopening the file at the same offset, or warn and count what
+// was read before the error.
+var onReadError string
+
+var readErrorPolicies = []string{"fail", "retry", "warn"}
+
+const readRetries = 3
+
+// stdinPath stands for standard input among the input paths.
+const stdinPath = "-"
+
+// inputName is the name of an input in messages and stored runs.
+func inputName(path string) string {
+	if path == stdinPath {
+		return "stdin"
+	}
+	return path
+}
+
+// inputReader reads an input file or standard input, keeping track of its offset so errors
+// can say where they happened and retries can resume at the same byte.
+type inputReader struct {
+	path      string
+	f         io.ReadCloser
+	pos       int64
+	validator string // of a URL input, see openURL
+}
+
+func openInput(path string, offset int64) (*inputReader, error) {
+	r := &inputReader{path: path, pos: offset}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *inputReader) open() error {
+	if r.path == stdinPath {
+		// Standard input cannot seek when it is a pipe; read past the offset.
+		r.f = os.Stdin
+		if _, err := io.CopyN(io.Discard, r.f, r.pos); err != nil && err != io.EOF {
+			return err
+		}
+		return nil
+	}
+	if isURL(r.path) {
+		body, err := r.openURL()
+		if err != nil {
+			return err
+		}
+		r.f = body
+		return nil
+	}
+	f, err := os.Open(r.path)
+	if err != nil {
+		return err
+	}
+	if r.pos > 0 {
+		if _, err := f.Seek(r.pos, io.SeekStart); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	r.f = f
+	return nil
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	n, err := r.f.Read(p)
+	r.pos += int64(n)
+	if err == nil || err == io.EOF {
+		return n, err
+	}
+	if n > 0 {
+		// Hand over what was read; the error comes back on the next call.
+		return n, nil
+	}
+
+	// Standard input cannot be reopened, so its errors are never retried;
+	// URLs always resume after a broken transfer.
+	retry := onReadError == "retry" && r.path != stdinPath || isURL(r.path)
+	for attempt := 1; retry && attempt <= readRetries; attempt++ {
+		fmt.Fprintf(os.Stderr, "wordcount: %s: read error at byte %d: %v; retrying (%d/%d)\n",
+			r.path, r.pos, err, attempt, readRetries)
+		time.Sleep(time.Duration(attempt) * time.Second)
+		r.f.Close()
+		r.f = closedInput{}
+		if err = r.open(); err != nil {
+			continue
+		}
+		n, err = r.f.Read(p)
+		r.pos += int64(n)
+		if err == nil || err == io.EOF || n > 0 {
+			return n, err
+		}
+	}
+	return 0, fmt.Errorf("%s: read error at byte %d: %w", inputName(r.path), r.pos, err)
+}
+
+func (r *inputReader) Close() error { return r.f.Close() }
+
+// closedInput stands in for an input closed by a retry until it is
+// reopened, so a failed reopen never closes the old one twice.
+type closedInput struct{}
+
+func (closedInput) Read([]byte) (int, error) { return 0, os.ErrClosed }
+func (closedInput) Close() error             { return nil }
+
+// inputError turns the error that ended a scan into the error of the input
+// phase, or into a warning with --on-read-error warn, in which case the
+// records read so far are kept.
+func inputError(err error, path string, recordOffset int64) error {
+	if errors.Is(err, bufio.ErrTooLong) {
+		err = fmt.Errorf("%s: record at byte %d is longer than %d bytes", path, recordOffset, bufio.MaxScanTokenSize)
+	}
+	if onReadError != "warn" {
+		return err
+	}
+	return warn("", "%v; keeping the counts read before it", err)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"regexp"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ------------------- Records -------------------
+
+// A record is the unit the input phase filters and deduplicates: a single
+// line by default, or a run of lines delimited by --record-separator. Each
+// non-blank line of a record is one word, or with --split=words each of its
+// whitespace-separated fields, or with --token-regex each match of the
+// regular expression, or with --tokenizer the words it segments.
+var (
+	recordSeparator string
+	uniquePerRecord bool
+	splitMode       string
+	tokenPattern    string
+
+	tokenRegex *regexp.Regexp
+
+	splitRecords bufio.SplitFunc = bufio.ScanLines
+)
+
+var splitModes = []string{"lines", "words"}
+
+// ------------------- Symbol Counting -------------------
+
+// With --mode=chars or --mode=bytes the input is not tokenized at all:
+// every rune or byte, newlines included, is a record counted under its
+// symbolKey, through the same spill and merge pipeline as words.
+var countMode string
+
+var countModes = []string{"words", "chars", "bytes"}
+
+// byteKeys are the keys of --mode=bytes: two hex digits per byte.
+var byteKeys [256]string
+
+func init() {
+	for b := range byteKeys {
+		byteKeys[b] = fmt.Sprintf("%02x", b)
+	}
+}
+
+// symbolKey returns the key a rune or byte is counted under. Runes that
+// would be invisible or break the TSV output, such as spaces, tabs and
+// control characters, are written as U+XXXX.
+func symbolKey(symbol []byte) string {
+	if countMode == "bytes" {
+		return byteKeys[symbol[0]]
+	}
+	r, _ := utf8.DecodeRune(symbol)
+	if unicode.IsGraphic(r) && !unicode.IsSpace(r) {
+		return string(symbol)
+	}
+	return fmt.Sprintf("U+%04X", r)
+}
+
+// parseRecordSeparator selects the record splitter for --record-separator:
+// newline, blank (one or more blank lines), json (top-level JSON objects)
+// or a literal delimiter, in which Go escapes such as \x1e or \0 are
+// interpreted.
+func parseRecordSeparator(sep string) (bufio.SplitFunc, error) {
+	switch sep {
+	case "newline":
+		return bufio.ScanLines, nil
+	case "blank":
+		return splitBlankLines, nil
+	case "json":
+		return splitJSONObjects, nil
+	}
+	delim, err := strconv.Unquote(`"` + sep + `"`)
+	if err != nil || delim == "" {
+		return nil, fmt.Errorf("invalid record-separator: %q", sep)
+	}
+	return splitDelimiter([]byte(delim)), nil
+}
+
+// splitBlankLines splits at blank lines (lines of nothing but whitespace).
+func splitBlankLines(data []byte, atEOF bool) (int, []byte, error) {
+	for i := bytes.IndexByte(data, '\n'); i >= 0; {
+		j := i + 1
+		for j < len(data) && (data[j] == ' ' || data[j] == '\t' || data[j] == '\r') {
+			j++
+		}
+		if j == len(data) {
+			break
+		}
+		if data[j] == '\n' {
+			return j + 1, data[:i], nil
+		}
+		next := bytes.IndexByte(data[j:], '\n')
+		if next < 0 {
+			break
+		}
+		i = j + next
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// splitJSONObjects splits a stream of JSON objects, such as JSON Lines,
+// pretty-printed objects or a top-level array of objects, at the end of
+// each top-level object. Bytes between objects are dropped.
+func splitJSONObjects(data []byte, atEOF bool) (int, []byte, error) {
+	start := bytes.IndexByte(data, '{')
+	if start < 0 {
+		return len(data), nil, nil
+	}
+	depth, inString, escaped := 0, false, false
+	for i := start; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case inString:
+			if escaped {
+				escaped = false
+			} else if c == '\\' {
+				escaped = true
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{':
+			depth++
+		case c == '}':
+			depth--
+			if depth == 0 {
+				return i + 1, data[start : i+1], nil
+			}
+		}
+	}
+	if atEOF {
+		return len(data), data[start:], nil
+	}
+	return start, nil, nil
+}
+
+func splitDelimiter(delim []byte) bufio.SplitFunc {
+	return func(data []byte, atEOF bool) (int, []byte, error) {
+		if i := bytes.Index(data, delim); i >= 0 {
+			return i + len(delim), data[:i], nil
+		}
+		if atEOF && len(data) > 0 {
+			return len(data), data, nil
+		}
+		return 0, nil, nil
+	}
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"container/heap"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ------------------- Redis Sink -------------------
+
+var (
+	redisURL  string
+	redisKey  string
+	redisTopN int
+)
+
+const (
+	redisBatch    = 1000 // hash fields per HSET
+	redisPipeline = 64   // commands sent before their replies are read
+	redisTempTTL  = "86400"
+)
+
+// redisSink loads the result into Redis: every count into the hash
+// <key>:counts and the --redis-top largest into the sorted set <key>:top.
+// Both are built under temporary names, expiring after redisTempTTL
+// seconds in case the run dies, and renamed into place together on Close,
+// so readers never see a half-written result. A failed merge deletes them.
+type redisSink struct {
+	conn    *redisConn
+	counts  string
+	top     string
+	fields  []string
+	records int
+	best    scoreHeap
+}
+
+func openRedisSink() (*redisSink, error) {
+	conn, err := dialRedis(redisURL)
+	if err != nil {
+		return nil, err
+	}
+	suffix := ":tmp-" + jobID
+	s := &redisSink{conn: conn, counts: redisKey + ":counts" + suffix, top: redisKey + ":top" + suffix}
+	if err := conn.do("DEL", s.counts, s.top); err != nil {
+		conn.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *redisSink) Write(word string, t tally) error {
+	value := t.column(0).columnString()
+	s.fields = append(s.fields, word, value)
+	s.records++
+	if len(s.fields) >= 2*redisBatch {
+		if err := s.flushFields(); err != nil {
+			return err
+		}
+	}
+
+	if redisTopN > 0 {
+		score, _ := strconv.ParseFloat(value, 64)
+		if s.best.Len() < redisTopN {
+			heap.Push(&s.best, scoredWord{word, score})
+		} else if score > s.best[0].score {
+			s.best[0] = scoredWord{word, score}
+			heap.Fix(&s.best, 0)
+		}
+	}
+	return nil
+}
+
+func (s *redisSink) flushFields() error {
+	if len(s.fields) == 0 {
+		return nil
+	}
+	err := s.conn.send(append([]string{"HSET", s.counts}, s.fields...)...)
+	s.fields = s.fields[:0]
+	if err != nil {
+		return err
+	}
+	return s.conn.send("EXPIRE", s.counts, redisTempTTL)
+}
+
+func (s *redisSink) Close() error {
+	defer s.conn.close()
+	if err := s.flushFields(); err != nil {
+		return err
+	}
+	if s.best.Len() > 0 {
+		args := []string{"ZADD", s.top}
+		for _, w := range s.best {
+			args = append(args, strconv.FormatFloat(w.score, 'g', -1, 64), w.word)
+		}
+		if err := s.conn.send(args...); err != nil {
+			return err
+		}
+		if err := s.conn.send("EXPIRE", s.top, redisTempTTL); err != nil {
+			return err
+		}
+	}
+	if err := s.conn.wait(); err != nil {
+		return err
+	}
+
+	if s.records == 0 {
+		return s.conn.do("DEL", redisKey+":counts", redisKey+":top")
+	}
+	// RENAME keeps the expiry of the temporary keys, so PERSIST drops it.
+	s.conn.send("MULTI")
+	s.conn.send("RENAME", s.counts, redisKey+":counts")
+	s.conn.send("PERSIST", redisKey+":counts")
+	if s.best.Len() == 0 {
+		s.conn.send("DEL", redisKey+":top")
+	} else {
+		s.conn.send("RENAME", s.top, redisKey+":top")
+		s.conn.send("PERSIST", redisKey+":top")
+	}
+	return s.conn.do("EXEC")
+}
+
+// Abort deletes the temporary keys of a failed merge.
+func (s *redisSink) Abort() {
+	s.conn.c.SetDeadline(time.Now().Add(10 * time.Second))
+	s.conn.do("DEL", s.counts, s.top)
+	s.conn.close()
+}
+
+type scoredWord struct {
+	word  string
+	score float64
+}
+
+// scoreHeap is a min-heap of the best-scored words seen so far.
+type scoreHeap []scoredWord
+
+func (h scoreHeap) Len() int           { return len(h) }
+func (h scoreHeap) Less(i, j int) bool { return h[i].score < h[j].score }
+func (h scoreHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *scoreHeap) Push(x any)        { *h = append(*h, x.(scoredWord)) }
+func (h *scoreHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
+
+// redisConn is a minimal RESP client: commands are pipelined, and their
+// replies are read back whenever redisPipeline of them are in flight.
+type redisConn struct {
+	c       net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	pending int
+}
+
+// dialRedis connects to redis://[:password@]host[:port][/db].
+func dialRedis(rawURL string) (*redisConn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Scheme != "redis" {
+		return nil, fmt.Errorf("invalid redis URL %q", rawURL)
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	c, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn := &redisConn{c: c, r: bufio.NewReader(c), w: bufio.NewWriter(c)}
+
+	if password, ok := u.User.Password(); ok {
+		args := []string{"AUTH", password}
+		if name := u.User.Username(); name != "" {
+			args = []string{"AUTH", name, password}
+		}
+		if err := conn.do(args...); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	if db := strings.Trim(u.Path, "/"); db != "" {
+		if err := conn.do("SELECT", db); err != nil {
+			conn.close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+func (c *redisConn) send(args ...string) error {
+	fmt.Fprintf(c.w, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(c.w, "$%d\r\n%s\r\n", len(a), a)
+	}
+	c.pending++
+	if c.pending >= redisPipeline {
+		return c.wait()
+	}
+	return nil
+}
+
+// wait flushes the pipeline and reads the pending replies, returning the
+// first error reply.
+func (c *redisConn) wait() error {
+	if err := c.w.Flush(); err != nil {
+		return err
+	}
+	var first error
+	for ; c.pending > 0; c.pending-- {
+		if err := c.reply(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (c *redisConn) do(args ...string) error {
+	if err := c.send(args...); err != nil {
+		return err
+	}
+	return c.wait()
+}
+
+// reply reads one reply, discarding its value.
+func (c *redisConn) reply() error {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '-':
+		return errors.New("redis: " + line[1:])
+	case '+', ':':
+		return nil
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return err
+		}
+		_, err = c.r.Discard(n + 2)
+		return err
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return err
+		}
+		for range n {
+			if err := c.reply(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (c *redisConn) close() error { return c.c.Close() }
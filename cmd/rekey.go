@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ------------------- Re-keying -------------------
+
+// rekeyRules are applied in order to every key during the final merge, so
+// stored runs can be rolled up at a coarser granularity (strip a prefix,
+// truncate a timestamp) without recounting the raw input.
+var rekeyRules []func(string) string
+
+// rekeyFlag collects --rekey specs, compiling each into rekeyRules.
+type rekeyFlag []string
+
+var rekeySpecs rekeyFlag
+
+func (r *rekeyFlag) String() string { return strings.Join(*r, " ") }
+
+func (r *rekeyFlag) values() []string { return *r }
+
+func (r *rekeyFlag) Set(spec string) error {
+	if err := addRekeyRule(spec); err != nil {
+		return err
+	}
+	*r = append(*r, spec)
+	return nil
+}
+
+func addRekeyRule(spec string) error {
+	kind, arg, ok := strings.Cut(spec, ":")
+	if !ok {
+		return fmt.Errorf("rekey rule %q: expected kind:argument", spec)
+	}
+
+	var rule func(string) string
+	switch kind {
+	case "strip-prefix":
+		rule = func(key string) string { return strings.TrimPrefix(key, arg) }
+	case "strip-suffix":
+		rule = func(key string) string { return strings.TrimSuffix(key, arg) }
+	case "truncate":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return fmt.Errorf("rekey rule %q: invalid length", spec)
+		}
+		rule = func(key string) string { return truncateRunes(key, n) }
+	case "before":
+		rule = func(key string) string {
+			before, _, _ := strings.Cut(key, arg)
+			return before
+		}
+	case "regex":
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return fmt.Errorf("rekey rule %q: %v", spec, err)
+		}
+		rule = func(key string) string { return regexRekey(re, key) }
+	default:
+		return fmt.Errorf("rekey rule %q: unknown kind %q", spec, kind)
+	}
+	rekeyRules = append(rekeyRules, rule)
+	return nil
+}
+
+func rekey(key string) string {
+	for _, rule := range rekeyRules {
+		key = rule(key)
+	}
+	return key
+}
+
+func truncateRunes(s string, n int) string {
+	for i := range s {
+		if n == 0 {
+			return s[:i]
+		}
+		n--
+	}
+	return s
+}
+
+// regexRekey replaces a matching key by its first capture group, or by the
+// whole match when the pattern has no groups. Other keys are kept.
+func regexRekey(re *regexp.Regexp, key string) string {
+	m := re.FindStringSubmatch(key)
+	switch {
+	case m == nil:
+		return key
+	case len(m) > 1:
+		return m[1]
+	default:
+		return m[0]
+	}
+}
+
+// rekeyRun streams a merged spill run through rekeyRules and the
+// --collapse-prefix roll-ups and re-aggregates the new keys into fresh spill
+// runs, exactly like the input phase does. Records whose new key is empty
+// are dropped.
+func rekeyRun(path string) ([]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file, spillFormat, path)
+	if err != nil {
+		return nil, err
+	}
+
+	wordCount := make(map[string]tally)
+	var tempFiles []string
+	for {
+		word, count, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		word = rekey(word)
+		if word == "" {
+			continue
+		}
+		keys := []string{word}
+		if rollup, ok := collapse(word); ok {
+			keys[0] = rollup
+			if collapseDetail {
+				keys = append(keys, word)
+			}
+		}
+		for _, key := range keys {
+			if combineInto(wordCount, key, count) {
+				if err := overflowWarning("re-keying "+path, key); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		if len(wordCount) >= MAX_WORDS_IN_MEMORY {
+			tmp, err := flushToTempFile(wordCount)
+			if err != nil {
+				return nil, err
+			}
+			tempFiles = append(tempFiles, tmp)
+			wordCount = make(map[string]tally)
+		}
+	}
+
+	if len(wordCount) > 0 {
+		tmp, err := flushToTempFile(wordCount)
+		if err != nil {
+			return nil, err
+		}
+		tempFiles = append(tempFiles, tmp)
+	}
+	return tempFiles, nil
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// ------------------- Repair and Verify -------------------
+
+// repair makes merge salvage damaged runs instead of failing on them.
+var repair bool
+
+// runDamage describes what is wrong with a run file.
+type runDamage struct {
+	records    int
+	malformed  int   // TSV lines that could not be parsed
+	outOfOrder int   // records sorting before their predecessor
+	truncated  error // corruption that ended the readable part early
+}
+
+func (d runDamage) ok() bool {
+	return d.malformed == 0 && d.outOfOrder == 0 && d.truncated == nil
+}
+
+func (d runDamage) String() string {
+	if d.ok() {
+		return fmt.Sprintf("ok, %d records", d.records)
+	}
+	parts := []string{fmt.Sprintf("%d records", d.records)}
+	if d.malformed > 0 {
+		parts = append(parts, fmt.Sprintf("%d malformed lines", d.malformed))
+	}
+	if d.outOfOrder > 0 {
+		parts = append(parts, fmt.Sprintf("%d out of order", d.outOfOrder))
+	}
+	if d.truncated != nil {
+		parts = append(parts, fmt.Sprintf("unreadable after the last record: %v", d.truncated))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// scanRun reads every readable record of the run at path, binary or TSV,
+// and hands it to fn. Malformed lines are skipped and counted, and
+// corruption, a truncated run as much as a garbled record such as a key
+// length no writer produces, stops the scan without failing it; only a
+// run that cannot be opened, --strict and errors from fn abort.
+func scanRun(path string, fn func(word string, count tally) error) (runDamage, error) {
+	var d runDamage
+	file, err := os.Open(path)
+	if err != nil {
+		return d, err
+	}
+	defer file.Close()
+
+	reader, err := newRecordReader(file, "auto", path)
+	if err != nil {
+		d.truncated = err
+		return d, nil
+	}
+
+	var prev string
+	for {
+		word, count, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if strict {
+				return d, err
+			}
+			d.truncated = err
+			break
+		}
+		if d.records > 0 && keyLess(word, prev) {
+			d.outOfOrder++
+		}
+		prev = word
+		d.records++
+		if err := fn(word, count); err != nil {
+			return d, err
+		}
+	}
+	if tr, ok := reader.(*tsvReader); ok {
+		d.malformed = tr.skipped
+	}
+	return d, nil
+}
+
+// repairRun re-spills the salvageable records of a damaged run into sorted
+// spill runs of at most MAX_WORDS_IN_MEMORY words, the same way the input
+// phase does, and reports what had to be fixed on stderr.
+func repairRun(path string) ([]string, error) {
+	wordCount := make(map[string]tally)
+	var tempFiles []string
+	d, err := scanRun(path, func(word string, count tally) error {
+		if combineInto(wordCount, word, count) {
+			if err := overflowWarning("repairing "+path, word); err != nil {
+				return err
+			}
+		}
+		if len(wordCount) >= MAX_WORDS_IN_MEMORY {
+			tmp, err := flushToTempFile(wordCount)
+			if err != nil {
+				return err
+			}
+			tempFiles = append(tempFiles, tmp)
+			wordCount = make(map[string]tally)
+		}
+		return nil
+	})
+	if err == nil && len(wordCount) > 0 {
+		var tmp string
+		tmp, err = flushToTempFile(wordCount)
+		tempFiles = append(tempFiles, tmp)
+	}
+	if err != nil {
+		for _, f := range tempFiles {
+			removeTemp(f)
+		}
+		return nil, err
+	}
+
+	if !d.ok() {
+		stats.repairedRuns++
+		fmt.Fprintf(os.Stderr, "repaired %s: %s\n", path, d)
+	}
+	return tempFiles, nil
+}
+
+// runRepairMerge is merge with --repair: every run is salvaged into owned
+// spill runs first, so damage in one run cannot fail the whole merge.
+func runRepairMerge(runFiles []string, outputFile string) error {
+	setPhase("repair", int64(len(runFiles)))
+	var tempFiles []string
+	defer func() {
+		for _, f := range tempFiles {
+			removeTemp(f)
+		}
+	}()
+	for i, f := range runFiles {
+		runs, err := repairRun(f)
+		if err != nil {
+			return err
+		}
+		tempFiles = append(tempFiles, runs...)
+		updateProgress(int64(i + 1))
+	}
+	stats.tempRuns = len(tempFiles)
+
+	setPhase("merge", 0)
+	finalFile, err := reduce(tempFiles, spillFormat, true)
+	if err != nil {
+		return err
+	}
+	return publishOutput(finalFile, outputFile)
+}
+
+// verifyRuns checks that each run is readable, well-formed and sorted, prints
+// one line per run and reports whether all of them passed.
+func verifyRuns(runFiles []string) (bool, error) {
+	allOK := true
+	for _, f := range runFiles {
+		d, err := scanRun(f, func(string, tally) error { return nil })
+		if err != nil {
+			return false, err
+		}
+		fmt.Printf("%s: %s\n", f, d)
+		allOK = allOK && d.ok()
+	}
+	return allOK, nil
+}
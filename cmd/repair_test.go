@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// writeGarbledRun writes a run of the words a to e whose record for d has
+// its key length replaced by one no writer produces, and returns its path.
+func writeGarbledRun(t *testing.T, dir string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := runfile.NewWriter(&buf, runfile.CodecNone)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, word := range []string{"a", "b", "c", "d", "e"} {
+		if err := w.Write(word, int64(i+1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Replace(buf.Bytes(), []byte("\x01\x01d"), []byte("\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01d"), 1)
+	path := filepath.Join(dir, "garbled.run")
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestVerifyGarbledRun(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbledRun(t, dir)
+	cmd := exec.Command(os.Args[0], "verify", "garbled.run")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), runAsCLI+"=1", envName("temp-dir")+"="+dir)
+	out, err := cmd.CombinedOutput()
+	if err == nil {
+		t.Fatalf("verify of a garbled run passed:\n%s", out)
+	}
+	if !strings.Contains(string(out), "3 records, unreadable after the last record") {
+		t.Fatalf("verify did not report the damage:\n%s", out)
+	}
+}
+
+func TestRepairGarbledRun(t *testing.T) {
+	dir := t.TempDir()
+	writeGarbledRun(t, dir)
+	wordcount(t, dir, "merge", "--repair", "-o", "out.tsv", "10", "garbled.run")
+	verify(t, filepath.Join(dir, "out.tsv"), nil, map[string]int64{"a": 1, "b": 2, "c": 3})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// ------------------- Replay Log -------------------
+
+// A successful count, merge or aggregate writes <output>.args.json: the
+// command, the value of every flag as resolved from the environment and
+// the command line, and the positional arguments. "wordcount rerun
+// output.tsv.args.json" repeats the run with exactly that configuration,
+// ignoring the WORDCOUNT_* environment, so later changes of defaults or of
+// the environment do not change the result. Paths are recorded absolute,
+// so the run can be repeated from any directory. Options that carry
+// credentials are left out, see credentialFlags.
+const runArgsSuffix = ".args.json"
+
+// pathFlags hold a file or directory path, made absolute in the replay log.
+var pathFlags = map[string]bool{
+	"output":      true,
+	"o":           true,
+	"status-file": true,
+	"cache-dir":   true,
+	"files-from":  true,
+	"run-store":   true,
+	"temp-dir":    true,
+	"stopwords":   true,
+	"cjk-dict":    true,
+}
+
+// credentialFlags may carry passwords or tokens (in URL userinfo, or in
+// the path or query of a webhook), so they are never written to the replay
+// log; rerun takes them from their WORDCOUNT_* variables instead.
+var credentialFlags = []string{"redis", "clickhouse", "notify-url"}
+
+type runArgs struct {
+	Command string   `json:"command"`
+	Flags   []string `json:"flags"`
+	Args    []string `json:"args"`
+}
+
+// resolvedRunArgs captures the current configuration. Every flag is
+// recorded as --name=value in name order, repeatable flags once per value
+// in the order they were given. All positional arguments but
+// MAX_WORDS_IN_MEMORY are paths.
+func resolvedRunArgs(fs *flag.FlagSet, mode string, args []string) runArgs {
+	r := runArgs{Command: mode, Flags: []string{}, Args: slices.Clone(args)}
+	for i := 1; i < len(r.Args); i++ {
+		r.Args[i] = absPath(r.Args[i])
+	}
+	fs.VisitAll(func(f *flag.Flag) {
+		if slices.Contains(credentialFlags, f.Name) {
+			return
+		}
+		if pathFlags[f.Name] {
+			r.Flags = append(r.Flags, "--"+f.Name+"="+absPath(f.Value.String()))
+			return
+		}
+		if list, ok := f.Value.(interface{ values() []string }); ok {
+			for _, v := range list.values() {
+				r.Flags = append(r.Flags, "--"+f.Name+"="+v)
+			}
+			return
+		}
+		r.Flags = append(r.Flags, "--"+f.Name+"="+f.Value.String())
+	})
+	return r
+}
+
+// absPath makes a local path absolute, leaving empty values, standard
+// input or output and URLs alone.
+func absPath(path string) string {
+	if path == "" || path == stdinPath || isURL(path) {
+		return path
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+func writeRunArgs(outputFile string, r runArgs) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Readable by the owner only: the log still reveals inputs and hosts.
+	return os.WriteFile(outputFile+runArgsSuffix, append(data, '\n'), 0600)
+}
+
+// applyCredentialEnv sets the credential flags of a rerun from the
+// environment, the only part of it a rerun reads.
+func applyCredentialEnv(fs *flag.FlagSet) error {
+	for _, name := range credentialFlags {
+		v, ok := os.LookupEnv(envName(name))
+		if !ok {
+			continue
+		}
+		if err := fs.Set(name, v); err != nil {
+			return fmt.Errorf("invalid %s=%q: %v", envName(name), v, err)
+		}
+	}
+	return nil
+}
+
+// readRunArgs turns a replay log back into a command line.
+func readRunArgs(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var r runArgs
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, fmt.Errorf("invalid replay log %s: %v", path, err)
+	}
+	if r.Command == "" {
+		return nil, fmt.Errorf("invalid replay log %s: no command", path)
+	}
+	var cmdArgs []string
+	if r.Command != "count" {
+		cmdArgs = append(cmdArgs, r.Command)
+	}
+	cmdArgs = append(append(cmdArgs, r.Flags...), "--")
+	return append(cmdArgs, r.Args...), nil
+}
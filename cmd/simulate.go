@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+)
+
+// ------------------- Merge Simulation -------------------
+
+// simulate plays the merge plan of mergeInBatches for hypothetical
+// parameters without touching any data: the rounds, the bytes they read
+// and write, the peak disk usage of runs and output, and the open files.
+// Merged runs are assumed to be as large as their inputs, which makes the
+// figures an upper bound; repeated words shrink real merges.
+var (
+	simRuns     int
+	simFanIn    int
+	simRunBytes int64
+)
+
+func simulateMerge(w io.Writer) error {
+	if simRuns < 1 || simFanIn < 2 || simRunBytes < 0 {
+		return errors.New("simulate needs --runs >= 1, --fanin >= 2 and --run-bytes >= 0")
+	}
+	runs := make([]int64, simRuns)
+	var disk int64
+	for i := range runs {
+		runs[i] = simRunBytes
+		disk += simRunBytes
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "round\truns\tbatches\tread\twritten\tpeak disk\topen files\t")
+	var moved, peakDisk int64
+	var rounds, peakFiles int
+	for {
+		rounds++
+		final := len(runs) <= simFanIn
+		var next []int64
+		var read int64
+		for i := 0; i < len(runs); i += simFanIn {
+			batch := runs[i:min(i+simFanIn, len(runs))]
+			var size int64
+			for _, r := range batch {
+				size += r
+			}
+			// The batch output is complete before its inputs are removed.
+			peakDisk = max(peakDisk, disk+size)
+			peakFiles = max(peakFiles, len(batch)+1)
+			read += size
+			next = append(next, size)
+		}
+		moved += 2 * read
+		disk = read
+		fmt.Fprintf(tw, "%d\t%d\t%d\t%s\t%s\t%s\t%d\t\n", rounds, len(runs), len(next),
+			byteSize(read), byteSize(read), byteSize(peakDisk), min(len(runs), simFanIn)+1)
+		if final {
+			break
+		}
+		runs = next
+	}
+	tw.Flush()
+
+	fmt.Fprintf(w, "\n%d runs of %s, fan-in %d\n", simRuns, byteSize(simRunBytes), simFanIn)
+	fmt.Fprintf(w, "merge rounds:    %d\n", rounds)
+	fmt.Fprintf(w, "bytes moved:     %s\n", byteSize(moved))
+	fmt.Fprintf(w, "peak disk:       %s\n", byteSize(peakDisk))
+	fmt.Fprintf(w, "peak open files: %d (plus the input and workspace lock)\n", peakFiles)
+	return nil
+}
+
+// byteSize formats a byte count with a binary unit.
+func byteSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
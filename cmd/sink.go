@@ -0,0 +1,91 @@
+package main
+
+// ------------------- Sinks -------------------
+
+// Sinks receive the final result alongside the output file, record by
+// record, as the last merge produces it. Close publishes what a sink
+// received; a merge that fails calls abortWriter instead, so sinks that
+// hold state outside the process can discard it.
+
+// aborter is implemented by sinks with state to discard on failure.
+type aborter interface {
+	Abort()
+}
+
+// abortWriter discards the sinks of a failed merge.
+func abortWriter(w recordWriter) {
+	if a, ok := w.(aborter); ok {
+		a.Abort()
+	}
+}
+
+func sinksConfigured() bool {
+	return redisURL != "" || clickhouseURL != "" || corpusEntropy || tokenClasses || partitionBy != "" ||
+		topOutput > 0 || len(partitionOutputs) > 0 || dfOutput
+}
+
+// withSinks returns w extended with every configured sink.
+func withSinks(w recordWriter) (recordWriter, error) {
+	tee := teeWriter{w}
+	if redisURL != "" {
+		rs, err := openRedisSink()
+		if err != nil {
+			return nil, err
+		}
+		tee = append(tee, rs)
+	}
+	if clickhouseURL != "" {
+		cs, err := openClickhouseSink()
+		if err != nil {
+			return nil, err
+		}
+		tee = append(tee, cs)
+	}
+	if corpusEntropy {
+		tee = append(tee, &entropySink{})
+	}
+	if tokenClasses {
+		tee = append(tee, &classSink{})
+	}
+	if partitionBy != "" {
+		tee = append(tee, newPartitionSink(partitionBy))
+	}
+	for _, key := range partitionOutputs {
+		tee = append(tee, newPartitionSink(key))
+	}
+	if topOutput > 0 {
+		tee = append(tee, &topSink{top: topRecords{n: topOutput}})
+	}
+	if len(tee) == 1 {
+		return w, nil
+	}
+	return tee, nil
+}
+
+// teeWriter writes every record to all of its writers.
+type teeWriter []recordWriter
+
+func (t teeWriter) Write(word string, count tally) error {
+	for _, w := range t {
+		if err := w.Write(word, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t teeWriter) Close() error {
+	var first error
+	for _, w := range t {
+		if err := w.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeWriter) Abort() {
+	for _, w := range t {
+		abortWriter(w)
+	}
+}
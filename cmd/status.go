@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+)
+
+// ------------------- Status File -------------------
+
+const statusInterval = time.Second
+
+type statusReport struct {
+	JobID      string    `json:"job_id"`
+	Phase      string    `json:"phase"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+	PhaseDone  int64     `json:"phase_done"`
+	PhaseTotal int64     `json:"phase_total"`
+	Percent    float64   `json:"percent"`
+	ETASec     float64   `json:"eta_sec,omitempty"`
+	Tokens     int       `json:"tokens"`
+	InputBytes int64     `json:"input_bytes"`
+	TempRuns   int       `json:"temp_runs"`
+	MergeRound int       `json:"merge_round"`
+}
+
+var statusFile string
+
+// status is written by the main goroutine and, when it fails the run or
+// the run is paused, by the watchdog and the signal handler.
+var status struct {
+	sync.Mutex
+	started    time.Time
+	phase      string
+	phaseStart time.Time
+	done       int64
+	total      int64
+	lastWrite  time.Time
+	err        error
+}
+
+// setPhase starts a new phase whose progress is measured against total
+// units (bytes for input, batches for a merge round) and records it.
+func setPhase(phase string, total int64) {
+	status.Lock()
+	defer status.Unlock()
+	now := time.Now()
+	status.phase = phase
+	status.phaseStart = now
+	status.done = 0
+	status.total = total
+	watchPhase(phase)
+	writeStatus()
+}
+
+// updateProgress records progress within the current phase, rewriting the
+// status file at most once per statusInterval.
+func updateProgress(done int64) {
+	status.Lock()
+	defer status.Unlock()
+	status.done = done
+	heartbeat()
+	if time.Since(status.lastWrite) >= statusInterval {
+		writeStatus()
+	}
+}
+
+func finishStatus(err error) {
+	status.Lock()
+	defer status.Unlock()
+	status.err = err
+	status.phaseStart = time.Now()
+	status.phase = "done"
+	status.done, status.total = 1, 1
+	if err != nil {
+		status.phase = "failed"
+		status.done = 0
+	}
+	writeStatus()
+}
+
+// writeStatus rewrites the status file; the caller holds status.
+func writeStatus() {
+	if statusFile == "" {
+		return
+	}
+	now := time.Now()
+	status.lastWrite = now
+
+	report := statusReport{
+		JobID:      jobID,
+		Phase:      status.phase,
+		StartedAt:  status.started,
+		UpdatedAt:  now,
+		PhaseDone:  status.done,
+		PhaseTotal: status.total,
+		Tokens:     stats.tokens,
+		InputBytes: stats.inputBytes,
+		TempRuns:   stats.tempRuns,
+		MergeRound: stats.mergeRounds,
+	}
+	if status.err != nil {
+		report.Error = status.err.Error()
+	}
+	if status.total > 0 {
+		report.Percent = 100 * float64(status.done) / float64(status.total)
+		if status.done > 0 && status.done < status.total {
+			elapsed := now.Sub(status.phaseStart).Seconds()
+			report.ETASec = elapsed * float64(status.total-status.done) / float64(status.done)
+		}
+	}
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		return
+	}
+	tmp := statusFile + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+		return
+	}
+	os.Rename(tmp, statusFile)
+}
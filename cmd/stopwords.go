@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ------------------- Stopword Lists -------------------
+
+var (
+	stopwordsFile string
+	stopwordSet   map[string]bool
+
+	stopCoverage float64
+	stopMinLen   int
+	stopMaxLen   int
+	stopClass    string
+)
+
+// Character classes selectable with --stop-class.
+var stopClasses = []string{"letters", "alnum", "any"}
+
+// stopwordList writes to w the most frequent words of the count result at
+// path that pass the length and class filters, until together they cover
+// --coverage of all tokens, one per line and most frequent first. Words
+// tied with the last one are all kept, as with export.
+//
+// The first pass only builds a histogram of the counts, the second keeps
+// the words above the cut, so memory stays proportional to the list.
+func stopwordList(path string, w io.Writer) error {
+	var total int64
+	histogram := make(map[int64]int64) // count -> tokens of candidates with that count
+	err := eachRecord(path, func(word string, count tally) error {
+		n := exportCount(count)
+		total += n
+		if n > 0 && stopCandidate(word) {
+			histogram[n] += n
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	counts := make([]int64, 0, len(histogram))
+	for n := range histogram {
+		counts = append(counts, n)
+	}
+	slices.Sort(counts)
+	var covered int64
+	threshold := int64(-1)
+	for i := len(counts) - 1; i >= 0 && float64(covered) < stopCoverage*float64(total); i-- {
+		covered += histogram[counts[i]]
+		threshold = counts[i]
+	}
+
+	type stopword struct {
+		word  string
+		count int64
+	}
+	var list []stopword
+	if threshold > 0 {
+		err = eachRecord(path, func(word string, count tally) error {
+			if n := exportCount(count); n >= threshold && stopCandidate(word) {
+				list = append(list, stopword{word, n})
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	slices.SortStableFunc(list, func(a, b stopword) int {
+		switch {
+		case a.count > b.count:
+			return -1
+		case a.count < b.count:
+			return 1
+		}
+		return 0
+	})
+
+	out := bufio.NewWriter(w)
+	for _, s := range list {
+		fmt.Fprintln(out, s.word)
+	}
+	if total > 0 {
+		fmt.Fprintf(os.Stderr, "%d stopwords covering %.1f%% of %d tokens\n", len(list), 100*float64(covered)/float64(total), total)
+	}
+	return out.Flush()
+}
+
+// stopCandidate reports whether word passes --stop-min-len, --stop-max-len
+// (in characters) and --stop-class.
+func stopCandidate(word string) bool {
+	n := utf8.RuneCountInString(word)
+	if n < stopMinLen || stopMaxLen > 0 && n > stopMaxLen {
+		return false
+	}
+	switch stopClass {
+	case "letters":
+		return !strings.ContainsFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && r != '\'' && r != '’' })
+	case "alnum":
+		return !strings.ContainsFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+	}
+	return true
+}
+
+// loadStopwords reads --stopwords, one word per line, into stopwordSet.
+// Entries are case-folded and normalized like the counted words, so a
+// list matches whatever --fold-case and --normalize produce.
+func loadStopwords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stopwordSet = make(map[string]bool)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			stopwordSet[canonicalWord(word)] = true
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ------------------- Run Store -------------------
+
+// A run store keeps the merged spill run of every counted input as
+// <dir>/<YYYY-MM-DD>/<input name>.run, so arbitrary subsets can be
+// aggregated later without re-reading the raw text. Stored runs hold
+// partial aggregates, so they must be aggregated with the same --agg,
+// --float-counts and --value-columns they were counted with.
+var (
+	runStore   string
+	storeGlob  string
+	storeSince string
+	storeUntil string
+)
+
+const storeDateLayout = "2006-01-02"
+
+// mergeInputRuns merges the spill runs of one input into a single spill run,
+// keeps a copy in the run store if there is one and returns the merged
+// run.
+func mergeInputRuns(tempFiles []string, inputFile string) (string, error) {
+	merged, err := mergeInBatches(tempFiles, spillFormat, true, spillFormat)
+	if err != nil || runStore == "" {
+		return merged, err
+	}
+
+	dir := filepath.Join(runStore, time.Now().Format(storeDateLayout))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	dst := filepath.Join(dir, filepath.Base(inputName(inputFile))+".run")
+	if err := copyFileAtomic(merged, dst); err != nil {
+		return "", err
+	}
+	return merged, nil
+}
+
+// selectStoredRuns lists the runs in a run store that match --runs-matching,
+// --runs-since and --runs-until, oldest first.
+func selectStoredRuns(dir string) ([]string, error) {
+	for _, date := range []string{storeSince, storeUntil} {
+		if _, err := time.Parse(storeDateLayout, date); date != "" && err != nil {
+			return nil, fmt.Errorf("invalid date %q, expected YYYY-MM-DD", date)
+		}
+	}
+	if _, err := filepath.Match(storeGlob, ""); err != nil {
+		return nil, fmt.Errorf("invalid glob %q: %v", storeGlob, err)
+	}
+
+	days, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []string
+	for _, day := range days {
+		date := day.Name()
+		if !day.IsDir() {
+			continue
+		}
+		if _, err := time.Parse(storeDateLayout, date); err != nil {
+			continue
+		}
+		if storeSince != "" && date < storeSince || storeUntil != "" && date > storeUntil {
+			continue
+		}
+
+		entries, err := os.ReadDir(filepath.Join(dir, date))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			name, ok := strings.CutSuffix(e.Name(), ".run")
+			if !ok || e.IsDir() {
+				continue
+			}
+			if match, _ := filepath.Match(storeGlob, name); match {
+				runs = append(runs, filepath.Join(dir, date, e.Name()))
+			}
+		}
+	}
+	sort.Strings(runs)
+	return runs, nil
+}
+
+// runAggregate merges stored runs into outputFile. Like merge, it only
+// reads the runs, but they are partial aggregates rather than records.
+func runAggregate(runFiles []string, outputFile string) error {
+	stats.tempRuns = len(runFiles)
+	setPhase("merge", 0)
+
+	finalFile, err := reduce(runFiles, spillFormat, false)
+	if err != nil {
+		return err
+	}
+	return publishOutput(finalFile, outputFile)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"math"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// ------------------- Streaming Binary Formats -------------------
+
+// msgpackWriter writes every record as a MessagePack array
+// [word, value1, ..., valueN], one after the other; integer results use
+// the smallest integer encoding, float results float 64.
+type msgpackWriter struct {
+	w     *bufio.Writer
+	float bool
+	buf   []byte
+}
+
+func newMsgpackWriter(w io.Writer) (recordWriter, error) {
+	return &msgpackWriter{w: bufio.NewWriter(w), float: resultKind() == runfile.KindFloat}, nil
+}
+
+func (m *msgpackWriter) Write(word string, t tally) error {
+	b := msgpackArray(m.buf[:0], 1+valueColumns)
+	b = msgpackString(b, word)
+	for i := range valueColumns {
+		n, f := t.column(i).final()
+		if m.float {
+			b = append(b, 0xcb)
+			b = binary.BigEndian.AppendUint64(b, math.Float64bits(f))
+		} else {
+			b = msgpackInt(b, n)
+		}
+	}
+	m.buf = b
+	_, err := m.w.Write(b)
+	return err
+}
+
+func (m *msgpackWriter) Close() error { return m.w.Flush() }
+
+func msgpackArray(b []byte, n int) []byte {
+	if n < 16 {
+		return append(b, 0x90|byte(n))
+	}
+	return binary.BigEndian.AppendUint32(append(b, 0xdd), uint32(n))
+}
+
+func msgpackString(b []byte, s string) []byte {
+	switch n := len(s); {
+	case n < 32:
+		b = append(b, 0xa0|byte(n))
+	case n <= math.MaxUint8:
+		b = append(b, 0xd9, byte(n))
+	case n <= math.MaxUint16:
+		b = binary.BigEndian.AppendUint16(append(b, 0xda), uint16(n))
+	default:
+		b = binary.BigEndian.AppendUint32(append(b, 0xdb), uint32(n))
+	}
+	return append(b, s...)
+}
+
+func msgpackInt(b []byte, v int64) []byte {
+	switch {
+	case v >= 0 && v < 128:
+		return append(b, byte(v))
+	case v >= -32 && v < 0:
+		return append(b, byte(v))
+	case v >= 0 && v <= math.MaxUint8:
+		return append(b, 0xcc, byte(v))
+	case v >= 0 && v <= math.MaxUint16:
+		return binary.BigEndian.AppendUint16(append(b, 0xcd), uint16(v))
+	case v >= 0 && v <= math.MaxUint32:
+		return binary.BigEndian.AppendUint32(append(b, 0xce), uint32(v))
+	}
+	return binary.BigEndian.AppendUint64(append(b, 0xd3), uint64(v))
+}
+
+// protobufWriter writes every record as a varint length-prefixed protobuf
+// message (the framing of Java's writeDelimitedTo and of
+// google.protobuf.util.delimited_message_util) with this schema:
+//
+//	message Record {
+//	  string word = 1;
+//	  repeated int64 counts = 2;  // integer results, packed
+//	  repeated double values = 3; // float results, packed
+//	}
+type protobufWriter struct {
+	w     *bufio.Writer
+	float bool
+	msg   []byte
+	vals  []byte
+}
+
+func newProtobufWriter(w io.Writer) (recordWriter, error) {
+	return &protobufWriter{w: bufio.NewWriter(w), float: resultKind() == runfile.KindFloat}, nil
+}
+
+func (p *protobufWriter) Write(word string, t tally) error {
+	vals := p.vals[:0]
+	for i := range valueColumns {
+		n, f := t.column(i).final()
+		if p.float {
+			vals = binary.LittleEndian.AppendUint64(vals, math.Float64bits(f))
+		} else {
+			vals = binary.AppendUvarint(vals, uint64(n))
+		}
+	}
+	field := byte(2)
+	if p.float {
+		field = 3
+	}
+
+	msg := append(p.msg[:0], 1<<3|2) // field 1, length-delimited
+	msg = binary.AppendUvarint(msg, uint64(len(word)))
+	msg = append(msg, word...)
+	msg = append(msg, field<<3|2)
+	msg = binary.AppendUvarint(msg, uint64(len(vals)))
+	msg = append(msg, vals...)
+	p.msg, p.vals = msg, vals
+
+	var prefix [binary.MaxVarintLen64]byte
+	p.w.Write(prefix[:binary.PutUvarint(prefix[:], uint64(len(msg)))])
+	_, err := p.w.Write(msg)
+	return err
+}
+
+func (p *protobufWriter) Close() error { return p.w.Flush() }
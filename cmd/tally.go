@@ -0,0 +1,233 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// ------------------- Counts -------------------
+
+// tally is the aggregate kept for each word: an exact integer value by
+// default, or a float64 value with --float-counts, combined according to
+// --agg, plus the number of input records k folded into it. Float sums are
+// compensated (Kahan-Babuska/Neumaier): c accumulates the low-order bits
+// lost by f, so millions of small weights do not drift.
+//
+// With --value-columns N > 1 the tally itself is the first column and rest
+// holds the other N-1, each aggregated independently.
+type tally struct {
+	n int64
+	f float64
+	c float64
+	k int64
+
+	rest []tally
+}
+
+// Aggregation operators selectable with --agg.
+const (
+	aggSum   = "sum"
+	aggMax   = "max"
+	aggMin   = "min"
+	aggCount = "count"
+	aggMean  = "mean"
+)
+
+var aggOps = []string{aggSum, aggMax, aggMin, aggCount, aggMean}
+
+// combine folds o, either a single record or a partial aggregate read back
+// from a run, into t, column by column. It reports whether a sum overflowed,
+// in which case the value is clamped to the largest representable one.
+func (t *tally) combine(o tally) (overflow bool) {
+	overflow = t.combineColumn(o)
+	if len(o.rest) == 0 {
+		return overflow
+	}
+	if t.rest == nil {
+		t.rest = make([]tally, len(o.rest))
+	}
+	for i := range o.rest {
+		if t.rest[i].combineColumn(o.rest[i]) {
+			overflow = true
+		}
+	}
+	return overflow
+}
+
+func (t *tally) combineColumn(o tally) (overflow bool) {
+	switch aggOp {
+	case aggMax:
+		if t.k == 0 || o.greater(*t) {
+			t.n, t.f, t.c = o.n, o.f, o.c
+		}
+	case aggMin:
+		if t.k == 0 || t.greater(o) {
+			t.n, t.f, t.c = o.n, o.f, o.c
+		}
+	case aggCount:
+	default:
+		overflow = t.add(o)
+	}
+	t.k += o.k
+	return overflow
+}
+
+func (t tally) greater(o tally) bool {
+	if floatCounts {
+		return t.float() > o.float()
+	}
+	return t.n > o.n
+}
+
+func (t *tally) add(o tally) (overflow bool) {
+	n := t.n + o.n
+	switch {
+	case o.n > 0 && n < t.n:
+		n, overflow = math.MaxInt64, true
+	case o.n < 0 && n > t.n:
+		n, overflow = math.MinInt64, true
+	}
+	t.n = n
+	if o.f == 0 && o.c == 0 {
+		return overflow
+	}
+	sum := t.f + o.f
+	if math.Abs(t.f) >= math.Abs(o.f) {
+		t.c += (t.f - sum) + o.f
+	} else {
+		t.c += (o.f - sum) + t.f
+	}
+	t.c += o.c
+	t.f = sum
+	if math.IsInf(sum, 0) && !math.IsInf(o.f, 0) {
+		t.f, t.c = math.Copysign(math.MaxFloat64, sum), 0
+		overflow = true
+	}
+	return overflow
+}
+
+// float returns the compensated float sum.
+func (t tally) float() float64 {
+	return t.f + t.c
+}
+
+// unitTally is what a single occurrence of a word contributes.
+func unitTally() tally {
+	if floatCounts {
+		return tally{f: 1, k: 1}
+	}
+	return tally{n: 1, k: 1}
+}
+
+// column returns the i-th value column of t.
+func (t tally) column(i int) tally {
+	if i == 0 {
+		t.rest = nil
+		return t
+	}
+	return t.rest[i-1]
+}
+
+// String formats the final values of the aggregate, tab-separated.
+func (t tally) String() string {
+	if len(t.rest) == 0 {
+		return t.columnString()
+	}
+	fields := make([]string, 0, 1+len(t.rest))
+	fields = append(fields, t.column(0).columnString())
+	for _, c := range t.rest {
+		fields = append(fields, c.columnString())
+	}
+	return strings.Join(fields, "\t")
+}
+
+func (t tally) columnString() string {
+	switch aggOp {
+	case aggCount:
+		return strconv.FormatInt(t.k, 10)
+	case aggMean:
+		return formatFloat(t.mean())
+	}
+	if floatCounts {
+		return formatFloat(t.float())
+	}
+	return strconv.FormatInt(t.n, 10)
+}
+
+// final returns the final value of a single column for typed result
+// formats: n for resultKind() KindInt, f for KindFloat.
+func (t tally) final() (n int64, f float64) {
+	switch {
+	case aggOp == aggCount:
+		return t.k, float64(t.k)
+	case aggOp == aggMean:
+		return 0, t.mean()
+	case floatCounts:
+		return 0, t.float()
+	}
+	return t.n, float64(t.n)
+}
+
+func (t tally) mean() float64 {
+	if floatCounts {
+		return t.float() / float64(t.k)
+	}
+	return float64(t.n) / float64(t.k)
+}
+
+func formatFloat(f float64) string {
+	if floatPrecision >= 0 {
+		return strconv.FormatFloat(f, 'f', floatPrecision, 64)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// parseTally parses a count as found in weighted input and merged count
+// files. Exporters disagree on number formats, so besides plain integers
+// it accepts digit separators ("1_000_000"), scientific notation ("1e6")
+// and floats; outside --float-counts those must still be whole numbers.
+func parseTally(s string) (tally, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "_") {
+		var err error
+		if s, err = stripDigitSeparators(s); err != nil {
+			return tally{}, err
+		}
+	}
+
+	if floatCounts {
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return tally{}, fmt.Errorf("invalid count %q", s)
+		}
+		return tally{f: f, k: 1}, nil
+	}
+
+	if n, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return tally{n: n, k: 1}, nil
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	if err != nil || f != math.Trunc(f) || f < math.MinInt64 || f >= math.MaxInt64 {
+		return tally{}, fmt.Errorf("invalid count %q (use --float-counts for fractional counts)", s)
+	}
+	return tally{n: int64(f), k: 1}, nil
+}
+
+// stripDigitSeparators removes underscores that sit between two digits.
+func stripDigitSeparators(s string) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '_' {
+			b.WriteByte(s[i])
+			continue
+		}
+		if i == 0 || i == len(s)-1 || !isDigit(s[i-1]) || !isDigit(s[i+1]) {
+			return "", fmt.Errorf("invalid count %q", s)
+		}
+	}
+	return b.String(), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
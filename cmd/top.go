@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"container/heap"
+	"slices"
+)
+
+// ------------------- Top-N Output -------------------
+
+// With --top N the final merge streams into a min-heap of the N records
+// with the largest values, and only those are written, largest first,
+// when the merge ends. The full result is never written, which for a top
+// 1000 of hundreds of millions of distinct words saves a multi-GB write.
+var topWords int
+
+// topRecords keeps the n records with the largest first-column values.
+type topRecords struct {
+	n      int
+	best   scoreHeap
+	values map[string]tally
+}
+
+func (t *topRecords) add(word string, v tally) {
+	_, score := v.column(0).final()
+	switch {
+	case t.best.Len() < t.n:
+		heap.Push(&t.best, scoredWord{word, score})
+	case t.n > 0 && score > t.best[0].score:
+		delete(t.values, t.best[0].word)
+		t.best[0] = scoredWord{word, score}
+		heap.Fix(&t.best, 0)
+	default:
+		return
+	}
+	if t.values == nil {
+		t.values = make(map[string]tally)
+	}
+	t.values[word] = v
+}
+
+// sorted returns the kept words, largest value first, ties in key order.
+func (t *topRecords) sorted() []string {
+	best := slices.Clone(t.best)
+	slices.SortFunc(best, func(a, b scoredWord) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.word, b.word)
+	})
+	words := make([]string, len(best))
+	for i, w := range best {
+		words[i] = w.word
+	}
+	return words
+}
+
+// topWriter withholds the records of the final merge from w but the
+// topWords best, which it writes when it is closed.
+type topWriter struct {
+	w   recordWriter
+	top topRecords
+}
+
+func newTopWriter(w recordWriter) *topWriter {
+	return &topWriter{w: w, top: topRecords{n: topWords}}
+}
+
+func (t *topWriter) Write(word string, v tally) error {
+	t.top.add(word, v)
+	return nil
+}
+
+func (t *topWriter) Close() error {
+	for _, word := range t.top.sorted() {
+		if err := t.w.Write(word, t.top.values[word]); err != nil {
+			t.w.Close()
+			return err
+		}
+	}
+	return t.w.Close()
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// ------------------- Spelling Variants -------------------
+
+var (
+	variantDistance int
+	variantMaxCount int64
+	variantRatio    float64
+	variantWindow   int
+)
+
+// variant is a word of the result under consideration while it is within
+// the window, with the best canonical form found for it so far.
+type variant struct {
+	word      []rune
+	count     int64
+	canonical []rune
+	canCount  int64
+	distance  int
+}
+
+// spellingVariants writes to w the rare words of the count result at path
+// (counted at most --variant-max-count times) that are within
+// --variant-distance edits of a word at least --variant-ratio times more
+// frequent, as variant, count, canonical form, its count and the distance.
+//
+// It streams over the sorted keys and compares each word with the
+// --variant-window words before it, so memory is bounded by the window;
+// the price is that typos in the first letters, which sort far from their
+// canonical form, go unnoticed.
+func spellingVariants(path string, w io.Writer) error {
+	out := bufio.NewWriter(w)
+	window := make([]*variant, 0, variantWindow)
+	emit := func(v *variant) {
+		if v.canonical != nil {
+			fmt.Fprintf(out, "%s\t%d\t%s\t%d\t%d\n", string(v.word), v.count, string(v.canonical), v.canCount, v.distance)
+		}
+	}
+
+	err := eachRecord(path, func(word string, count tally) error {
+		cur := &variant{word: []rune(word), count: exportCount(count)}
+		for _, prev := range window {
+			consider(prev, cur)
+			consider(cur, prev)
+		}
+		if len(window) == variantWindow {
+			emit(window[0])
+			window = append(window[:0], window[1:]...)
+		}
+		window = append(window, cur)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, v := range window {
+		emit(v)
+	}
+	return out.Flush()
+}
+
+// consider records c as the canonical form of v if v is rare, c is frequent
+// enough and close enough, and c is better than v's current candidate:
+// closer, or as close and more frequent.
+func consider(v, c *variant) {
+	if v.count > variantMaxCount || float64(c.count) < variantRatio*float64(v.count) {
+		return
+	}
+	d := editDistance(v.word, c.word, variantDistance)
+	if d > variantDistance {
+		return
+	}
+	if v.canonical == nil || d < v.distance || d == v.distance && c.count > v.canCount {
+		v.canonical, v.canCount, v.distance = c.word, c.count, d
+	}
+}
+
+// editDistance returns the optimal string alignment distance between a and
+// b (insertions, deletions, substitutions and transpositions of adjacent
+// runes), or limit+1 as soon as it is known to exceed limit.
+func editDistance(a, b []rune, limit int) int {
+	if abs(len(a)-len(b)) > limit {
+		return limit + 1
+	}
+	prev2 := make([]int, len(b)+1)
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		rowMin := cur[0]
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				cur[j] = min(cur[j], prev2[j-2]+1)
+			}
+			rowMin = min(rowMin, cur[j])
+		}
+		if rowMin > limit {
+			return limit + 1
+		}
+		prev2, prev, cur = prev, cur, prev2
+	}
+	return prev[len(b)]
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+)
+
+// ------------------- Warnings -------------------
+
+// strict turns every warning into a hard failure, for pipelines where
+// silently dropping or mangling data is unacceptable.
+var strict bool
+
+// warn reports a recoverable data problem at loc (usually file:line) on
+// stderr. Under --strict it returns the problem as an error instead, which
+// the caller must propagate.
+func warn(loc, format string, args ...any) error {
+	msg := fmt.Sprintf(format, args...)
+	if loc != "" {
+		msg = loc + ": " + msg
+	}
+	if strict {
+		return &strictError{msg: msg, located: loc != ""}
+	}
+	stats.warnings++
+	fmt.Fprintln(os.Stderr, "warning:", msg)
+	return nil
+}
+
+// strictError is a warning failing the run under --strict.
+type strictError struct {
+	msg     string
+	located bool // msg starts with the location of the problem
+}
+
+func (e *strictError) Error() string { return e.msg + " (--strict)" }
+
+// inFile prefixes an error met while reading the file name with that name,
+// unless it is a warning that already tells where it happened.
+func inFile(name string, err error) error {
+	var se *strictError
+	if errors.As(err, &se) && se.located {
+		return err
+	}
+	return fmt.Errorf("%s: %w", name, err)
+}
+
+func lineLoc(name string, line int) string {
+	return fmt.Sprintf("%s:%d", name, line)
+}
+
+// combineInto folds o into the tally of word in counts and reports whether
+// the aggregate overflowed; see overflowWarning.
+func combineInto(counts map[string]tally, word string, o tally) (overflow bool) {
+	t := counts[word]
+	overflow = t.combine(o)
+	counts[word] = t
+	return overflow
+}
+
+func overflowWarning(loc, word string) error {
+	return warn(loc, "count for %q overflowed and was clamped", word)
+}
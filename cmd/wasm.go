@@ -0,0 +1,301 @@
+//go:build js && wasm
+
+package main
+
+import (
+	"container/heap"
+	"flag"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall/js"
+)
+
+// ------------------- WebAssembly API -------------------
+
+// Built with
+//
+//	GOOS=js GOARCH=wasm go build -o wordcount.wasm ./cmd
+//
+// and started with Go's wasm_exec.js, the module does not read a command
+// line but defines a global wordcount object:
+//
+//	wordcount.configure({"split": "words", "fold-case": true}) // null or an error message
+//	wordcount.feed(chunk) // a string or Uint8Array; lines may span chunks
+//	wordcount.end()       // counts a last line without a newline
+//	wordcount.topN(10)    // [{word, count}, ...], most frequent first
+//	wordcount.reset()
+//
+// configure takes the tokenization options by their flag name, stopwords
+// and cjk-dict as arrays of words, and max-words, the number of distinct
+// words kept in the map before it is spilled (100000 by default). A
+// browser has no file system: spilled runs are kept in memory as sorted
+// slices, which take a fraction of the map's memory, and merged into one
+// when more than max-words of them pile up, like merge passes over files.
+
+// wasmOptions are the flags configure accepts.
+var wasmOptions = []string{
+	"split", "token-regex", "tokenizer", "strip-punct", "hyphens", "apostrophes",
+	"fold-case", "normalize", "stem", "min-len", "max-len",
+}
+
+type memRecord struct {
+	word  string
+	count int64
+}
+
+var wasmCounter struct {
+	counts  map[string]int64
+	runs    [][]memRecord
+	pending string
+	split   wordSplitter
+}
+
+func init() {
+	serve = serveJS
+}
+
+func serveJS() {
+	MAX_WORDS_IN_MEMORY = 100000
+	resetCounter()
+
+	api := js.Global().Get("Object").New()
+	api.Set("configure", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if err := configure(args[0]); err != nil {
+			return err.Error()
+		}
+		return nil
+	}))
+	api.Set("feed", js.FuncOf(func(this js.Value, args []js.Value) any {
+		chunk := args[0]
+		if chunk.Type() == js.TypeString {
+			feed(chunk.String())
+		} else {
+			buf := make([]byte, chunk.Get("length").Int())
+			js.CopyBytesToGo(buf, chunk)
+			feed(string(buf))
+		}
+		return nil
+	}))
+	api.Set("end", js.FuncOf(func(this js.Value, args []js.Value) any {
+		if wasmCounter.pending != "" {
+			countJSLine(wasmCounter.pending)
+			wasmCounter.pending = ""
+		}
+		return nil
+	}))
+	api.Set("topN", js.FuncOf(func(this js.Value, args []js.Value) any {
+		return topN(args[0].Int())
+	}))
+	api.Set("reset", js.FuncOf(func(this js.Value, args []js.Value) any {
+		resetCounter()
+		return nil
+	}))
+	js.Global().Set("wordcount", api)
+	select {}
+}
+
+func resetCounter() {
+	wasmCounter.counts = make(map[string]int64)
+	wasmCounter.runs = nil
+	wasmCounter.pending = ""
+}
+
+// configure resets the counter and the options to their defaults, then
+// applies opts and validates them like the command line.
+func configure(opts js.Value) error {
+	resetCounter()
+	for _, name := range wasmOptions {
+		f := flag.Lookup(name)
+		f.Value.Set(f.DefValue)
+	}
+	stripPunct = punctNone
+	MAX_WORDS_IN_MEMORY = 100000
+	stopwordSet, cjkDict, cjkDictMax = nil, nil, 0
+
+	var stopwords js.Value
+	keys := js.Global().Get("Object").Call("keys", opts)
+	for i := range keys.Length() {
+		name := keys.Index(i).String()
+		v := opts.Get(name)
+		switch {
+		case name == "max-words":
+			if MAX_WORDS_IN_MEMORY = v.Int(); MAX_WORDS_IN_MEMORY <= 0 {
+				return fmt.Errorf("invalid max-words: %d", MAX_WORDS_IN_MEMORY)
+			}
+		case name == "stopwords":
+			stopwords = v
+		case name == "cjk-dict":
+			cjkDict = make(map[string]bool)
+			for j := range v.Length() {
+				word := v.Index(j).String()
+				cjkDict[word] = true
+				cjkDictMax = max(cjkDictMax, len([]rune(word)))
+			}
+		case slices.Contains(wasmOptions, name):
+			if err := flag.Set(name, jsOption(v)); err != nil {
+				return fmt.Errorf("invalid %s: %v", name, err)
+			}
+		default:
+			return fmt.Errorf("unknown option: %s", name)
+		}
+	}
+
+	var ok bool
+	if !slices.Contains(splitModes, splitMode) {
+		return fmt.Errorf("invalid split: %s", splitMode)
+	}
+	tokenRegex = nil
+	if tokenPattern != "" {
+		var err error
+		if tokenRegex, err = regexp.Compile(tokenPattern); err != nil {
+			return fmt.Errorf("invalid token-regex: %v", err)
+		}
+	}
+	if tokenizer, ok = tokenizers[tokenizerName]; !ok {
+		return fmt.Errorf("invalid tokenizer: %s", tokenizerName)
+	}
+	if tokenPattern != "" && (splitMode != "lines" || tokenizer != nil) || tokenizer != nil && splitMode != "lines" {
+		return fmt.Errorf("invalid options: split=words, token-regex and tokenizer exclude each other")
+	}
+	if !slices.Contains(hyphenPolicies, hyphenPolicy) {
+		return fmt.Errorf("invalid hyphens: %s", hyphenPolicy)
+	}
+	if !slices.Contains(apostrophePolicies, apostrophePolicy) {
+		return fmt.Errorf("invalid apostrophes: %s", apostrophePolicy)
+	}
+	if unicodeForm, ok = unicodeForms[normalizeForm]; !ok {
+		return fmt.Errorf("invalid normalize: %s", normalizeForm)
+	}
+	if stemmer, ok = stemmers[stemName]; !ok {
+		return fmt.Errorf("invalid stem: %s", stemName)
+	}
+	if minLen < 0 || maxLen < 0 || maxLen > 0 && minLen > maxLen {
+		return fmt.Errorf("invalid min-len/max-len: %d %d", minLen, maxLen)
+	}
+	if !stopwords.IsUndefined() {
+		stopwordSet = make(map[string]bool)
+		for j := range stopwords.Length() {
+			stopwordSet[canonicalWord(stopwords.Index(j).String())] = true
+		}
+	}
+	return nil
+}
+
+// jsOption formats an option value as it would be given on the command
+// line.
+func jsOption(v js.Value) string {
+	switch v.Type() {
+	case js.TypeBoolean:
+		return strconv.FormatBool(v.Bool())
+	case js.TypeNumber:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	}
+	return v.String()
+}
+
+func feed(chunk string) {
+	c := &wasmCounter
+	for {
+		i := strings.IndexByte(chunk, '\n')
+		if i < 0 {
+			c.pending += chunk
+			return
+		}
+		countJSLine(c.pending + chunk[:i])
+		c.pending, chunk = "", chunk[i+1:]
+	}
+}
+
+// countJSLine counts the words of a line as countContent does.
+func countJSLine(line string) {
+	c := &wasmCounter
+	c.split.line(strings.TrimSuffix(line, "\r"), func(word string) error {
+		if wordSelected(word) {
+			c.counts[word]++
+		}
+		return nil
+	})
+	if len(c.counts) >= MAX_WORDS_IN_MEMORY {
+		c.runs = append(c.runs, sortedRun(c.counts))
+		c.counts = make(map[string]int64)
+		if len(c.runs) > MAX_WORDS_IN_MEMORY {
+			c.runs = [][]memRecord{mergeRuns(c.runs)}
+		}
+	}
+}
+
+func sortedRun(counts map[string]int64) []memRecord {
+	run := make([]memRecord, 0, len(counts))
+	for word, n := range counts {
+		run = append(run, memRecord{word, n})
+	}
+	slices.SortFunc(run, func(a, b memRecord) int { return strings.Compare(a.word, b.word) })
+	return run
+}
+
+// mergeRuns merges sorted runs pairwise, adding up the counts of equal
+// words.
+func mergeRuns(runs [][]memRecord) []memRecord {
+	if len(runs) == 0 {
+		return nil
+	}
+	for len(runs) > 1 {
+		next := make([][]memRecord, 0, (len(runs)+1)/2)
+		for i := 0; i < len(runs); i += 2 {
+			if i+1 == len(runs) {
+				next = append(next, runs[i])
+				break
+			}
+			a, b := runs[i], runs[i+1]
+			merged := make([]memRecord, 0, len(a)+len(b))
+			for len(a) > 0 && len(b) > 0 {
+				switch {
+				case a[0].word < b[0].word:
+					merged, a = append(merged, a[0]), a[1:]
+				case a[0].word > b[0].word:
+					merged, b = append(merged, b[0]), b[1:]
+				default:
+					merged = append(merged, memRecord{a[0].word, a[0].count + b[0].count})
+					a, b = a[1:], b[1:]
+				}
+			}
+			next = append(next, append(append(merged, a...), b...))
+		}
+		runs = next
+	}
+	return runs[0]
+}
+
+// topN returns the n most frequent words counted so far, without
+// consuming them: more chunks may be fed afterwards.
+func topN(n int) []any {
+	c := &wasmCounter
+	all := mergeRuns(append(slices.Clip(c.runs), sortedRun(c.counts)))
+	best := &scoreHeap{}
+	for _, r := range all {
+		switch score := float64(r.count); {
+		case best.Len() < n:
+			heap.Push(best, scoredWord{r.word, score})
+		case n > 0 && score > (*best)[0].score:
+			(*best)[0] = scoredWord{r.word, score}
+			heap.Fix(best, 0)
+		}
+	}
+	slices.SortFunc(*best, func(a, b scoredWord) int {
+		if a.score != b.score {
+			if a.score > b.score {
+				return -1
+			}
+			return 1
+		}
+		return strings.Compare(a.word, b.word)
+	})
+	top := make([]any, best.Len())
+	for i, w := range *best {
+		top[i] = map[string]any{"word": w.word, "count": w.score}
+	}
+	return top
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime/pprof"
+	"sync/atomic"
+	"time"
+)
+
+// ------------------- Watchdog -------------------
+
+// The watchdog fails runs that exceed --input-timeout or --merge-timeout,
+// or that make no progress for --stall-timeout (a hung NFS read, a stuck
+// object store), instead of letting them hang forever. It dumps the
+// goroutine stacks, which show where the run is blocked, releases the
+// workspace and ends the run as failed: reported like any failure, then
+// exit status 1.
+var (
+	inputTimeout time.Duration
+	mergeTimeout time.Duration
+	stallTimeout time.Duration
+)
+
+// watched is what the watchdog sees of the run: the phase, when it began
+// and when progress was last made (Unix nanoseconds).
+var watched struct {
+	phase      atomic.Value
+	phaseStart atomic.Int64
+	lastBeat   atomic.Int64
+}
+
+// heartbeat records that the run is making progress.
+func heartbeat() {
+	watched.lastBeat.Store(time.Now().UnixNano())
+}
+
+// watchPhase records the current phase; merge rounds keep the start of
+// the merge phase.
+func watchPhase(phase string) {
+	if prev, _ := watched.phase.Load().(string); prev != phase {
+		watched.phase.Store(phase)
+		watched.phaseStart.Store(time.Now().UnixNano())
+	}
+	heartbeat()
+}
+
+// pauseWatch shows the run as paused to the watchdog until the returned
+// function resumes the interrupted phase, whose start moves by the time
+// spent paused.
+func pauseWatch() (resume func()) {
+	phase, _ := watched.phase.Load().(string)
+	pausedAt := time.Now()
+	watched.phase.Store("paused")
+	return func() {
+		watched.phaseStart.Add(int64(time.Since(pausedAt)))
+		heartbeat()
+		watched.phase.CompareAndSwap("paused", phase)
+	}
+}
+
+// startWatchdog watches the run until the returned function is called.
+func startWatchdog(release func()) (stop func()) {
+	if inputTimeout == 0 && mergeTimeout == 0 && stallTimeout == 0 {
+		return func() {}
+	}
+	heartbeat()
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+			if err := watchdogCheck(); err != nil {
+				fmt.Fprintf(os.Stderr, "wordcount: %v\n\n", err)
+				pprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+				release()
+				endRun(err, abortNotifyTimeout)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func watchdogCheck() error {
+	now := time.Now()
+	phase, _ := watched.phase.Load().(string)
+	inPhase := now.Sub(time.Unix(0, watched.phaseStart.Load()))
+	switch {
+	case phase == "paused":
+		return nil
+	case phase == "input" && inputTimeout > 0 && inPhase > inputTimeout:
+		return fmt.Errorf("watchdog: input phase exceeded --input-timeout %s", inputTimeout)
+	case phase == "merge" && mergeTimeout > 0 && inPhase > mergeTimeout:
+		return fmt.Errorf("watchdog: merge phase exceeded --merge-timeout %s", mergeTimeout)
+	}
+	if idle := now.Sub(time.Unix(0, watched.lastBeat.Load())); stallTimeout > 0 && idle > stallTimeout {
+		if phase == "" {
+			phase = "setup"
+		}
+		return fmt.Errorf("watchdog: no progress for %s in the %s phase (--stall-timeout %s)",
+			idle.Round(time.Second), phase, stallTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// ------------------- Workspace -------------------
+
+// Every invocation keeps its temporary runs in a private workspace
+// directory under --temp-dir, so concurrent runs sharing $TMPDIR never
+// touch each other's files. The workspace holds a lock file, locked for
+// the lifetime of the process, that tells live workspaces from ones left
+// behind by crashed runs.
+var (
+	tempDir   string
+	workspace string
+)
+
+const (
+	workspacePrefix = "wordcount-"
+	workspaceLock   = "owner.lock"
+)
+
+// createWorkspace creates and locks the workspace. The returned release
+// function removes it (unless --keep-temp is set); it is also called on
+// SIGINT and SIGTERM.
+func createWorkspace() (release func(), err error) {
+	dir, err := os.MkdirTemp(tempDir, workspacePrefix+"*")
+	if err != nil {
+		return nil, err
+	}
+
+	lock, err := os.OpenFile(filepath.Join(dir, workspaceLock), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	if err := lockFile(lock); err != nil {
+		lock.Close()
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("lock workspace: %w", err)
+	}
+	fmt.Fprintf(lock, "pid %d\n", os.Getpid())
+
+	var once sync.Once
+	release = func() {
+		once.Do(func() {
+			lock.Close()
+			if keepTemp {
+				fmt.Fprintln(os.Stderr, "wordcount: kept workspace", dir)
+				return
+			}
+			os.RemoveAll(dir)
+		})
+	}
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigs
+		release()
+		endRun(fmt.Errorf("wordcount: %v", sig), abortNotifyTimeout)
+	}()
+
+	workspace = dir
+	return release, nil
+}
+
+// ------------------- clean-temp -------------------
+
+var (
+	cleanTTL    time.Duration
+	cleanDryRun bool
+)
+
+// cleanTemp removes workspaces under --temp-dir whose owner is gone and
+// which have not been modified for --ttl, along with loose run files left
+// by versions that predate workspaces.
+func cleanTemp() error {
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return err
+	}
+
+	if !workspaceLocking {
+		fmt.Fprintln(os.Stderr, "clean-temp: workspaces cannot be locked on this platform; only loose runs are removed")
+	}
+	cutoff := time.Now().Add(-cleanTTL)
+	var removed int
+	var freed int64
+	for _, e := range entries {
+		name := e.Name()
+		path := filepath.Join(tempDir, name)
+
+		switch {
+		case e.IsDir() && strings.HasPrefix(name, workspacePrefix):
+			if workspaceInUse(path) {
+				continue
+			}
+		case !e.IsDir() && isLegacyTempRun(name):
+		default:
+			continue
+		}
+
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+
+		size := diskUsage(path)
+		if cleanDryRun {
+			fmt.Printf("would remove %s (%d bytes, idle since %s)\n", path, size, info.ModTime().Format(time.RFC3339))
+		} else {
+			if err := os.RemoveAll(path); err != nil {
+				fmt.Fprintln(os.Stderr, "clean-temp:", err)
+				continue
+			}
+			fmt.Printf("removed %s (%d bytes)\n", path, size)
+		}
+		removed++
+		freed += size
+	}
+
+	verb := "removed"
+	if cleanDryRun {
+		verb = "would remove"
+	}
+	fmt.Printf("%s %d entries, %d bytes\n", verb, removed, freed)
+	return nil
+}
+
+// workspaceInUse reports whether a live process still holds the workspace
+// lock. A workspace without a lock file is still being set up or is not
+// ours, so it is left alone too, as is every workspace where locks are not
+// available.
+func workspaceInUse(dir string) bool {
+	if !workspaceLocking {
+		return true
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, workspaceLock), os.O_RDWR, 0)
+	if err != nil {
+		return true
+	}
+	defer lock.Close()
+	return lockFile(lock) != nil
+}
+
+func isLegacyTempRun(name string) bool {
+	return strings.HasSuffix(name, ".tmp") &&
+		(strings.HasPrefix(name, "wordcount_") || strings.HasPrefix(name, "merged_"))
+}
+
+func diskUsage(path string) int64 {
+	var total int64
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total
+}
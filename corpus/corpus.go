@@ -0,0 +1,221 @@
+// Package corpus generates reproducible synthetic inputs for wordcount and
+// checks its results against a reference count, so custom tokenizers, sinks
+// and formats can be tested end to end without shipping large fixtures.
+//
+// A typical integration test generates a corpus, runs wordcount over it and
+// verifies the result:
+//
+//	want, err := corpus.Generate(input, corpus.Config{Tokens: 1e6, Vocabulary: 5e4, Skew: 1.1, Seed: 1})
+//	// ... run wordcount on input ...
+//	if err := corpus.Verify(output, want); err != nil {
+//		t.Fatal(err)
+//	}
+package corpus
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"strconv"
+	"strings"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// Encodings selectable in Config.Encoding.
+const (
+	ASCII  = "ascii"  // lower-case Latin letters
+	UTF8   = "utf8"   // Latin, Cyrillic, Greek and CJK letters
+	Latin1 = "latin1" // ISO-8859-1 bytes, i.e. invalid UTF-8 above 0x7f
+)
+
+// Config describes a synthetic corpus. The zero value of every field but
+// Tokens has a usable default.
+type Config struct {
+	Tokens     int     // number of tokens (lines) to write
+	Vocabulary int     // number of distinct words (default 1000)
+	Skew       float64 // Zipf exponent of word frequencies, > 1; 0 means uniform
+	MinLen     int     // shortest word in characters (default 1)
+	MaxLen     int     // longest word in characters (default 12)
+	Encoding   string  // ASCII (default), UTF8 or Latin1
+	Seed       uint64  // corpora with equal configs and seeds are identical
+}
+
+var alphabets = map[string][]string{
+	ASCII:  letters('a', 'z'),
+	UTF8:   append(append(append(letters('a', 'z'), letters('а', 'я')...), letters('α', 'ω')...), letters('一', '丯')...),
+	Latin1: append(letters('a', 'z'), latin1Letters()...),
+}
+
+func letters(from, to rune) []string {
+	var s []string
+	for r := from; r <= to; r++ {
+		s = append(s, string(r))
+	}
+	return s
+}
+
+func latin1Letters() []string {
+	var s []string
+	for b := 0xe0; b <= 0xfe; b++ {
+		s = append(s, string([]byte{byte(b)}))
+	}
+	return s
+}
+
+// Generate writes a corpus of one word per line to w and returns the
+// reference count of every word in it.
+func Generate(w io.Writer, cfg Config) (map[string]int64, error) {
+	if cfg.Vocabulary <= 0 {
+		cfg.Vocabulary = 1000
+	}
+	if cfg.MinLen <= 0 {
+		cfg.MinLen = 1
+	}
+	if cfg.MaxLen <= 0 {
+		cfg.MaxLen = 12
+	}
+	if cfg.Encoding == "" {
+		cfg.Encoding = ASCII
+	}
+	alphabet, ok := alphabets[cfg.Encoding]
+	if !ok {
+		return nil, fmt.Errorf("corpus: unknown encoding %q", cfg.Encoding)
+	}
+	if cfg.MaxLen < cfg.MinLen {
+		return nil, fmt.Errorf("corpus: MaxLen %d is below MinLen %d", cfg.MaxLen, cfg.MinLen)
+	}
+	if cfg.Skew != 0 && cfg.Skew <= 1 {
+		return nil, fmt.Errorf("corpus: Skew must be above 1, got %v", cfg.Skew)
+	}
+
+	rng := rand.New(rand.NewPCG(cfg.Seed, cfg.Seed^0x9e3779b97f4a7c15))
+	vocab, err := vocabulary(rng, cfg, alphabet)
+	if err != nil {
+		return nil, err
+	}
+
+	pick := func() int { return rng.IntN(len(vocab)) }
+	if cfg.Skew != 0 {
+		zipf := rand.NewZipf(rng, cfg.Skew, 1, uint64(len(vocab)-1))
+		pick = func() int { return int(zipf.Uint64()) }
+	}
+
+	counts := make(map[string]int64)
+	bw := bufio.NewWriter(w)
+	for range cfg.Tokens {
+		word := vocab[pick()]
+		counts[word]++
+		bw.WriteString(word)
+		if err := bw.WriteByte('\n'); err != nil {
+			return nil, err
+		}
+	}
+	return counts, bw.Flush()
+}
+
+// vocabulary draws cfg.Vocabulary distinct words with lengths uniformly
+// distributed between cfg.MinLen and cfg.MaxLen.
+func vocabulary(rng *rand.Rand, cfg Config, alphabet []string) ([]string, error) {
+	seen := make(map[string]bool, cfg.Vocabulary)
+	vocab := make([]string, 0, cfg.Vocabulary)
+	for attempts := 0; len(vocab) < cfg.Vocabulary; attempts++ {
+		if attempts > 100*cfg.Vocabulary {
+			return nil, fmt.Errorf("corpus: cannot draw %d distinct words of %d-%d characters", cfg.Vocabulary, cfg.MinLen, cfg.MaxLen)
+		}
+		var sb strings.Builder
+		for range cfg.MinLen + rng.IntN(cfg.MaxLen-cfg.MinLen+1) {
+			sb.WriteString(alphabet[rng.IntN(len(alphabet))])
+		}
+		if word := sb.String(); !seen[word] {
+			seen[word] = true
+			vocab = append(vocab, word)
+		}
+	}
+	return vocab, nil
+}
+
+// Count is the reference count of a one-word-per-line input, as a plain
+// map: surrounding whitespace is trimmed and blank lines are skipped.
+func Count(r io.Reader) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if word := strings.TrimSpace(scanner.Text()); word != "" {
+			counts[word]++
+		}
+	}
+	return counts, scanner.Err()
+}
+
+// Verify checks that r holds exactly the counts in want, sorted by word
+// in ascending byte order. r may be a TSV result or a binary run; the
+// returned error names the first difference.
+func Verify(r io.Reader, want map[string]int64) error {
+	br := bufio.NewReader(r)
+	next, err := resultRecords(br)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool, len(want))
+	var prev string
+	for i := 0; ; i++ {
+		word, count, err := next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("corpus: record %d: %w", i+1, err)
+		}
+		if i > 0 && word <= prev {
+			return fmt.Errorf("corpus: record %d: %q is out of order after %q", i+1, word, prev)
+		}
+		prev = word
+		expected, ok := want[word]
+		if !ok {
+			return fmt.Errorf("corpus: unexpected word %q with count %d", word, count)
+		}
+		if count != expected {
+			return fmt.Errorf("corpus: word %q has count %d, want %d", word, count, expected)
+		}
+		seen[word] = true
+	}
+	for word := range want {
+		if !seen[word] {
+			return fmt.Errorf("corpus: %d of %d words missing, e.g. %q", len(want)-len(seen), len(want), word)
+		}
+	}
+	return nil
+}
+
+func resultRecords(br *bufio.Reader) (func() (string, int64, error), error) {
+	magic, _ := br.Peek(len(runfile.Magic))
+	if bytes.Equal(magic, []byte(runfile.Magic)) {
+		rr, err := runfile.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		return rr.Next, nil
+	}
+
+	scanner := bufio.NewScanner(br)
+	return func() (string, int64, error) {
+		if !scanner.Scan() {
+			if err := scanner.Err(); err != nil {
+				return "", 0, err
+			}
+			return "", 0, io.EOF
+		}
+		line := scanner.Text()
+		i := strings.LastIndexByte(line, '\t')
+		if i < 0 {
+			return "", 0, errors.New("missing tab in " + strconv.Quote(line))
+		}
+		count, err := strconv.ParseInt(line[i+1:], 10, 64)
+		return line[:i], count, err
+	}, nil
+}
@@ -1,3 +1,9 @@
 module github.com/andreyflyagin/wordcounter
 
 go 1.24.1
+
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/ulikunitz/xz v0.5.12
+	golang.org/x/text v0.33.0
+)
@@ -0,0 +1,50 @@
+/*
+ * wordcount.h - C API of the wordcount engine.
+ *
+ * Build the shared library with
+ *
+ *     go build -tags capi -buildmode=c-shared -o libwordcount.so ./cmd
+ *
+ * and link against it (-lwordcount), or load it with Python's ctypes or
+ * cffi. This header is the stable interface; the one go build writes next
+ * to the library also declares Go's internal types and may change.
+ *
+ * Calls are serialized. Strings returned by the library are allocated with
+ * malloc and must be released with wordcount_free.
+ */
+#ifndef WORDCOUNT_H
+#define WORDCOUNT_H
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+/*
+ * wordcount_count counts the words of the n_inputs files in inputs (one
+ * word per line, compressed files and archives included) with the default
+ * options, keeping at most max_words distinct words in memory, and writes
+ * the result as word<TAB>count lines sorted by word to output.
+ * It returns 0 on success and -1 on failure (see wordcount_last_error).
+ */
+int wordcount_count(char **inputs, int n_inputs, int max_words, char *output);
+
+/*
+ * wordcount_top_n returns the n most frequent words of a result file, as
+ * word<TAB>count lines, most frequent first, or NULL on failure.
+ */
+char *wordcount_top_n(char *result, int n);
+
+/*
+ * wordcount_last_error returns the error of the last failed call, or NULL
+ * if it succeeded.
+ */
+char *wordcount_last_error(void);
+
+/* wordcount_free releases a string returned by the library. */
+void wordcount_free(char *p);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif /* WORDCOUNT_H */
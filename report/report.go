@@ -0,0 +1,137 @@
+// Package report exposes wordcount results to text/template and
+// html/template, so report generators can render frequency tables
+// directly from a result file:
+//
+//	counts, err := report.Load(f)
+//	tmpl := template.Must(template.New("r").Funcs(report.Funcs()).Parse(
+//		`{{range topN 10 .}}{{.Word}} {{.Count}}{{"\n"}}{{end}}` +
+//			`top 100 cover {{coverage 100 . | printf "%.1f%%"}}, "go" occurs {{lookup "go" .}} times`))
+//	tmpl.Execute(w, counts)
+//
+// Every function takes the Counts last, so it can also end a pipeline
+// ({{. | topN 10}}).
+package report
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// Entry is a word and its count.
+type Entry struct {
+	Word  string
+	Count int64
+}
+
+// Counts is a loaded result, held in memory.
+type Counts struct {
+	byWord map[string]int64
+	ranked []Entry // by count descending, then word ascending
+	total  int64
+}
+
+// Load reads a wordcount result of integer counts, either a word<TAB>count
+// TSV file or a binary run (of which only the first value column is used).
+func Load(r io.Reader) (*Counts, error) {
+	c := &Counts{byWord: make(map[string]int64)}
+	add := func(word string, count int64) {
+		c.byWord[word] += count
+		c.total += count
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(runfile.Magic))
+	if bytes.Equal(magic, []byte(runfile.Magic)) {
+		rr, err := runfile.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		for {
+			word, counts, err := rr.NextInts()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			add(word, counts[0])
+		}
+	} else {
+		scanner := bufio.NewScanner(br)
+		for line := 1; scanner.Scan(); line++ {
+			text := scanner.Text()
+			i := strings.LastIndexByte(text, '\t')
+			if i < 0 {
+				return nil, fmt.Errorf("report: line %d: missing count", line)
+			}
+			count, err := strconv.ParseInt(text[i+1:], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("report: line %d: %v", line, err)
+			}
+			add(text[:i], count)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	c.ranked = make([]Entry, 0, len(c.byWord))
+	for word, count := range c.byWord {
+		c.ranked = append(c.ranked, Entry{word, count})
+	}
+	sort.Slice(c.ranked, func(i, j int) bool {
+		a, b := c.ranked[i], c.ranked[j]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		return a.Word < b.Word
+	})
+	return c, nil
+}
+
+// TopN returns the n most frequent words, ties broken alphabetically.
+func (c *Counts) TopN(n int) []Entry {
+	return c.ranked[:min(max(n, 0), len(c.ranked))]
+}
+
+// Lookup returns the count of word, or 0.
+func (c *Counts) Lookup(word string) int64 {
+	return c.byWord[word]
+}
+
+// Coverage returns the percentage of all counted tokens accounted for by
+// the n most frequent words.
+func (c *Counts) Coverage(n int) float64 {
+	if c.total == 0 {
+		return 0
+	}
+	var covered int64
+	for _, e := range c.TopN(n) {
+		covered += e.Count
+	}
+	return 100 * float64(covered) / float64(c.total)
+}
+
+// Total returns the number of counted tokens.
+func (c *Counts) Total() int64 { return c.total }
+
+// Len returns the number of distinct words.
+func (c *Counts) Len() int { return len(c.ranked) }
+
+// Funcs returns the template functions topN, lookup, coverage and total,
+// ready to pass to the Funcs method of a text/template or html/template.
+func Funcs() map[string]any {
+	return map[string]any{
+		"topN":     func(n int, c *Counts) []Entry { return c.TopN(n) },
+		"lookup":   func(word string, c *Counts) int64 { return c.Lookup(word) },
+		"coverage": func(n int, c *Counts) float64 { return c.Coverage(n) },
+		"total":    func(c *Counts) int64 { return c.Total() },
+	}
+}
@@ -0,0 +1,372 @@
+// Package result serves wordcount results from packed files: memory-mapped,
+// offset-indexed files answering lookups in O(log n) without deserializing
+// anything at load time, for latency-sensitive applications.
+//
+// # Format
+//
+// A packed file is a header, the sorted keys, an index and a footer. All
+// fixed-width integers are little-endian.
+//
+//	header:  magic "WCPACK\x00" (7 bytes) | version (1 byte) | kind (1 byte)
+//	         | 7 zero bytes
+//	keys:    key bytes of every record, concatenated in sorted order
+//	padding: zero bytes up to a multiple of 8
+//	index:   per record, uint64 offset of its key within keys
+//	         | value (int64, or IEEE 754 float64 for runfile.KindFloat)
+//	footer:  uint64 records | uint64 len(keys) | uint64 index offset
+//	         | end magic "WCPKEND\x00"
+//
+// Keys are in ascending byte-wise order, so lookups are a binary search
+// over the index; key i ends where key i+1 starts.
+package result
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"os"
+
+	"github.com/andreyflyagin/wordcounter/runfile"
+)
+
+// Magic identifies a packed result file.
+const Magic = "WCPACK\x00"
+
+// Version is the format version written by this package.
+const Version = 1
+
+const (
+	endMagic   = "WCPKEND\x00"
+	headerSize = 16
+	footerSize = 32
+	entrySize  = 16
+)
+
+var (
+	ErrNotPacked = errors.New("result: not a packed result file")
+	ErrCorrupt   = errors.New("result: corrupt packed result")
+	ErrOrder     = errors.New("result: keys not in ascending byte-wise order")
+)
+
+// Entry is a key with its value. Count is exact for integer results and
+// truncated for float ones; Value holds the value as a float64 for both.
+type Entry struct {
+	Key   string
+	Count int64
+	Value float64
+}
+
+// ------------------- Writer -------------------
+
+// Writer encodes a packed result. The keys are streamed to the output
+// directly; the index is collected in a temporary file and appended by
+// Close.
+type Writer struct {
+	w       *bufio.Writer
+	kind    runfile.Kind
+	index   *os.File
+	ibuf    *bufio.Writer
+	keysLen uint64
+	records uint64
+	last    string
+	scratch [entrySize]byte
+}
+
+// NewWriter writes the header of a packed result holding values of the
+// given kind to w. The index is buffered in a temporary file under tempDir
+// (the system default if empty). Close must be called to complete the
+// file; it does not close w.
+func NewWriter(w io.Writer, kind runfile.Kind, tempDir string) (*Writer, error) {
+	if kind != runfile.KindInt && kind != runfile.KindFloat {
+		return nil, fmt.Errorf("result: unknown kind %d", kind)
+	}
+	index, err := os.CreateTemp(tempDir, "packed_index_*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	os.Remove(index.Name())
+
+	pw := &Writer{w: bufio.NewWriter(w), kind: kind, index: index, ibuf: bufio.NewWriter(index)}
+	header := make([]byte, headerSize)
+	copy(header, Magic)
+	header[len(Magic)] = Version
+	header[len(Magic)+1] = byte(kind)
+	if _, err := pw.w.Write(header); err != nil {
+		index.Close()
+		return nil, err
+	}
+	return pw, nil
+}
+
+// Write appends an integer record. Keys must be written in ascending
+// byte-wise order.
+func (w *Writer) Write(key string, count int64) error {
+	if w.kind != runfile.KindInt {
+		return runfile.ErrLayout
+	}
+	return w.record(key, uint64(count))
+}
+
+// WriteFloat appends a float record.
+func (w *Writer) WriteFloat(key string, value float64) error {
+	if w.kind != runfile.KindFloat {
+		return runfile.ErrLayout
+	}
+	return w.record(key, math.Float64bits(value))
+}
+
+func (w *Writer) record(key string, bits uint64) error {
+	if w.records > 0 && key <= w.last {
+		return ErrOrder
+	}
+	w.last = key
+	binary.LittleEndian.PutUint64(w.scratch[:8], w.keysLen)
+	binary.LittleEndian.PutUint64(w.scratch[8:], bits)
+	if _, err := w.ibuf.Write(w.scratch[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.WriteString(key); err != nil {
+		return err
+	}
+	w.keysLen += uint64(len(key))
+	w.records++
+	return nil
+}
+
+// Close appends the index and footer and flushes the output.
+func (w *Writer) Close() error {
+	defer w.index.Close()
+	pad := (8 - (headerSize+w.keysLen)%8) % 8
+	if _, err := w.w.Write(make([]byte, pad)); err != nil {
+		return err
+	}
+	if err := w.ibuf.Flush(); err != nil {
+		return err
+	}
+	if _, err := w.index.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := io.Copy(w.w, w.index); err != nil {
+		return err
+	}
+
+	var footer [footerSize]byte
+	binary.LittleEndian.PutUint64(footer[0:], w.records)
+	binary.LittleEndian.PutUint64(footer[8:], w.keysLen)
+	binary.LittleEndian.PutUint64(footer[16:], headerSize+w.keysLen+pad)
+	copy(footer[24:], endMagic)
+	if _, err := w.w.Write(footer[:]); err != nil {
+		return err
+	}
+	return w.w.Flush()
+}
+
+// ------------------- Reader -------------------
+
+// Result is an open packed result. Its methods are safe for concurrent use.
+type Result struct {
+	data  []byte
+	kind  runfile.Kind
+	n     int
+	keys  []byte
+	index []byte
+	unmap func() error
+}
+
+// OpenResult memory-maps the packed result at path. Only the header and
+// footer are read; records are decoded on access.
+func OpenResult(path string) (*Result, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, unmap, err := mapFile(f)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newResult(data)
+	if err != nil {
+		unmap()
+		return nil, err
+	}
+	r.unmap = unmap
+	return r, nil
+}
+
+func newResult(data []byte) (*Result, error) {
+	if len(data) < headerSize+footerSize || string(data[:len(Magic)]) != Magic {
+		return nil, ErrNotPacked
+	}
+	if v := data[len(Magic)]; v != Version {
+		return nil, fmt.Errorf("result: unsupported version %d", v)
+	}
+	kind := runfile.Kind(data[len(Magic)+1])
+	if kind != runfile.KindInt && kind != runfile.KindFloat {
+		return nil, fmt.Errorf("result: unknown kind %d", kind)
+	}
+
+	footer := data[len(data)-footerSize:]
+	if string(footer[24:]) != endMagic {
+		return nil, ErrCorrupt
+	}
+	n := binary.LittleEndian.Uint64(footer[0:])
+	keysLen := binary.LittleEndian.Uint64(footer[8:])
+	indexOff := binary.LittleEndian.Uint64(footer[16:])
+	indexEnd := uint64(len(data) - footerSize)
+	if keysLen > indexEnd-headerSize || indexOff < headerSize+keysLen || indexOff > indexEnd ||
+		n > (indexEnd-indexOff)/entrySize || indexOff+n*entrySize != indexEnd {
+		return nil, ErrCorrupt
+	}
+
+	return &Result{
+		data:  data,
+		kind:  kind,
+		n:     int(n),
+		keys:  data[headerSize : headerSize+keysLen],
+		index: data[indexOff:indexEnd],
+	}, nil
+}
+
+// Close unmaps the file. Keys returned earlier remain valid.
+func (r *Result) Close() error {
+	if r.unmap == nil {
+		return nil
+	}
+	err := r.unmap()
+	r.unmap = nil
+	return err
+}
+
+// Len returns the number of records.
+func (r *Result) Len() int { return r.n }
+
+// Kind returns whether values are integers or floats.
+func (r *Result) Kind() runfile.Kind { return r.kind }
+
+// key returns the bytes of key i, which alias the mapping. Offsets that
+// point outside the keys section yield an empty key rather than a panic.
+func (r *Result) key(i int) []byte {
+	start := binary.LittleEndian.Uint64(r.index[i*entrySize:])
+	end := uint64(len(r.keys))
+	if i+1 < r.n {
+		end = binary.LittleEndian.Uint64(r.index[(i+1)*entrySize:])
+	}
+	if start > end || end > uint64(len(r.keys)) {
+		return nil
+	}
+	return r.keys[start:end]
+}
+
+// Entry returns record i, 0 <= i < Len(), in key order.
+func (r *Result) Entry(i int) Entry {
+	e := Entry{Key: string(r.key(i))}
+	bits := binary.LittleEndian.Uint64(r.index[i*entrySize+8:])
+	if r.kind == runfile.KindFloat {
+		e.Value = math.Float64frombits(bits)
+		e.Count = int64(e.Value)
+	} else {
+		e.Count = int64(bits)
+		e.Value = float64(e.Count)
+	}
+	return e
+}
+
+// search returns the index of the first key not below key.
+func (r *Result) search(key string) int {
+	lo, hi := 0, r.n
+	for lo < hi {
+		mid := int(uint(lo+hi) >> 1)
+		if string(r.key(mid)) < key {
+			lo = mid + 1
+		} else {
+			hi = mid
+		}
+	}
+	return lo
+}
+
+// Lookup returns the record of key, if present.
+func (r *Result) Lookup(key string) (Entry, bool) {
+	i := r.search(key)
+	if i == r.n || string(r.key(i)) != key {
+		return Entry{}, false
+	}
+	return r.Entry(i), true
+}
+
+// Range yields the records with from <= key < to in key order; an empty
+// to means no upper bound.
+func (r *Result) Range(from, to string) iter.Seq[Entry] {
+	return func(yield func(Entry) bool) {
+		for i := r.search(from); i < r.n; i++ {
+			if to != "" && string(r.key(i)) >= to {
+				return
+			}
+			if !yield(r.Entry(i)) {
+				return
+			}
+		}
+	}
+}
+
+// TopN returns the n records with the largest values, ties broken by key.
+// It scans the index once, keeping n candidates.
+func (r *Result) TopN(n int) []Entry {
+	if n <= 0 {
+		return nil
+	}
+	h := &topHeap{r: r}
+	for i := 0; i < r.n; i++ {
+		if h.Len() < n {
+			heap.Push(h, i)
+		} else if h.less(h.idx[0], i) {
+			h.idx[0] = i
+			heap.Fix(h, 0)
+		}
+	}
+	top := make([]Entry, h.Len())
+	for i := len(top) - 1; i >= 0; i-- {
+		top[i] = r.Entry(heap.Pop(h).(int))
+	}
+	return top
+}
+
+// topHeap is a min-heap of record indexes, the weakest candidate first.
+type topHeap struct {
+	r   *Result
+	idx []int
+}
+
+func (h *topHeap) bits(i int) uint64 {
+	return binary.LittleEndian.Uint64(h.r.index[i*entrySize+8:])
+}
+
+// less reports whether record a ranks below record b.
+func (h *topHeap) less(a, b int) bool {
+	ba, bb := h.bits(a), h.bits(b)
+	if h.r.kind == runfile.KindFloat {
+		if va, vb := math.Float64frombits(ba), math.Float64frombits(bb); va != vb {
+			return va < vb
+		}
+	} else if int64(ba) != int64(bb) {
+		return int64(ba) < int64(bb)
+	}
+	return a > b
+}
+
+func (h *topHeap) Len() int           { return len(h.idx) }
+func (h *topHeap) Less(i, j int) bool { return h.less(h.idx[i], h.idx[j]) }
+func (h *topHeap) Swap(i, j int)      { h.idx[i], h.idx[j] = h.idx[j], h.idx[i] }
+func (h *topHeap) Push(x any)         { h.idx = append(h.idx, x.(int)) }
+func (h *topHeap) Pop() any {
+	x := h.idx[len(h.idx)-1]
+	h.idx = h.idx[:len(h.idx)-1]
+	return x
+}
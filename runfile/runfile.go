@@ -0,0 +1,534 @@
+// Package runfile reads and writes wordcount runs: sequences of
+// (key, values) records sorted by key, as spilled by the input phase and
+// consumed by the merge phase.
+//
+// # Format
+//
+// A run file is a fixed header followed by a record stream and a trailer.
+// All integers are varints as produced by encoding/binary.
+//
+//	header:  magic "WCRUN\x00" (6 bytes) | version (1 byte) | codec (1 byte)
+//	         | kind (1 byte) | uvarint columns          (kind, columns: v2+)
+//	body:    record* end
+//	record:  0x01 | uvarint len(key) | key bytes | value * columns
+//	value:   varint                                   (KindInt)
+//	         IEEE 754 float64, 8 bytes little-endian   (KindFloat)
+//	end:     0x00
+//	trailer: uvarint record count | CRC-32C of the body (4 bytes, big-endian)
+//
+// The body and trailer are stored as-is for CodecNone, as a raw DEFLATE
+// stream for CodecFlate, as an S2 stream (a Snappy extension, about as
+// fast as LZ4) for CodecS2 and as a zstd stream for CodecZstd. The checksum covers the uncompressed body bytes,
+// from the first record tag up to and including the end tag.
+//
+// Version 1 files have no kind or columns bytes in the header; they always
+// hold a single KindInt column.
+//
+// Records are sorted by key, in ascending byte-wise order unless producer
+// and consumer agree on another total order (wordcount's --key-sep
+// composite keys, for instance). Readers reject
+// files with an unknown magic, a newer version, or an unknown codec or kind.
+package runfile
+
+import (
+	"bufio"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/klauspost/compress/s2"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Magic identifies a run file.
+const Magic = "WCRUN\x00"
+
+// Version is the format version written by this package.
+const Version = 2
+
+// Codec selects how the record stream is compressed.
+type Codec byte
+
+const (
+	CodecNone  Codec = 0
+	CodecFlate Codec = 1
+	CodecS2    Codec = 2
+	CodecZstd  Codec = 3
+)
+
+func (c Codec) String() string {
+	switch c {
+	case CodecNone:
+		return "none"
+	case CodecFlate:
+		return "flate"
+	case CodecS2:
+		return "s2"
+	case CodecZstd:
+		return "zstd"
+	}
+	return fmt.Sprintf("codec(%d)", byte(c))
+}
+
+// ParseCodec returns the codec with the given name.
+func ParseCodec(name string) (Codec, error) {
+	switch name {
+	case "none", "":
+		return CodecNone, nil
+	case "flate":
+		return CodecFlate, nil
+	case "s2":
+		return CodecS2, nil
+	case "zstd":
+		return CodecZstd, nil
+	}
+	return 0, fmt.Errorf("runfile: unknown codec %q", name)
+}
+
+// Kind selects how the values of a record are encoded.
+type Kind byte
+
+const (
+	KindInt   Kind = 0
+	KindFloat Kind = 1
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "int"
+	case KindFloat:
+		return "float"
+	}
+	return fmt.Sprintf("kind(%d)", byte(k))
+}
+
+// Limits a reader enforces before trusting lengths read from a file, so a
+// damaged run fails with ErrCorrupt instead of an oversized allocation.
+const (
+	MaxKeyLen  = 1 << 20
+	MaxColumns = 1 << 10
+)
+
+// Header describes how the records of a run are stored.
+type Header struct {
+	Codec   Codec
+	Kind    Kind
+	Columns int
+}
+
+const (
+	tagEnd    = 0x00
+	tagRecord = 0x01
+)
+
+var (
+	ErrNotRun   = errors.New("runfile: not a run file")
+	ErrLayout   = errors.New("runfile: values do not match the run header")
+	ErrChecksum = errors.New("runfile: checksum mismatch")
+	ErrCorrupt  = errors.New("runfile: corrupt record stream")
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// ------------------- Writer -------------------
+
+// Writer encodes records into a run file.
+type Writer struct {
+	header  Header
+	out     io.Writer
+	buf     *bufio.Writer
+	zw      io.WriteCloser
+	crc     hash.Hash32
+	records uint64
+	scratch [binary.MaxVarintLen64]byte
+	closed  bool
+}
+
+// NewWriter writes the header of a run with a single integer count per key
+// to w and returns a Writer for its records. Close must be called to write
+// the trailer; it does not close w.
+func NewWriter(w io.Writer, codec Codec) (*Writer, error) {
+	return NewHeaderWriter(w, Header{Codec: codec, Kind: KindInt, Columns: 1})
+}
+
+// NewHeaderWriter is like NewWriter but stores values as described by h.
+func NewHeaderWriter(w io.Writer, h Header) (*Writer, error) {
+	if h.Kind != KindInt && h.Kind != KindFloat {
+		return nil, fmt.Errorf("runfile: unknown kind %d", h.Kind)
+	}
+	if h.Columns < 1 || h.Columns > MaxColumns {
+		return nil, fmt.Errorf("runfile: invalid column count %d", h.Columns)
+	}
+	header := append([]byte(Magic), Version, byte(h.Codec), byte(h.Kind))
+	header = binary.AppendUvarint(header, uint64(h.Columns))
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+
+	rw := &Writer{header: h, crc: crc32.New(castagnoli)}
+	switch h.Codec {
+	case CodecNone:
+		rw.buf = bufio.NewWriter(w)
+		rw.out = rw.buf
+	case CodecFlate:
+		zw, err := flate.NewWriter(w, flate.BestSpeed)
+		if err != nil {
+			return nil, err
+		}
+		rw.zw = zw
+		rw.buf = bufio.NewWriter(zw)
+		rw.out = rw.buf
+	case CodecS2:
+		rw.zw = s2.NewWriter(w)
+		rw.buf = bufio.NewWriter(rw.zw)
+		rw.out = rw.buf
+	case CodecZstd:
+		zw, err := zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedFastest), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		rw.zw = zw
+		rw.buf = bufio.NewWriter(zw)
+		rw.out = rw.buf
+	default:
+		return nil, fmt.Errorf("runfile: unknown codec %d", h.Codec)
+	}
+	return rw, nil
+}
+
+// Header returns the layout the Writer was created with.
+func (w *Writer) Header() Header { return w.header }
+
+// Write appends one record to a single-column integer run. Keys must be
+// written in sorted order.
+func (w *Writer) Write(key string, count int64) error {
+	return w.WriteInts(key, []int64{count})
+}
+
+// WriteInts appends one record to an integer run.
+func (w *Writer) WriteInts(key string, values []int64) error {
+	if w.header.Kind != KindInt || len(values) != w.header.Columns {
+		return ErrLayout
+	}
+	if err := w.key(key); err != nil {
+		return err
+	}
+	for _, v := range values {
+		n := binary.PutVarint(w.scratch[:], v)
+		if err := w.body(w.scratch[:n]); err != nil {
+			return err
+		}
+	}
+	w.records++
+	return nil
+}
+
+// WriteFloats appends one record to a float run.
+func (w *Writer) WriteFloats(key string, values []float64) error {
+	if w.header.Kind != KindFloat || len(values) != w.header.Columns {
+		return ErrLayout
+	}
+	if err := w.key(key); err != nil {
+		return err
+	}
+	for _, v := range values {
+		binary.LittleEndian.PutUint64(w.scratch[:8], math.Float64bits(v))
+		if err := w.body(w.scratch[:8]); err != nil {
+			return err
+		}
+	}
+	w.records++
+	return nil
+}
+
+func (w *Writer) key(key string) error {
+	if len(key) > MaxKeyLen {
+		return fmt.Errorf("runfile: key of %d bytes exceeds %d", len(key), MaxKeyLen)
+	}
+	if err := w.body([]byte{tagRecord}); err != nil {
+		return err
+	}
+	n := binary.PutUvarint(w.scratch[:], uint64(len(key)))
+	if err := w.body(w.scratch[:n]); err != nil {
+		return err
+	}
+	return w.body([]byte(key))
+}
+
+// Close writes the end tag and trailer and flushes all buffered data.
+func (w *Writer) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if err := w.body([]byte{tagEnd}); err != nil {
+		return err
+	}
+	n := binary.PutUvarint(w.scratch[:], w.records)
+	if _, err := w.out.Write(w.scratch[:n]); err != nil {
+		return err
+	}
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], w.crc.Sum32())
+	if _, err := w.out.Write(sum[:]); err != nil {
+		return err
+	}
+
+	if err := w.buf.Flush(); err != nil {
+		return err
+	}
+	if w.zw != nil {
+		return w.zw.Close()
+	}
+	return nil
+}
+
+func (w *Writer) body(p []byte) error {
+	w.crc.Write(p)
+	_, err := w.out.Write(p)
+	return err
+}
+
+// ------------------- Reader -------------------
+
+// Reader decodes records from a run file.
+type Reader struct {
+	in      *bufio.Reader
+	crc     hash.Hash32
+	version byte
+	header  Header
+	records uint64
+	key     []byte
+	ints    []int64
+	floats  []float64
+	done    bool
+}
+
+// NewReader reads and validates the run header from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	header := make([]byte, len(Magic)+2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, ErrNotRun
+		}
+		return nil, err
+	}
+	if string(header[:len(Magic)]) != Magic {
+		return nil, ErrNotRun
+	}
+
+	rr := &Reader{
+		crc:     crc32.New(castagnoli),
+		version: header[len(Magic)],
+		header:  Header{Codec: Codec(header[len(Magic)+1]), Kind: KindInt, Columns: 1},
+	}
+	if rr.version == 0 || rr.version > Version {
+		return nil, fmt.Errorf("runfile: unsupported version %d", rr.version)
+	}
+
+	br := bufio.NewReader(r)
+	if rr.version >= 2 {
+		kind, err := br.ReadByte()
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		columns, err := binary.ReadUvarint(br)
+		if err != nil {
+			return nil, unexpected(err)
+		}
+		if columns > MaxColumns {
+			return nil, ErrCorrupt
+		}
+		rr.header.Kind = Kind(kind)
+		rr.header.Columns = int(columns)
+	}
+	if rr.header.Kind != KindInt && rr.header.Kind != KindFloat {
+		return nil, fmt.Errorf("runfile: unknown kind %d", rr.header.Kind)
+	}
+	if rr.header.Columns < 1 {
+		return nil, fmt.Errorf("runfile: invalid column count %d", rr.header.Columns)
+	}
+
+	switch rr.header.Codec {
+	case CodecNone:
+		rr.in = br
+	case CodecFlate:
+		rr.in = bufio.NewReader(flate.NewReader(br))
+	case CodecS2:
+		rr.in = bufio.NewReader(s2.NewReader(br))
+	case CodecZstd:
+		// Decode synchronously: a merge opens a reader per run.
+		zr, err := zstd.NewReader(br, zstd.WithDecoderConcurrency(1), zstd.WithDecoderLowmem(true))
+		if err != nil {
+			return nil, err
+		}
+		rr.in = bufio.NewReader(zr)
+	default:
+		return nil, fmt.Errorf("runfile: unknown codec %d", rr.header.Codec)
+	}
+	return rr, nil
+}
+
+// Version returns the format version of the file being read.
+func (r *Reader) Version() int { return int(r.version) }
+
+// Codec returns the codec of the file being read.
+func (r *Reader) Codec() Codec { return r.header.Codec }
+
+// Header returns the layout of the file being read.
+func (r *Reader) Header() Header { return r.header }
+
+// Next returns the next record of a single-column integer run. At the end
+// of the run it verifies the trailer and returns io.EOF.
+func (r *Reader) Next() (string, int64, error) {
+	if r.header.Kind != KindInt || r.header.Columns != 1 {
+		return "", 0, ErrLayout
+	}
+	key, values, err := r.NextInts()
+	if err != nil {
+		return "", 0, err
+	}
+	return key, values[0], nil
+}
+
+// NextInts returns the next record of an integer run. The returned slice
+// is only valid until the following call.
+func (r *Reader) NextInts() (string, []int64, error) {
+	if r.header.Kind != KindInt {
+		return "", nil, ErrLayout
+	}
+	key, err := r.nextKey()
+	if err != nil {
+		return "", nil, err
+	}
+	r.ints = r.ints[:0]
+	for range r.header.Columns {
+		v, err := r.varint()
+		if err != nil {
+			return "", nil, err
+		}
+		r.ints = append(r.ints, v)
+	}
+	r.records++
+	return key, r.ints, nil
+}
+
+// NextFloats returns the next record of a float run. The returned slice is
+// only valid until the following call.
+func (r *Reader) NextFloats() (string, []float64, error) {
+	if r.header.Kind != KindFloat {
+		return "", nil, ErrLayout
+	}
+	key, err := r.nextKey()
+	if err != nil {
+		return "", nil, err
+	}
+	r.floats = r.floats[:0]
+	var buf [8]byte
+	for range r.header.Columns {
+		if _, err := io.ReadFull(r.in, buf[:]); err != nil {
+			return "", nil, unexpected(err)
+		}
+		r.crc.Write(buf[:])
+		r.floats = append(r.floats, math.Float64frombits(binary.LittleEndian.Uint64(buf[:])))
+	}
+	r.records++
+	return key, r.floats, nil
+}
+
+func (r *Reader) nextKey() (string, error) {
+	if r.done {
+		return "", io.EOF
+	}
+
+	tag, err := r.in.ReadByte()
+	if err != nil {
+		return "", unexpected(err)
+	}
+	r.crc.Write([]byte{tag})
+
+	switch tag {
+	case tagEnd:
+		r.done = true
+		return "", r.trailer()
+	case tagRecord:
+	default:
+		return "", ErrCorrupt
+	}
+
+	keyLen, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if keyLen > MaxKeyLen {
+		return "", ErrCorrupt
+	}
+	if cap(r.key) < int(keyLen) {
+		r.key = make([]byte, keyLen)
+	}
+	r.key = r.key[:keyLen]
+	if _, err := io.ReadFull(r.in, r.key); err != nil {
+		return "", unexpected(err)
+	}
+	r.crc.Write(r.key)
+	return string(r.key), nil
+}
+
+func (r *Reader) trailer() error {
+	want := r.crc.Sum32()
+	records, err := binary.ReadUvarint(r.in)
+	if err != nil {
+		return unexpected(err)
+	}
+	var sum [4]byte
+	if _, err := io.ReadFull(r.in, sum[:]); err != nil {
+		return unexpected(err)
+	}
+	if records != r.records || binary.BigEndian.Uint32(sum[:]) != want {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+func (r *Reader) uvarint() (uint64, error) {
+	var buf [binary.MaxVarintLen64]byte
+	for i := range buf {
+		b, err := r.in.ReadByte()
+		if err != nil {
+			return 0, unexpected(err)
+		}
+		buf[i] = b
+		if b < 0x80 {
+			r.crc.Write(buf[:i+1])
+			v, n := binary.Uvarint(buf[:i+1])
+			if n <= 0 {
+				return 0, ErrCorrupt
+			}
+			return v, nil
+		}
+	}
+	return 0, ErrCorrupt
+}
+
+func (r *Reader) varint() (int64, error) {
+	ux, err := r.uvarint()
+	x := int64(ux >> 1)
+	if ux&1 != 0 {
+		x = ^x
+	}
+	return x, err
+}
+
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
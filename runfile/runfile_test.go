@@ -0,0 +1,78 @@
+package runfile
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	for _, codec := range []Codec{CodecNone, CodecFlate, CodecS2, CodecZstd} {
+		t.Run(codec.String(), func(t *testing.T) {
+			var buf bytes.Buffer
+			w, err := NewWriter(&buf, codec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			words := []string{"", "a", "b", "c\x00d"}
+			for i, word := range words {
+				if err := w.Write(word, int64(i)-1); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			r, err := NewReader(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i, word := range words {
+				key, n, err := r.Next()
+				if err != nil || key != word || n != int64(i)-1 {
+					t.Fatalf("Next() = %q, %d, %v, want %q, %d", key, n, err, word, i-1)
+				}
+			}
+			if _, _, err := r.Next(); err != io.EOF {
+				t.Fatalf("Next() at the end = %v, want io.EOF", err)
+			}
+		})
+	}
+}
+
+// TestDamagedLengths feeds lengths no writer produces, which must fail
+// with an error rather than a panic or a huge allocation.
+func TestDamagedLengths(t *testing.T) {
+	header := "WCRUN\x00\x02\x00\x00\x01"
+	tests := []struct {
+		name string
+		data string
+		want error
+	}{
+		{"huge key length", header + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01abc", ErrCorrupt},
+		{"key length above the limit", header + "\x01\x81\x80\x40abc", ErrCorrupt},
+		{"overlong key length varint", header + "\x01\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\x01", ErrCorrupt},
+		{"truncated key", header + "\x01\x10abc", io.ErrUnexpectedEOF},
+		{"truncated key length", header + "\x01\x80", io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := NewReader(bytes.NewReader([]byte(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, err := r.Next(); !errors.Is(err, tt.want) {
+				t.Fatalf("Next() = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestDamagedColumns(t *testing.T) {
+	_, err := NewReader(bytes.NewReader([]byte("WCRUN\x00\x02\x00\x00\xff\xff\xff\xff\x0f")))
+	if !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("NewReader() = %v, want ErrCorrupt", err)
+	}
+}